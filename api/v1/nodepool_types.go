@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -34,6 +35,56 @@ type NodePoolSpec struct {
 	// +optional
 	// +mapType=atomic
 	NodeSelector map[string]string `json:"nodeSelector,omitempty" protobuf:"bytes,7,rep,name=nodeSelector"`
+
+	// MinNodes, nodes can not be moved out of the nodepool below this size
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	MinNodes *int32 `json:"minNodes,omitempty"`
+
+	// MaxNodes, nodes can not be moved into the nodepool above this size
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	MaxNodes *int32 `json:"maxNodes,omitempty"`
+
+	// Resources, container resource defaults and bounds applied to pods at admission
+	// +optional
+	Resources *NodePoolResources `json:"resources,omitempty"`
+
+	// Topology, failure domain requirements of the member nodes
+	// +optional
+	Topology *NodePoolTopology `json:"topology,omitempty"`
+}
+
+// NodePoolTopology failure domain requirements of the nodepool, zones are read from the topology.kubernetes.io/zone label
+type NodePoolTopology struct {
+	// MinZones, min number of zones the member nodes must span
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MinZones *int32 `json:"minZones,omitempty"`
+
+	// MaxSkew, max difference between the node counts of the zones
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	MaxSkew *int32 `json:"maxSkew,omitempty"`
+
+	// SpreadPods, inject a zone topologySpreadConstraint with MaxSkew into pods without one at admission
+	// +optional
+	SpreadPods bool `json:"spreadPods,omitempty"`
+}
+
+// NodePoolResources container resource defaults and bounds of the nodepool
+type NodePoolResources struct {
+	// DefaultRequests, requests given to containers which set neither a request nor a limit for the resource
+	// +optional
+	DefaultRequests corev1.ResourceList `json:"defaultRequests,omitempty"`
+
+	// DefaultLimits, limits given to containers which do not set a limit for the resource
+	// +optional
+	DefaultLimits corev1.ResourceList `json:"defaultLimits,omitempty"`
+
+	// MaxLimitRequestRatio, max ratio of a container's limit to its request per resource
+	// +optional
+	MaxLimitRequestRatio corev1.ResourceList `json:"maxLimitRequestRatio,omitempty"`
 }
 
 // NodePoolStatus defines the observed state of NodePool
@@ -43,8 +94,149 @@ type NodePoolStatus struct {
 
 	// Nodes, All nodes contained in nodepool
 	Nodes []string `json:"nodes,omitempty"`
+
+	// MaxNodeAllocatable, largest allocatable of the member nodes per resource.
+	// Pods requesting more can not be scheduled into the nodepool.
+	// +optional
+	MaxNodeAllocatable corev1.ResourceList `json:"maxNodeAllocatable,omitempty"`
+
+	// Allocatable, sum of the allocatable of the member nodes
+	// +optional
+	Allocatable corev1.ResourceList `json:"allocatable,omitempty"`
+
+	// Zones, number of member nodes per topology.kubernetes.io/zone
+	// +optional
+	Zones map[string]int32 `json:"zones,omitempty"`
+
+	// Regions, number of member nodes per topology.kubernetes.io/region
+	// +optional
+	Regions map[string]int32 `json:"regions,omitempty"`
+
+	// DriftedPods, pods of the namespace running on nodes outside of the nodepool.
+	// The list is truncated to MaxDriftedPods entries, the PodsDrifted condition carries the total.
+	// +optional
+	DriftedPods []string `json:"driftedPods,omitempty"`
+
+	// Releasing, nodes which left the nodepool and are being drained of its pods
+	// +optional
+	Releasing []NodeRelease `json:"releasing,omitempty"`
+
+	// Pending, summary of pods of the namespace which can not be scheduled into the nodepool
+	// +optional
+	Pending *PendingPods `json:"pending,omitempty"`
+
+	// History, latest nodes joining and leaving the nodepool, oldest first.
+	// The list is truncated to MaxHistory entries.
+	// +optional
+	History []MembershipEvent `json:"history,omitempty"`
+
+	// Conditions, latest available observations of the nodepool's state
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// NodeRelease tracks the progress of a node leaving the nodepool
+type NodeRelease struct {
+	// Node, name of the released node
+	Node string `json:"node"`
+
+	// Phase, current step of the release
+	Phase string `json:"phase"`
+
+	// StartTime, time the release started
+	StartTime metav1.Time `json:"startTime"`
+
+	// PodsRemaining, pods of the namespace still running on the node
+	PodsRemaining int32 `json:"podsRemaining"`
+
+	// Message, human readable details of the current phase
+	// +optional
+	Message string `json:"message,omitempty"`
 }
 
+const (
+	// ReleasePhaseDraining pods of the namespace are being evicted from the cordoned node
+	ReleasePhaseDraining = "Draining"
+	// ReleasePhaseReleased the node was handed over, the entry is dropped once the node left the nodepool
+	ReleasePhaseReleased = "Released"
+)
+
+// MembershipEvent records a node joining or leaving the nodepool
+type MembershipEvent struct {
+	// Node, name of the node
+	Node string `json:"node"`
+
+	// Type, Joined or Left
+	Type string `json:"type"`
+
+	// Time, time the nodepool observed the transition
+	Time metav1.Time `json:"time"`
+
+	// Reason, cause of the transition: LabelChanged, NodeDeleted or Drained
+	Reason string `json:"reason"`
+
+	// Actor, field manager which set the nodepool label of the node, empty when unknown
+	// +optional
+	Actor string `json:"actor,omitempty"`
+}
+
+const (
+	// MembershipJoined the node became a member of the nodepool
+	MembershipJoined = "Joined"
+	// MembershipLeft the node stopped being a member of the nodepool
+	MembershipLeft = "Left"
+
+	// MembershipReasonLabelChanged the nodepool label of the node was set, changed or removed
+	MembershipReasonLabelChanged = "LabelChanged"
+	// MembershipReasonNodeDeleted the node was deleted
+	MembershipReasonNodeDeleted = "NodeDeleted"
+	// MembershipReasonDrained the node left once the pods of the namespace were drained from it
+	MembershipReasonDrained = "Drained"
+)
+
+// PendingPods summarizes unschedulable pods of the nodepool
+type PendingPods struct {
+	// Count, number of unschedulable pods
+	Count int32 `json:"count"`
+
+	// Pods, names of unschedulable pods, truncated to MaxPendingPods entries
+	// +optional
+	Pods []string `json:"pods,omitempty"`
+
+	// Since, creation time of the oldest unschedulable pod
+	// +optional
+	Since *metav1.Time `json:"since,omitempty"`
+
+	// Reason, human readable explanation of why pods do not fit into the nodepool
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+const (
+	// ConditionPodsDrifted is true when pods of the namespace run on nodes outside of the nodepool
+	ConditionPodsDrifted = "PodsDrifted"
+
+	// ConditionCapacityExhausted is true when unschedulable pods do not fit on any node of the nodepool
+	ConditionCapacityExhausted = "CapacityExhausted"
+
+	// ConditionTopologyDegraded is true when the member nodes do not satisfy spec.topology
+	ConditionTopologyDegraded = "TopologyDegraded"
+
+	// ConditionRedundant is true when the namespace inherits the nodepool of an ancestor, no pod is pinned to this one
+	ConditionRedundant = "Redundant"
+
+	// MaxDriftedPods bounds the length of NodePoolStatus.DriftedPods
+	MaxDriftedPods = 50
+
+	// MaxPendingPods bounds the length of PendingPods.Pods
+	MaxPendingPods = 50
+
+	// MaxHistory bounds the length of NodePoolStatus.History
+	MaxHistory = 50
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:JSONPath=".spec.nodeSelector",name=nodeSelector,type=string
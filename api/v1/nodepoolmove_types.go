@@ -0,0 +1,114 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodePoolReference identifies a NodePool
+type NodePoolReference struct {
+	// Namespace, namespace of the nodepool
+	Namespace string `json:"namespace"`
+
+	// Name, name of the nodepool, defaults to "default"
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// NodePoolMoveSpec defines the desired state of NodePoolMove
+type NodePoolMoveSpec struct {
+	// Nodes, names of the nodes to move
+	// +kubebuilder:validation:MinItems=1
+	Nodes []string `json:"nodes"`
+
+	// Source, the nodepool the nodes currently belong to
+	Source NodePoolReference `json:"source"`
+
+	// Target, the nodepool the nodes are moved to
+	Target NodePoolReference `json:"target"`
+
+	// DrainTimeout, max time to wait for pods of the source namespace to be evicted.
+	// The move fails when pods are still running after the timeout.
+	// +optional
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+}
+
+const (
+	MovePhasePending     = "Pending"
+	MovePhaseDraining    = "Draining"
+	MovePhaseRelabelling = "Relabelling"
+	MovePhaseCompleted   = "Completed"
+	MovePhaseFailed      = "Failed"
+)
+
+// NodePoolMoveTransition records a phase change of the move
+type NodePoolMoveTransition struct {
+	// Phase, the phase entered
+	Phase string `json:"phase"`
+
+	// Time, when the phase was entered
+	Time metav1.Time `json:"time"`
+
+	// Message, why the phase was entered
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// NodePoolMoveStatus defines the observed state of NodePoolMove
+type NodePoolMoveStatus struct {
+	// Phase, one of Pending, Draining, Relabelling, Completed, Failed
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// Message, human readable details of the current phase
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Transitions, audit trail of the phases the move went through
+	// +optional
+	Transitions []NodePoolMoveTransition `json:"transitions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:JSONPath=".spec.source.namespace",name=source,type=string
+//+kubebuilder:printcolumn:JSONPath=".spec.target.namespace",name=target,type=string
+//+kubebuilder:printcolumn:JSONPath=".status.phase",name=phase,type=string
+
+// NodePoolMove is the Schema for the nodepoolmoves API, it moves nodes from one nodepool to another
+type NodePoolMove struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodePoolMoveSpec   `json:"spec,omitempty"`
+	Status NodePoolMoveStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NodePoolMoveList contains a list of NodePoolMove
+type NodePoolMoveList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NodePoolMove `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NodePoolMove{}, &NodePoolMoveList{})
+}
@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"nodepool/controllers"
+)
+
+const (
+	// PoolLabelKey is set on admitted pods to the nodepool label value they are pinned to
+	PoolLabelKey = controllers.LabelPool
+	// AssignedByAnnotationKey records the nodepool a pod was admitted against, see Assignment
+	AssignedByAnnotationKey = controllers.AnnotationAssignedBy
+
+	// PolicyNamespace, the pod was pinned to the nodepool of its namespace
+	PolicyNamespace = controllers.PolicyNamespace
+)
+
+// Assignment is the value of the assigned-by annotation
+type Assignment = controllers.Assignment
+
+// assignmentPatches labels and annotates the pod admitted into the namespace with the nodepool it is admitted against,
+// the annotation is signed so that controllers can tell it from one written by the creator of the pod
+func assignmentPatches(pod *corev1.Pod, namespace string, p placement) ([]patchOperation, error) {
+	assignment := Assignment{Policy: p.policy}
+	if p.pool != nil {
+		assignment.Pool = fmt.Sprintf("%s/%s", p.pool.Namespace, p.pool.Name)
+		assignment.Generation = p.pool.Generation
+	}
+	if p.policy == EmptyPoolFallback {
+		assignment.Fallback = p.value
+	}
+	controllers.SignAssignment(&assignment, namespace, pod)
+	value, err := json.Marshal(assignment)
+	if err != nil {
+		return nil, err
+	}
+
+	var patch []patchOperation
+	patch = append(patch, patchMetadataEntry("/metadata/labels", pod.Labels, PoolLabelKey, p.value)...)
+	patch = append(patch, patchMetadataEntry("/metadata/annotations", pod.Annotations, AssignedByAnnotationKey, string(value))...)
+	return patch, nil
+}
+
+// patchMetadataEntry sets key of the labels or annotations map found at path, nothing is patched when already set
+func patchMetadataEntry(path string, entries map[string]string, key, value string) []patchOperation {
+	if entries == nil {
+		return []patchOperation{{Op: "add", Path: path, Value: map[string]string{key: value}}}
+	}
+	if current, ok := entries[key]; ok && current == value {
+		return nil
+	}
+	return []patchOperation{{Op: "add", Path: path + "/" + escapeJSONPointer(key), Value: value}}
+}
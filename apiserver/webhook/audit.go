@@ -0,0 +1,192 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// AuditAnnotationKey puts a single namespace in audit mode when set to "true"
+const AuditAnnotationKey = "nodepool.sunkai.xyz/audit"
+
+var (
+	// AuditMode, admit everything unchanged and only report the patches and denials the webhook would have made
+	AuditMode = false
+	// DecisionLogSize, number of recent admission decisions kept for the /decisions endpoint
+	DecisionLogSize = 200
+)
+
+// Decision is an entry of the decision log
+type Decision struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Operation string    `json:"operation"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Pool      string    `json:"pool,omitempty"`
+	Patch     string    `json:"patch,omitempty"`
+	Allowed   bool      `json:"allowed"`
+	Message   string    `json:"message,omitempty"`
+	Audit     bool      `json:"audit"`
+}
+
+// decisionLog is a fixed size ring buffer of the recent decisions
+type decisionLog struct {
+	mu      sync.Mutex
+	entries []Decision
+	next    int
+	full    bool
+}
+
+func newDecisionLog(size int) *decisionLog {
+	if size <= 0 {
+		return nil
+	}
+	return &decisionLog{entries: make([]Decision, size)}
+}
+
+func (d *decisionLog) add(decision Decision) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[d.next] = decision
+	d.next = (d.next + 1) % len(d.entries)
+	if d.next == 0 {
+		d.full = true
+	}
+}
+
+// list returns the decisions, newest first
+func (d *decisionLog) list() []Decision {
+	if d == nil {
+		return []Decision{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.next
+	if d.full {
+		n = len(d.entries)
+	}
+	out := make([]Decision, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, d.entries[(d.next-i+len(d.entries))%len(d.entries)])
+	}
+	return out
+}
+
+// review runs the mutation, applies audit mode and records the decision
+func (s *Server) review(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	resp := s.mutating(ctx, ar)
+	req := ar.Request
+	if req == nil || resp == nil {
+		return resp
+	}
+
+	decision := Decision{
+		Time:      time.Now(),
+		Kind:      req.Kind.Kind,
+		Operation: string(req.Operation),
+		Namespace: req.Namespace,
+		Name:      requestObjectName(req),
+		Patch:     string(resp.Patch),
+		Allowed:   resp.Allowed,
+	}
+	if resp.Result != nil {
+		decision.Message = resp.Result.Message
+	}
+	if s.client != nil && req.Namespace != "" {
+		if pool, err := controllers.GetNamespacePool(ctx, s.client, req.Namespace); err == nil {
+			decision.Pool = fmt.Sprintf("%s/%s", pool.Namespace, pool.Name)
+		}
+	}
+
+	// 没有变更的请求不需要审计
+	if (resp.Allowed && len(resp.Patch) == 0) || controllers.InclusionExceptionNs(req.Namespace) {
+		s.decisions.add(decision)
+		return resp
+	}
+	ns, audit := s.auditMode(ctx, req.Namespace)
+	decision.Audit = audit
+	s.decisions.add(decision)
+	if !audit {
+		return resp
+	}
+
+	var findings []string
+	if !resp.Allowed {
+		findings = append(findings, fmt.Sprintf("nodepool audit: would deny: %s", decision.Message))
+	}
+	if len(resp.Patch) > 0 {
+		findings = append(findings, fmt.Sprintf("nodepool audit: would patch: %s", resp.Patch))
+	}
+	for _, finding := range findings {
+		log.Log.Info(fmt.Sprintf("%s %s/%s: %s", req.Kind.Kind, req.Namespace, decision.Name, finding))
+		if s.recorder != nil && ns != nil {
+			s.recorder.Eventf(ns, corev1.EventTypeNormal, "NodePoolAudit", "%s %s: %s", req.Kind.Kind, decision.Name, finding)
+		}
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: append(resp.Warnings, findings...),
+	}
+}
+
+// auditMode reports whether the namespace is audited, the namespace is returned to attach events to
+func (s *Server) auditMode(ctx context.Context, namespace string) (*corev1.Namespace, bool) {
+	if s.client == nil {
+		return nil, AuditMode
+	}
+	ns := &corev1.Namespace{}
+	if err := s.client.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		return nil, AuditMode
+	}
+	if value, ok := ns.Annotations[AuditAnnotationKey]; ok {
+		return ns, value == "true"
+	}
+	return ns, AuditMode
+}
+
+// requestObjectName name of the admitted object, pods created by controllers only have a generateName yet
+func requestObjectName(req *v1beta1.AdmissionRequest) string {
+	if req.Name != "" {
+		return req.Name
+	}
+	obj := struct {
+		Metadata struct {
+			Name         string `json:"name"`
+			GenerateName string `json:"generateName"`
+		} `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return ""
+	}
+	if obj.Metadata.Name != "" {
+		return obj.Metadata.Name
+	}
+	return obj.Metadata.GenerateName
+}
+
+// DecisionsHandler serves the decision log. It names pods and their creators, so it is not served on the
+// webhook port which every client of the cluster network can reach, but on the metrics listener behind its auth proxy.
+func (s *Server) DecisionsHandler() http.Handler {
+	return http.HandlerFunc(s.decisionsHandle)
+}
+
+// decisionsHandle serves the decision log as JSON, newest first
+func (s *Server) decisionsHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.decisions.list()); err != nil {
+		log.Log.Error(err, "Can't encode decisions")
+	}
+}
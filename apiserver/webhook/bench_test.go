@@ -0,0 +1,22 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+func BenchmarkMutatingPodCreate(b *testing.B) {
+	s := newTestServer(b)
+	ar := newReview(b, "Pod", v1beta1.Create, "", "web", testPod())
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if resp := s.mutating(ctx, ar); !resp.Allowed {
+			b.Fatalf("pod create denied: %v", resp.Result)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// admitBinding checks that a pods/binding request, as sent by schedulers, targets a node of the nodepool of the pod.
+// It never patches, the binding is only admitted, warned about or rejected according to the enforcement mode.
+func (s *Server) admitBinding(ctx context.Context, req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	resp := &v1beta1.AdmissionResponse{Allowed: true}
+	if s.client == nil || controllers.InclusionExceptionNs(req.Namespace) {
+		return resp
+	}
+
+	binding := corev1.Binding{}
+	if err := json.Unmarshal(req.Object.Raw, &binding); err != nil {
+		log.Log.Error(err, "Could not unmarshal raw object: %v")
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: err.Error()}
+		return resp
+	}
+	if binding.Target.Kind != "" && binding.Target.Kind != "Node" {
+		return resp
+	}
+
+	mode := s.enforcementMode(ctx, req.Namespace)
+	if mode == EnforcementOff {
+		return resp
+	}
+
+	pod := corev1.Pod{}
+	if err := s.client.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: req.Name}, &pod); err != nil {
+		log.Log.Error(err, fmt.Sprintf("failed to get pod %s/%s", req.Namespace, req.Name))
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("pod %s/%s can not be verified: %v", req.Namespace, req.Name, err)}
+		return resp
+	}
+	// 只信任webhook创建pod时鉴权并签名记录过的skip注解
+	if controllers.IsSkipAuthorized(&pod) {
+		return resp
+	}
+	nodePod, err := controllers.IsNodePod(ctx, s.client, &pod)
+	if err != nil {
+		log.Log.Error(err, fmt.Sprintf("failed to get the owner of pod %s/%s", req.Namespace, req.Name))
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("owner of pod %s/%s can not be verified: %v", req.Namespace, req.Name, err)}
+		return resp
+	}
+	if nodePod {
+		return resp
+	}
+	// 没有ready node时被固定到fallback nodepool的pod
+	fallback, err := controllers.InFallbackPool(ctx, s.client, &pod, binding.Target.Name)
+	if err != nil {
+		log.Log.Error(err, fmt.Sprintf("failed to get node %s", binding.Target.Name))
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("nodepool of node %s can not be verified: %v", binding.Target.Name, err)}
+		return resp
+	}
+	if fallback {
+		return resp
+	}
+
+	pool, err := controllers.GetNamespacePool(ctx, s.client, req.Namespace)
+	// namespace还没有nodepool时不校验
+	if errors.IsNotFound(err) {
+		return resp
+	}
+	if err != nil {
+		log.Log.Error(err, fmt.Sprintf("failed to get nodepool of namespace %s", req.Namespace))
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("nodepool of namespace %s can not be verified: %v", req.Namespace, err)}
+		return resp
+	}
+	if controllers.NodeInPool(binding.Target.Name, pool) {
+		return resp
+	}
+
+	msg := fmt.Sprintf("binding of pod %s/%s to node %s bypasses nodepool %s/%s",
+		req.Namespace, req.Name, binding.Target.Name, pool.Namespace, pool.Name)
+	if mode == EnforcementWarn {
+		resp.Warnings = []string{msg}
+		return resp
+	}
+	resp.Allowed = false
+	resp.Result = &metav1.Status{Message: msg}
+	return resp
+}
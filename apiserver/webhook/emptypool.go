@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// EmptyPoolReject rejects pods whose nodepool has no ready node
+	EmptyPoolReject = "reject"
+	// EmptyPoolWarn admits pods whose nodepool has no ready node with an admission warning
+	EmptyPoolWarn = "warn"
+	// EmptyPoolFallback pins pods whose nodepool has no ready node to controllers.FallbackPool
+	EmptyPoolFallback = controllers.PolicyFallback
+)
+
+// EmptyPoolPolicy, handling of pods whose nodepool is unknown or has no ready node: reject, warn or
+// fallback to controllers.FallbackPool
+var EmptyPoolPolicy = EmptyPoolWarn
+
+// placement of a pod decided at admission
+type placement struct {
+	// value, nodepool label value the pod is pinned to
+	value string
+	// pool, nodepool of the namespace, nil when unknown
+	pool *poolv1.NodePool
+	// policy, PolicyNamespace or the empty pool policy applied
+	policy   string
+	warnings []string
+	// denial, set when the pod must be rejected
+	denial string
+}
+
+// podPlacement decides the nodepool label value pods of the namespace are pinned to, the value selected by
+// the nodepool of the namespace or of the ancestor it inherits from.
+// Pools and nodes are read from the informer cache of the manager client.
+func (s *Server) podPlacement(ctx context.Context, namespace string) placement {
+	p := placement{value: namespace, policy: PolicyNamespace}
+	if s.client == nil {
+		return p
+	}
+
+	var reason string
+	pool, err := controllers.GetNamespacePool(ctx, s.client, namespace)
+	switch {
+	case errors.IsNotFound(err):
+		reason = fmt.Sprintf("namespace %s has no nodepool", namespace)
+	case err != nil:
+		log.Log.Error(err, fmt.Sprintf("failed to get nodepool of namespace %s, skip empty pool check", namespace))
+		return p
+	default:
+		// 子namespace继承祖先的nodepool
+		p.pool = pool
+		p.value = controllers.PoolSelectorValue(pool)
+		ready, err := s.readyPoolNodes(ctx, pool)
+		if err != nil {
+			log.Log.Error(err, fmt.Sprintf("failed to get nodes of nodepool %s/%s, skip empty pool check", pool.Namespace, pool.Name))
+			return p
+		}
+		if ready > 0 {
+			return p
+		}
+		reason = fmt.Sprintf("nodepool %s/%s has no ready node", pool.Namespace, pool.Name)
+	}
+
+	switch EmptyPoolPolicy {
+	case EmptyPoolReject:
+		p.policy = EmptyPoolReject
+		p.denial = fmt.Sprintf("%s, the pod would stay Pending", reason)
+		return p
+	case EmptyPoolFallback:
+		if controllers.FallbackPool != "" {
+			p.value = controllers.FallbackPool
+			p.policy = EmptyPoolFallback
+			p.warnings = []string{fmt.Sprintf("%s, pod pinned to shared nodepool %s", reason, controllers.FallbackPool)}
+			return p
+		}
+	}
+	p.policy = EmptyPoolWarn
+	p.warnings = []string{fmt.Sprintf("%s, the pod will stay Pending until a node joins", reason)}
+	return p
+}
+
+// readyPoolNodes counts the ready and schedulable member nodes of the nodepool
+func (s *Server) readyPoolNodes(ctx context.Context, pool *poolv1.NodePool) (int, error) {
+	nodes, err := s.poolNodes(ctx, pool)
+	if err != nil {
+		return 0, err
+	}
+	ready := 0
+	for i := 0; i < len(nodes); i++ {
+		if controllers.IsNodeReady(&nodes[i]) && !nodes[i].Spec.Unschedulable {
+			ready++
+		}
+	}
+	return ready, nil
+}
@@ -0,0 +1,205 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
+
+// SkipVerb is the verb on nodepools a user needs to create pods carrying the skip annotation
+const SkipVerb = "skip"
+
+// exemption tells why the pod is left alone by the webhook, empty when the pod is pinned as usual.
+// skip is set when the pod is exempt by an authorized skip annotation. denial rejects a pod claiming an exemption
+// which can not be verified or whose placement its owner would not have set. warning tells why a skip annotation
+// is ignored.
+func (s *Server) exemption(ctx context.Context, req *v1beta1.AdmissionRequest, pod *corev1.Pod) (reason string, skip bool, denial, warning string) {
+	// DaemonSet的pod需要运行在所有node上，owner reference由创建者填写，只信任存在且UID一致的DaemonSet
+	if s.client != nil {
+		ds, err := controllers.PodDaemonSet(ctx, s.client, pod)
+		if err != nil {
+			log.Log.Error(err, fmt.Sprintf("failed to get the DaemonSet of pod %s/%s", req.Namespace, pod.Name))
+			return "", false, fmt.Sprintf("owner of pod %s/%s can not be verified: %v", req.Namespace, pod.Name, err), ""
+		}
+		if ds != nil {
+			if violations := daemonSetViolations(pod, ds); len(violations) > 0 {
+				return "", false, fmt.Sprintf("pod places itself unlike DaemonSet %s/%s: %s", ds.Namespace, ds.Name, strings.Join(violations, "; ")), ""
+			}
+			return "owned by DaemonSet " + ds.Name, false, "", ""
+		}
+	}
+	// 只有kubelet可以创建mirror pod，其他用户设置的mirror注解不生效
+	if controllers.IsMirrorPod(pod) && isNodeUser(req.UserInfo) {
+		if node := strings.TrimPrefix(req.UserInfo.Username, "system:node:"); pod.Spec.NodeName != node {
+			return "", false, fmt.Sprintf("mirror pod created by %s sets spec.nodeName %s", req.UserInfo.Username, pod.Spec.NodeName), ""
+		}
+		return "mirror pod", false, "", ""
+	}
+	if pod.Annotations[controllers.AnnotationSkip] != "true" {
+		return "", false, "", ""
+	}
+
+	// pod由controller创建时请求用户是controller的ServiceAccount，未授权的注解不拒绝pod，只忽略并正常固定
+	allowed, err := s.canSkip(ctx, req)
+	if err != nil {
+		log.Log.Error(err, fmt.Sprintf("failed to authorize %s annotation of user %s", controllers.AnnotationSkip, req.UserInfo.Username))
+	}
+	if err != nil || !allowed {
+		return "", false, "", fmt.Sprintf("%s annotation ignored, user %s needs %s permission on nodepools of namespace %s, the pod is pinned to its nodepool",
+			controllers.AnnotationSkip, req.UserInfo.Username, SkipVerb, req.Namespace)
+	}
+	return fmt.Sprintf("%s annotation authorized for user %s", controllers.AnnotationSkip, req.UserInfo.Username), true, "", ""
+}
+
+// daemonSetViolations lists how the placement of the pod differs from the one the DaemonSet controller creates:
+// no spec.nodeName, the nodeSelector of the template, and its required node affinity terms whose matchFields only
+// select the node by metadata.name
+func daemonSetViolations(pod *corev1.Pod, ds *appsv1.DaemonSet) []string {
+	var violations []string
+	if pod.Spec.NodeName != "" {
+		violations = append(violations, fmt.Sprintf("spec.nodeName %s is set", pod.Spec.NodeName))
+	}
+	template := &ds.Spec.Template.Spec
+	if !labels.Equals(pod.Spec.NodeSelector, template.NodeSelector) {
+		violations = append(violations, "spec.nodeSelector differs from the template")
+	}
+
+	// 没有亲和性的模板只会加上一个选择node名称的term
+	want := []corev1.NodeSelectorTerm{{}}
+	if terms := requiredTerms(template); len(terms) > 0 {
+		want = terms
+	}
+	got := requiredTerms(&pod.Spec)
+	if len(got) != len(want) {
+		return append(violations, "required nodeAffinity differs from the template")
+	}
+	for i := range got {
+		if !equality.Semantic.DeepEqual(got[i].MatchExpressions, want[i].MatchExpressions) {
+			return append(violations, "required nodeAffinity differs from the template")
+		}
+		for _, field := range got[i].MatchFields {
+			if field.Key != "metadata.name" {
+				return append(violations, fmt.Sprintf("required nodeAffinity selects field %s", field.Key))
+			}
+		}
+	}
+	return violations
+}
+
+// requiredTerms returns the required node affinity terms of the pod spec
+func requiredTerms(spec *corev1.PodSpec) []corev1.NodeSelectorTerm {
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nil
+	}
+	return spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+}
+
+// isNodeUser Whether the request is sent by a kubelet
+func isNodeUser(user authenticationv1.UserInfo) bool {
+	if strings.HasPrefix(user.Username, "system:node:") {
+		return true
+	}
+	for _, group := range user.Groups {
+		if group == "system:nodes" {
+			return true
+		}
+	}
+	return false
+}
+
+// skipPatches records on the pod admitted into the namespace that its skip annotation was authorized, drift
+// detection and binding checks only trust a recorded skip signed by the webhook
+func skipPatches(pod *corev1.Pod, namespace string) ([]patchOperation, error) {
+	assignment := Assignment{Policy: controllers.PolicySkip}
+	controllers.SignAssignment(&assignment, namespace, pod)
+	value, err := json.Marshal(assignment)
+	if err != nil {
+		return nil, err
+	}
+	return patchMetadataEntry("/metadata/annotations", pod.Annotations, AssignedByAnnotationKey, string(value)), nil
+}
+
+// admitPodUpdate rejects pod updates tampering with the records of the webhook: the pool label, the assigned-by
+// annotation, and a skip annotation added after the creation
+func admitPodUpdate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+	resp := &v1beta1.AdmissionResponse{Allowed: true}
+	if req.Operation != v1beta1.Update || controllers.InclusionExceptionNs(req.Namespace) {
+		return resp
+	}
+
+	pod, old := corev1.Pod{}, corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: err.Error()}
+		return resp
+	}
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: err.Error()}
+		return resp
+	}
+
+	var changed []string
+	if pod.Labels[PoolLabelKey] != old.Labels[PoolLabelKey] {
+		changed = append(changed, "label "+PoolLabelKey)
+	}
+	if pod.Annotations[AssignedByAnnotationKey] != old.Annotations[AssignedByAnnotationKey] {
+		changed = append(changed, "annotation "+AssignedByAnnotationKey)
+	}
+	if pod.Annotations[controllers.AnnotationSkip] == "true" && old.Annotations[controllers.AnnotationSkip] != "true" {
+		changed = append(changed, "annotation "+controllers.AnnotationSkip)
+	}
+	if len(changed) > 0 {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{Message: fmt.Sprintf("%s of pod %s/%s can only be set at creation",
+			strings.Join(changed, ", "), req.Namespace, req.Name)}
+	}
+	return resp
+}
+
+// canSkip asks the apiserver whether the requesting user may skip the nodepools of the namespace. Pods of workloads
+// are created by their controllers, whose ServiceAccount needs the permission for the annotation of the template to apply.
+func (s *Server) canSkip(ctx context.Context, req *v1beta1.AdmissionRequest) (bool, error) {
+	if s.client == nil {
+		return false, nil
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(req.UserInfo.Extra))
+	for k, v := range req.UserInfo.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   req.UserInfo.Username,
+			Groups: req.UserInfo.Groups,
+			UID:    req.UserInfo.UID,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: req.Namespace,
+				Verb:      SkipVerb,
+				Group:     poolv1.GroupVersion.Group,
+				Resource:  "nodepools",
+			},
+		},
+	}
+	if err := s.client.Create(ctx, sar); err != nil {
+		return false, err
+	}
+	return sar.Status.Allowed, nil
+}
@@ -0,0 +1,54 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AdmitPod runs the admission of a pod create against the nodepools, namespaces and nodes readable by c,
+// without a server and without recording a decision. It returns the pod as patched by the webhook,
+// nil when the pod is denied, and the response carrying the warnings or the denial.
+func AdmitPod(ctx context.Context, c client.Client, pod *corev1.Pod) (*corev1.Pod, *v1beta1.AdmissionResponse, error) {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	ar := &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Operation: v1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+
+	s := &Server{client: c}
+	resp := s.mutating(ctx, ar)
+	if !resp.Allowed {
+		return nil, resp, nil
+	}
+	if len(resp.Patch) == 0 {
+		return pod.DeepCopy(), resp, nil
+	}
+
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		return nil, resp, err
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, resp, err
+	}
+	admitted := &corev1.Pod{}
+	if err := json.Unmarshal(patched, admitted); err != nil {
+		return nil, resp, err
+	}
+	return admitted, resp, nil
+}
@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+)
+
+// resourcePatches fills missing container requests and limits from the defaults of the nodepool and checks
+// the resulting pod against the limit/request ratios and the largest member node.
+// The defaults are applied to pod as well so later checks see the admitted resources.
+func resourcePatches(pod *corev1.Pod, pool *poolv1.NodePool) (patch []patchOperation, violations []string) {
+	if pool == nil {
+		return nil, nil
+	}
+
+	if res := pool.Spec.Resources; res != nil {
+		for i := range pod.Spec.InitContainers {
+			path := fmt.Sprintf("/spec/initContainers/%d/resources", i)
+			patch = append(patch, defaultContainerResources(path, &pod.Spec.InitContainers[i], res)...)
+			violations = append(violations, checkLimitRequestRatio(&pod.Spec.InitContainers[i], res)...)
+		}
+		for i := range pod.Spec.Containers {
+			path := fmt.Sprintf("/spec/containers/%d/resources", i)
+			patch = append(patch, defaultContainerResources(path, &pod.Spec.Containers[i], res)...)
+			violations = append(violations, checkLimitRequestRatio(&pod.Spec.Containers[i], res)...)
+		}
+	}
+
+	// nodepool中最大的node也放不下
+	max := pool.Status.MaxNodeAllocatable
+	if len(max) == 0 {
+		return patch, violations
+	}
+	for name, q := range controllers.PodRequests(pod) {
+		limit, ok := max[name]
+		if ok && q.Cmp(limit) > 0 {
+			violations = append(violations, fmt.Sprintf("pod requests %s %s but the largest node of nodepool %s/%s has %s allocatable",
+				q.String(), name, pool.Namespace, pool.Name, limit.String()))
+		}
+	}
+	return patch, violations
+}
+
+// defaultContainerResources fills the missing requests and limits of the container.
+// A request is only defaulted when the container sets no limit for the resource, the apiserver copies the limit
+// into the request otherwise. A limit is not defaulted below the request of the container.
+func defaultContainerResources(path string, c *corev1.Container, res *poolv1.NodePoolResources) []patchOperation {
+	var patch []patchOperation
+
+	requests := corev1.ResourceList{}
+	for name, q := range res.DefaultRequests {
+		if _, ok := c.Resources.Requests[name]; ok {
+			continue
+		}
+		if _, ok := c.Resources.Limits[name]; ok {
+			continue
+		}
+		requests[name] = q.DeepCopy()
+	}
+	limits := corev1.ResourceList{}
+	for name, q := range res.DefaultLimits {
+		if _, ok := c.Resources.Limits[name]; ok {
+			continue
+		}
+		request, ok := c.Resources.Requests[name]
+		if !ok {
+			request, ok = requests[name]
+		}
+		if ok && request.Cmp(q) > 0 {
+			continue
+		}
+		limits[name] = q.DeepCopy()
+	}
+
+	patch = append(patch, patchResourceList(path+"/requests", &c.Resources.Requests, requests)...)
+	patch = append(patch, patchResourceList(path+"/limits", &c.Resources.Limits, limits)...)
+	return patch
+}
+
+// patchResourceList adds the entries to the resource list found at path and to list
+func patchResourceList(path string, list *corev1.ResourceList, entries corev1.ResourceList) []patchOperation {
+	if len(entries) == 0 {
+		return nil
+	}
+	if *list == nil {
+		*list = entries
+		return []patchOperation{{Op: "add", Path: path, Value: entries}}
+	}
+
+	patch := make([]patchOperation, 0, len(entries))
+	for name, q := range entries {
+		(*list)[name] = q
+		patch = append(patch, patchOperation{Op: "add", Path: path + "/" + escapeJSONPointer(string(name)), Value: q.String()})
+	}
+	return patch
+}
+
+// checkLimitRequestRatio reports the resources of the container whose limit exceeds the max ratio to its request
+func checkLimitRequestRatio(c *corev1.Container, res *poolv1.NodePoolResources) []string {
+	var violations []string
+	for name, ratio := range res.MaxLimitRequestRatio {
+		limit, ok := c.Resources.Limits[name]
+		if !ok {
+			continue
+		}
+		request, ok := c.Resources.Requests[name]
+		if !ok || request.IsZero() {
+			continue
+		}
+		if limit.AsApproximateFloat64()/request.AsApproximateFloat64() > ratio.AsApproximateFloat64() {
+			violations = append(violations, fmt.Sprintf("container %s %s limit %s exceeds %s times its request %s",
+				c.Name, name, limit.String(), ratio.String(), request.String()))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	poolv1 "nodepool/api/v1"
+)
+
+// podIdentityLabels are unique to a pod or to one revision of its workload, a spread selector matching them
+// would only count the pod itself or a part of its peers
+var podIdentityLabels = map[string]bool{
+	appsv1.StatefulSetPodNameLabel:         true,
+	appsv1.ControllerRevisionHashLabelKey:  true,
+	appsv1.DefaultDeploymentUniqueLabelKey: true,
+}
+
+// topologyPatches spreads the pod over the zones of the nodepool when spec.topology.spreadPods is set.
+// Pods with a zone constraint of their own and pods without labels to select their peers are left alone.
+func topologyPatches(pod *corev1.Pod, pool *poolv1.NodePool) []patchOperation {
+	if pool == nil || pool.Spec.Topology == nil || !pool.Spec.Topology.SpreadPods {
+		return nil
+	}
+	for _, c := range pod.Spec.TopologySpreadConstraints {
+		if c.TopologyKey == corev1.LabelTopologyZone {
+			return nil
+		}
+	}
+
+	maxSkew := int32(1)
+	if pool.Spec.Topology.MaxSkew != nil {
+		maxSkew = *pool.Spec.Topology.MaxSkew
+	}
+	matchLabels := make(map[string]string, len(pod.Labels))
+	for k, v := range pod.Labels {
+		if !podIdentityLabels[k] {
+			matchLabels[k] = v
+		}
+	}
+	if len(matchLabels) == 0 {
+		return nil
+	}
+	// 尽量分散，zone不足时pod也能调度
+	constraint := corev1.TopologySpreadConstraint{
+		MaxSkew:           maxSkew,
+		TopologyKey:       corev1.LabelTopologyZone,
+		WhenUnsatisfiable: corev1.ScheduleAnyway,
+		LabelSelector:     &metav1.LabelSelector{MatchLabels: matchLabels},
+	}
+
+	if pod.Spec.TopologySpreadConstraints == nil {
+		return []patchOperation{{
+			Op:    "add",
+			Path:  "/spec/topologySpreadConstraints",
+			Value: []corev1.TopologySpreadConstraint{constraint},
+		}}
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/topologySpreadConstraints/-", Value: constraint}}
+}
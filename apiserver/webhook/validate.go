@@ -0,0 +1,225 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// EnforcementAnnotationKey overrides DefaultEnforcementMode for a namespace
+	EnforcementAnnotationKey = "nodepool.sunkai.xyz/enforcement"
+
+	// EnforcementEnforce rejects pods bypassing the nodepool and drops unsatisfiable affinity terms
+	EnforcementEnforce = "enforce"
+	// EnforcementWarn admits pods bypassing the nodepool with an admission warning
+	EnforcementWarn = "warn"
+	// EnforcementOff disables validation
+	EnforcementOff = "off"
+)
+
+//+kubebuilder:rbac:groups="",resources=namespaces;nodes,verbs=get;list;watch
+
+// DefaultEnforcementMode is used for namespaces without the enforcement annotation
+var DefaultEnforcementMode = EnforcementEnforce
+
+// validation result of a pod against its nodepool
+type validation struct {
+	// violations which can not be fixed by mutating the pod
+	violations []string
+	// warnings about unsatisfiable affinity terms that patches remove
+	warnings []string
+	patches  []patchOperation
+}
+
+// enforcementMode returns the enforcement mode of the namespace
+func (s *Server) enforcementMode(ctx context.Context, namespace string) string {
+	if s.client == nil {
+		return DefaultEnforcementMode
+	}
+	ns := corev1.Namespace{}
+	if err := s.client.Get(ctx, types.NamespacedName{Name: namespace}, &ns); err != nil {
+		return DefaultEnforcementMode
+	}
+	switch mode := ns.Annotations[EnforcementAnnotationKey]; mode {
+	case EnforcementEnforce, EnforcementWarn, EnforcementOff:
+		return mode
+	default:
+		return DefaultEnforcementMode
+	}
+}
+
+// poolNodes returns member nodes of the nodepool, deleted nodes still listed in its status are left out
+func (s *Server) poolNodes(ctx context.Context, pool *poolv1.NodePool) ([]corev1.Node, error) {
+	nodes := make([]corev1.Node, 0, len(pool.Status.Nodes))
+	for _, name := range pool.Status.Nodes {
+		node := corev1.Node{}
+		err := s.client.Get(ctx, types.NamespacedName{Name: name}, &node)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// validationNodes returns the name and the member nodes of the nodepool the pod is validated against,
+// the fallback nodepool when the pod is pinned to it. A namespace without nodepool has no node.
+func (s *Server) validationNodes(ctx context.Context, namespace string, p placement) (string, []corev1.Node, error) {
+	if p.policy == EmptyPoolFallback {
+		nodes, err := s.labelledNodes(ctx, p.value)
+		return p.value, nodes, err
+	}
+	pool, err := controllers.GetNamespacePool(ctx, s.client, namespace)
+	if errors.IsNotFound(err) {
+		return fmt.Sprintf("%s/%s", namespace, controllers.DefaultNodePoolName), nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	nodes, err := s.poolNodes(ctx, pool)
+	return fmt.Sprintf("%s/%s", pool.Namespace, pool.Name), nodes, err
+}
+
+// labelledNodes returns the nodes labelled with the nodepool label value
+func (s *Server) labelledNodes(ctx context.Context, value string) ([]corev1.Node, error) {
+	nodeList := corev1.NodeList{}
+	if err := s.client.List(ctx, &nodeList, client.MatchingLabels{controllers.LableNodePoolKey: value}); err != nil {
+		return nil, err
+	}
+	return nodeList.Items, nil
+}
+
+// placesPod Whether the pod sets spec.nodeName or a required node affinity, the only fields validated
+func placesPod(pod *corev1.Pod) bool {
+	if pod.Spec.NodeName != "" {
+		return true
+	}
+	affinity := pod.Spec.Affinity
+	return affinity != nil && affinity.NodeAffinity != nil && affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil
+}
+
+// validatePod checks that spec.nodeName and required node affinity of the pod can be satisfied by the member
+// nodes of the nodepool named pool
+func validatePod(pod *corev1.Pod, pool string, nodes []corev1.Node) *validation {
+	v := &validation{}
+
+	if pod.Spec.NodeName != "" && !hasNode(nodes, pod.Spec.NodeName) {
+		v.violations = append(v.violations, fmt.Sprintf("spec.nodeName %s is not a member of nodepool %s",
+			pod.Spec.NodeName, pool))
+	}
+
+	// nodepool中没有node时无法判断亲和性能否满足
+	if len(nodes) == 0 || pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil {
+		return v
+	}
+	required := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		return v
+	}
+
+	satisfiable := make([]corev1.NodeSelectorTerm, 0, len(required.NodeSelectorTerms))
+	for i, term := range required.NodeSelectorTerms {
+		if termMatchesAnyNode(term, nodes) {
+			satisfiable = append(satisfiable, term)
+			continue
+		}
+		v.warnings = append(v.warnings, fmt.Sprintf("required nodeAffinity term %d matches no node of nodepool %s",
+			i, pool))
+	}
+
+	switch {
+	case len(satisfiable) == 0:
+		v.violations = append(v.violations, fmt.Sprintf("required nodeAffinity can not be satisfied by any node of nodepool %s",
+			pool))
+		v.warnings = nil
+	case len(satisfiable) < len(required.NodeSelectorTerms):
+		// 删除nodepool内无法满足的亲和性条件
+		v.patches = append(v.patches, patchOperation{
+			Op:    "replace",
+			Path:  "/spec/affinity/nodeAffinity/requiredDuringSchedulingIgnoredDuringExecution/nodeSelectorTerms",
+			Value: satisfiable,
+		})
+	}
+	return v
+}
+
+// hasNode Whether the node named name is one of the nodes
+func hasNode(nodes []corev1.Node, name string) bool {
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// termMatchesAnyNode reports whether any of the nodes satisfies the node selector term
+func termMatchesAnyNode(term corev1.NodeSelectorTerm, nodes []corev1.Node) bool {
+	// 空的term不匹配任何node
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+
+	exprSelector, err := nodeSelectorRequirementsAsSelector(term.MatchExpressions)
+	if err != nil {
+		return false
+	}
+	fieldSelector, err := nodeSelectorRequirementsAsSelector(term.MatchFields)
+	if err != nil {
+		return false
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		node := &nodes[i]
+		if !exprSelector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		if !fieldSelector.Matches(labels.Set{"metadata.name": node.Name}) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// nodeSelectorRequirementsAsSelector converts node selector requirements to a labels.Selector
+func nodeSelectorRequirementsAsSelector(reqs []corev1.NodeSelectorRequirement) (labels.Selector, error) {
+	selector := labels.NewSelector()
+	for _, req := range reqs {
+		var op selection.Operator
+		switch req.Operator {
+		case corev1.NodeSelectorOpIn:
+			op = selection.In
+		case corev1.NodeSelectorOpNotIn:
+			op = selection.NotIn
+		case corev1.NodeSelectorOpExists:
+			op = selection.Exists
+		case corev1.NodeSelectorOpDoesNotExist:
+			op = selection.DoesNotExist
+		case corev1.NodeSelectorOpGt:
+			op = selection.GreaterThan
+		case corev1.NodeSelectorOpLt:
+			op = selection.LessThan
+		default:
+			return nil, fmt.Errorf("%q is not a valid node selector operator", req.Operator)
+		}
+		r, err := labels.NewRequirement(req.Key, op, req.Values)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*r)
+	}
+	return selector, nil
+}
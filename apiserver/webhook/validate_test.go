@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// hostnameTerm requires the node named node
+func hostnameTerm(node string) corev1.NodeSelectorTerm {
+	return corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{{
+		Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{node},
+	}}}
+}
+
+func withAffinity(pod *corev1.Pod, terms ...corev1.NodeSelectorTerm) *corev1.Pod {
+	pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+	}}
+	return pod
+}
+
+func withNodeName(pod *corev1.Pod, node string) *corev1.Pod {
+	pod.Spec.NodeName = node
+	return pod
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		stale      bool
+		pod        *corev1.Pod
+		skipped    bool
+		violations int
+		warnings   int
+		patches    int
+	}{
+		{name: "no placement", pod: testPod(), skipped: true},
+		{name: "nodeName inside the pool", pod: withNodeName(testPod(), "node-a")},
+		{name: "nodeName outside the pool", pod: withNodeName(testPod(), "node-b"), violations: 1},
+		{name: "nodeName with a stale member", stale: true, pod: withNodeName(testPod(), "node-a")},
+		{name: "nodeName of the stale member", stale: true, pod: withNodeName(testPod(), "node-gone"), violations: 1},
+		{name: "satisfiable affinity", pod: withAffinity(testPod(), hostnameTerm("node-a"))},
+		{name: "unsatisfiable affinity", pod: withAffinity(testPod(), hostnameTerm("node-b")), violations: 1},
+		{
+			name:     "partially satisfiable affinity",
+			pod:      withAffinity(testPod(), hostnameTerm("node-b"), hostnameTerm("node-a")),
+			warnings: 1,
+			patches:  1,
+		},
+		{name: "nodeName outside the pool in warn mode", mode: EnforcementWarn, pod: withNodeName(testPod(), "node-b"), warnings: 1},
+		{
+			name:     "partially satisfiable affinity in warn mode",
+			mode:     EnforcementWarn,
+			pod:      withAffinity(testPod(), hostnameTerm("node-b"), hostnameTerm("node-a")),
+			warnings: 1,
+		},
+		{name: "nodeName outside the pool in off mode", mode: EnforcementOff, pod: withNodeName(testPod(), "node-b"), skipped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ctx := context.Background()
+			if tt.mode != "" {
+				ns := &corev1.Namespace{}
+				if err := s.client.Get(ctx, client.ObjectKey{Name: testNamespace}, ns); err != nil {
+					t.Fatal(err)
+				}
+				ns.Annotations = map[string]string{EnforcementAnnotationKey: tt.mode}
+				if err := s.client.Update(ctx, ns); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.stale {
+				pool := &poolv1.NodePool{}
+				if err := s.client.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: controllers.DefaultNodePoolName}, pool); err != nil {
+					t.Fatal(err)
+				}
+				pool.Status.Nodes = []string{"node-a", "node-gone"}
+				if err := s.client.Update(ctx, pool); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			v := s.validate(ctx, testNamespace, tt.pod, placement{value: testNamespace, policy: PolicyNamespace})
+			if v == nil {
+				if !tt.skipped {
+					t.Fatal("pod was not validated")
+				}
+				return
+			}
+			if tt.skipped {
+				t.Fatalf("pod was validated: %+v", v)
+			}
+			if len(v.violations) != tt.violations || len(v.warnings) != tt.warnings || len(v.patches) != tt.patches {
+				t.Fatalf("got %d violations %v, %d warnings %v, %d patches, want %d, %d, %d",
+					len(v.violations), v.violations, len(v.warnings), v.warnings, len(v.patches), tt.violations, tt.warnings, tt.patches)
+			}
+		})
+	}
+}
+
+func TestValidateFailsClosed(t *testing.T) {
+	// 没有注册NodePool类型，读取nodepool失败
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}
+	s := &Server{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(ns).Build()}
+	ctx := context.Background()
+	p := placement{value: testNamespace, policy: PolicyNamespace}
+
+	v := s.validate(ctx, testNamespace, withNodeName(testPod(), "node-b"), p)
+	if v == nil || len(v.violations) != 1 {
+		t.Fatalf("unverifiable pod admitted in enforce mode: %+v", v)
+	}
+
+	ns.Annotations = map[string]string{EnforcementAnnotationKey: EnforcementWarn}
+	if err := s.client.Update(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	v = s.validate(ctx, testNamespace, withNodeName(testPod(), "node-b"), p)
+	if v == nil || len(v.violations) != 0 || len(v.warnings) != 1 {
+		t.Fatalf("unverifiable pod not warned about in warn mode: %+v", v)
+	}
+}
@@ -1,6 +1,7 @@
 package webhook
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -11,8 +12,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/tools/record"
 	"net/http"
+	"strings"
 	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -23,6 +27,12 @@ const (
 
 	)
 
+var (
+	// TLSCertFile, TLSKeyFile, serving certificate and key of the webhook server
+	TLSCertFile = "/root/test/server.crt"
+	TLSKeyFile  = "/root/test/server.key"
+)
+
 var (
 	runtimeScheme = runtime.NewScheme()
 	codecs        = serializer.NewCodecFactory(runtimeScheme)
@@ -30,7 +40,10 @@ var (
 )
 
 type Server struct {
-	server *http.Server
+	server    *http.Server
+	client    client.Client
+	recorder  record.EventRecorder
+	decisions *decisionLog
 }
 
 type patchOperation struct {
@@ -39,9 +52,9 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-func NewServer(addr string, port int) *Server {
+func NewServer(addr string, port int, c client.Client, recorder record.EventRecorder) *Server {
 	//tlsCertKey, err := tls.X509KeyPair([]byte(CertFile), []byte(KeyFile))
-	tlsCertKey, err := tls.LoadX509KeyPair("/root/test/server.crt", "/root/test/server.key")
+	tlsCertKey, err := tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
 	if err != nil {
 		panic(err)
 	}
@@ -51,6 +64,9 @@ func NewServer(addr string, port int) *Server {
 			Addr:      fmt.Sprintf("%s:%d", addr, port),
 			TLSConfig: &tls.Config{Certificates: []tls.Certificate{tlsCertKey}},
 		},
+		client:    c,
+		recorder:  recorder,
+		decisions: newDecisionLog(DecisionLogSize),
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutating", s.mutatingHandle)
@@ -98,7 +114,7 @@ func (s *Server) mutatingHandle(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	admissionResponse = s.mutating(&ar)
+	admissionResponse = s.review(r.Context(), &ar)
 
 	admissionReview := v1beta1.AdmissionReview{}
 	if admissionResponse != nil {
@@ -124,10 +140,9 @@ func (s *Server) mutatingHandle(w http.ResponseWriter, r *http.Request) {
 }
 
 // main mutation process
-func (s *Server) mutating(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+func (s *Server) mutating(ctx context.Context, ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
 	pod := corev1.Pod{}
-	patchBytes := []byte{}
 	err := errors.New("")
 	resp := &v1beta1.AdmissionResponse{
 		Allowed: false,
@@ -137,6 +152,19 @@ func (s *Server) mutating(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionRespons
 	log.Log.Info(fmt.Sprintf("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo))
 
+	switch {
+	case req.SubResource == "binding":
+		return s.admitBinding(ctx, req)
+	case req.SubResource != "":
+		// ephemeralcontainers等子资源不会改变pod所在的node
+		log.Log.Info(fmt.Sprintf("no need Admission subresource %s of %s", req.SubResource, req.Kind.Kind))
+		resp.Allowed = true
+		return resp
+	case req.Kind.Kind == "Pod" && req.Operation != v1beta1.Create:
+		// pod的nodeSelector、nodeName和亲和性在创建后不可修改，只检查webhook记录的分配结果
+		return admitPodUpdate(req)
+	}
+
 	switch req.Kind.Kind {
 	case "Pod":
 		if err = json.Unmarshal(req.Object.Raw, &pod); err != nil {
@@ -145,10 +173,94 @@ func (s *Server) mutating(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionRespons
 			return resp
 		}
 	default:
-		log.Log.Info(fmt.Sprintf("no need Admission resource of kind %s", req.Kind.Kind))
+		if !MutateWorkloads || !isWorkloadKind(req.Kind.Kind) {
+			log.Log.Info(fmt.Sprintf("no need Admission resource of kind %s", req.Kind.Kind))
+			resp.Allowed = true
+			return resp
+		}
+	}
+
+	if req.Kind.Kind == "Pod" && !controllers.InclusionExceptionNs(req.Namespace) {
+		reason, skip, denial, warning := s.exemption(ctx, req, &pod)
+		if denial != "" {
+			resp.Result.Message = denial
+			return resp
+		}
+		if warning != "" {
+			log.Log.Info(fmt.Sprintf("pod %s/%s: %s", req.Namespace, pod.Name, warning))
+			resp.Warnings = append(resp.Warnings, warning)
+		}
+		if reason != "" {
+			log.Log.Info(fmt.Sprintf("pod %s/%s exempt from nodepool: %s", req.Namespace, pod.Name, reason))
+			if !skip {
+				resp.Allowed = true
+				return resp
+			}
+			// 记录skip注解已鉴权
+			patch, err := skipPatches(&pod, req.Namespace)
+			if err != nil {
+				resp.Result.Message = err.Error()
+				return resp
+			}
+			return patchResponse(resp, patch)
+		}
+	}
+
+	var patch []patchOperation
+	var placed placement
+	if req.Kind.Kind == "Pod" {
+		placed = s.podPlacement(ctx, req.Namespace)
+		if placed.denial != "" {
+			resp.Result.Message = placed.denial
+			return resp
+		}
+		resp.Warnings = append(resp.Warnings, placed.warnings...)
+		patch, err = patchPod(ar, &pod, placed)
+		if err != nil {
+			resp.Result.Message = err.Error()
+			return resp
+		}
+		if !controllers.InclusionExceptionNs(req.Namespace) {
+			resources, violations := resourcePatches(&pod, placed.pool)
+			if len(violations) > 0 {
+				resp.Result.Message = fmt.Sprintf("pod violates the resource bounds of its nodepool: %s", strings.Join(violations, "; "))
+				return resp
+			}
+			patch = append(patch, resources...)
+			patch = append(patch, topologyPatches(&pod, placed.pool)...)
+		}
+	} else {
+		patch, err = s.patchWorkload(ctx, ar)
+		if err != nil {
+			log.Log.Error(err, "Could not unmarshal raw object: %v")
+			resp.Result.Message = err.Error()
+			return resp
+		}
+	}
+
+	if req.Kind.Kind == "Pod" {
+		v := s.validate(ctx, req.Namespace, &pod, placed)
+		if v != nil {
+			if len(v.violations) > 0 {
+				resp.Result.Message = fmt.Sprintf("pod bypasses nodepool placement: %s", strings.Join(v.violations, "; "))
+				return resp
+			}
+			resp.Warnings = append(resp.Warnings, v.warnings...)
+			patch = append(patch, v.patches...)
+		}
+	}
+
+	return patchResponse(resp, patch)
+}
+
+// patchResponse allows the request with the JSON patch
+func patchResponse(resp *v1beta1.AdmissionResponse, patch []patchOperation) *v1beta1.AdmissionResponse {
+	if len(patch) == 0 {
+		resp.Allowed = true
+		return resp
 	}
 
-	patchBytes, err = patchPod(ar)
+	patchBytes, err := json.Marshal(patch)
 	if err != nil {
 		resp.Result.Message = err.Error()
 		return resp
@@ -164,18 +276,72 @@ func (s *Server) mutating(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionRespons
 	return resp
 }
 
-func patchPod(ar *v1beta1.AdmissionReview) ([]byte, error) {
+// validate runs the validation phase for the pod according to the enforcement mode of the namespace,
+// against the fallback nodepool when the pod is pinned to it.
+// In warn mode violations are returned as warnings and no patch is applied.
+func (s *Server) validate(ctx context.Context, namespace string, pod *corev1.Pod, p placement) *validation {
+	if s.client == nil || controllers.InclusionExceptionNs(namespace) || !placesPod(pod) {
+		return nil
+	}
+
+	mode := s.enforcementMode(ctx, namespace)
+	if mode == EnforcementOff {
+		return nil
+	}
+
+	var v *validation
+	name, nodes, err := s.validationNodes(ctx, namespace, p)
+	if err != nil {
+		// 无法确认时拒绝，warn模式下只警告
+		log.Log.Error(err, fmt.Sprintf("failed to get nodes of the nodepool of namespace %s", namespace))
+		v = &validation{violations: []string{fmt.Sprintf("nodepool placement can not be verified: %v", err)}}
+	} else {
+		v = validatePod(pod, name, nodes)
+	}
+	if mode == EnforcementWarn {
+		v.warnings = append(v.violations, v.warnings...)
+		v.violations = nil
+		v.patches = nil
+	}
+	return v
+}
+
+func patchPod(ar *v1beta1.AdmissionReview, pod *corev1.Pod, p placement) ([]patchOperation, error) {
 	var patch []patchOperation
 
 	if !controllers.InclusionExceptionNs(ar.Request.Namespace) {
-		values := make(map[string]string)
-		values[controllers.LableNodePoolKey] = ar.Request.Namespace
-		patch = append(patch, patchOperation{
+		patch = append(patch, patchPodSpec("/spec", &pod.Spec, p.value)...)
+		assignment, err := assignmentPatches(pod, ar.Request.Namespace, p)
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, assignment...)
+	}
+
+	return patch, nil
+}
+
+// patchPodSpec pins the pod spec found at basePath to the nodepool label value.
+// Other nodeSelector entries are kept, nothing is patched when the spec is already pinned.
+func patchPodSpec(basePath string, spec *corev1.PodSpec, pool string) []patchOperation {
+	if spec.NodeSelector == nil {
+		return []patchOperation{{
 			Op:    "add",
-			Path:  "/spec/nodeSelector",
-			Value: values,
-		})
+			Path:  basePath + "/nodeSelector",
+			Value: map[string]string{controllers.LableNodePoolKey: pool},
+		}}
+	}
+	if value, ok := spec.NodeSelector[controllers.LableNodePoolKey]; ok && value == pool {
+		return nil
 	}
+	return []patchOperation{{
+		Op:    "add",
+		Path:  basePath + "/nodeSelector/" + escapeJSONPointer(controllers.LableNodePoolKey),
+		Value: pool,
+	}}
+}
 
-	return json.Marshal(patch)
+// escapeJSONPointer escapes a map key for use as a JSON pointer reference token
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
 }
@@ -0,0 +1,773 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testNamespace = "tenant"
+
+func newTestServer(t testing.TB, objs ...client.Object) *Server {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := poolv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pool := &poolv1.NodePool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: controllers.DefaultNodePoolName},
+		Spec:       poolv1.NodePoolSpec{NodeSelector: map[string]string{controllers.LableNodePoolKey: testNamespace}},
+		Status:     poolv1.NodePoolStatus{Nodes: []string{"node-a"}},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}
+	objs = append(objs, pool, ns,
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{controllers.LableNodePoolKey: testNamespace}},
+			Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}},
+	)
+	return &Server{client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+func newReview(t testing.TB, kind string, op v1beta1.Operation, subResource, name string, obj interface{}) *v1beta1.AdmissionReview {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1beta1.AdmissionReview{Request: &v1beta1.AdmissionRequest{
+		Kind:        metav1.GroupVersionKind{Version: "v1", Kind: kind},
+		Resource:    metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		SubResource: subResource,
+		Name:        name,
+		Namespace:   testNamespace,
+		Operation:   op,
+		Object:      runtime.RawExtension{Raw: raw},
+	}}
+}
+
+// withTestKey signs assignments with a test key until the test ends
+func withTestKey(t testing.TB) {
+	key := controllers.AssignmentKey
+	t.Cleanup(func() { controllers.AssignmentKey = key })
+	controllers.AssignmentKey = []byte("test-key")
+}
+
+// testDaemonSet is the DaemonSet owning pods built by daemonSetPod
+func testDaemonSet() *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "agent", UID: "1"}}
+}
+
+// daemonSetPod returns a pod as the controller of testDaemonSet creates it
+func daemonSetPod() *corev1.Pod {
+	pod := testPod()
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "agent", UID: "1", Controller: &controller}}
+	pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+			MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-b"}}},
+		}}},
+	}}
+	return pod
+}
+
+func testPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "web"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+	}
+}
+
+func TestMutatingPodCreatePinsNodeSelector(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.mutating(context.Background(), newReview(t, "Pod", v1beta1.Create, "", "web", testPod()))
+	if !resp.Allowed {
+		t.Fatalf("pod create denied: %v", resp.Result)
+	}
+
+	var patch []patchOperation
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 3 || patch[0].Path != "/spec/nodeSelector" {
+		t.Fatalf("unexpected patch %s", resp.Patch)
+	}
+}
+
+func TestMutatingPodCreateLabelsAssignment(t *testing.T) {
+	s := newTestServer(t)
+	pod := testPod()
+	pod.Labels = map[string]string{"app": "web"}
+	pod.Annotations = map[string]string{"team": "a"}
+	resp := s.mutating(context.Background(), newReview(t, "Pod", v1beta1.Create, "", "web", pod))
+	if !resp.Allowed {
+		t.Fatalf("pod create denied: %v", resp.Result)
+	}
+
+	var patch []patchOperation
+	if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]interface{}, len(patch))
+	for _, op := range patch {
+		values[op.Path] = op.Value
+	}
+	if values["/metadata/labels/nodepool.sunkai.xyz~1pool"] != testNamespace {
+		t.Fatalf("pool label not patched: %s", resp.Patch)
+	}
+	raw, _ := values["/metadata/annotations/nodepool.sunkai.xyz~1assigned-by"].(string)
+	assignment := Assignment{}
+	if err := json.Unmarshal([]byte(raw), &assignment); err != nil {
+		t.Fatalf("assigned-by annotation not patched: %s", resp.Patch)
+	}
+	if assignment.Pool != testNamespace+"/"+controllers.DefaultNodePoolName || assignment.Policy != PolicyNamespace {
+		t.Fatalf("unexpected assignment %+v", assignment)
+	}
+}
+
+func TestMutatingPodUpdateIsNoop(t *testing.T) {
+	s := newTestServer(t)
+	pod := testPod()
+	pod.Labels = map[string]string{"version": "2"}
+	ar := newReview(t, "Pod", v1beta1.Update, "", "web", pod)
+	ar.Request.OldObject = newReview(t, "Pod", v1beta1.Update, "", "web", testPod()).Request.Object
+	resp := s.mutating(context.Background(), ar)
+	if !resp.Allowed {
+		t.Fatalf("pod update denied: %v", resp.Result)
+	}
+	if resp.Patch != nil {
+		t.Fatalf("pod update patched: %s", resp.Patch)
+	}
+}
+
+func TestMutatingPodUpdateKeepsAssignment(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		allowed     bool
+	}{
+		{name: "unrelated label", labels: map[string]string{"version": "2"}, allowed: true},
+		{name: "pool label", labels: map[string]string{PoolLabelKey: "other"}, allowed: false},
+		{name: "assigned-by annotation", annotations: map[string]string{AssignedByAnnotationKey: `{"policy":"skip"}`}, allowed: false},
+		{name: "skip annotation", annotations: map[string]string{controllers.AnnotationSkip: "true"}, allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			old := testPod()
+			old.Labels = map[string]string{PoolLabelKey: testNamespace}
+			pod := old.DeepCopy()
+			for k, v := range tt.labels {
+				pod.Labels[k] = v
+			}
+			pod.Annotations = tt.annotations
+
+			ar := newReview(t, "Pod", v1beta1.Update, "", "web", pod)
+			ar.Request.OldObject = newReview(t, "Pod", v1beta1.Update, "", "web", old).Request.Object
+			resp := s.mutating(context.Background(), ar)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v: %v", resp.Allowed, tt.allowed, resp.Result)
+			}
+		})
+	}
+}
+
+func TestMutatingExemption(t *testing.T) {
+	kubelet := authenticationv1.UserInfo{Username: "system:node:node-b", Groups: []string{"system:nodes"}}
+	mirror := func(node string) func(pod *corev1.Pod) {
+		return func(pod *corev1.Pod) {
+			pod.Annotations = map[string]string{controllers.MirrorPodAnnotationKey: "hash"}
+			pod.Spec.NodeName = node
+		}
+	}
+	tests := []struct {
+		name   string
+		user   authenticationv1.UserInfo
+		pod    func() *corev1.Pod
+		mutate func(pod *corev1.Pod)
+		denied bool
+		pinned bool
+	}{
+		{name: "mirror pod from kubelet", user: kubelet, mutate: mirror("node-b")},
+		{name: "mirror pod from kubelet for another node", user: kubelet, mutate: mirror("node-a"), denied: true},
+		{name: "mirror annotation from tenant", user: authenticationv1.UserInfo{Username: "tenant-user"}, mutate: mirror(""), pinned: true},
+		{name: "daemonset pod", pod: daemonSetPod},
+		// 无法确认的DaemonSet按普通pod处理，指向nodepool外node的亲和性被拒绝
+		{
+			name:   "daemonset pod with another uid",
+			pod:    daemonSetPod,
+			mutate: func(pod *corev1.Pod) { pod.OwnerReferences[0].UID = "2" },
+			denied: true,
+		},
+		{
+			name:   "foreign daemonset kind",
+			pod:    daemonSetPod,
+			mutate: func(pod *corev1.Pod) { pod.OwnerReferences[0].APIVersion = "example.com/v1" },
+			denied: true,
+		},
+		{
+			name:   "daemonset pod with nodeName",
+			pod:    daemonSetPod,
+			mutate: func(pod *corev1.Pod) { pod.Spec.NodeName = "node-b" },
+			denied: true,
+		},
+		{
+			name: "daemonset pod with node affinity of its own",
+			pod:  daemonSetPod,
+			mutate: func(pod *corev1.Pod) {
+				terms := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+				terms[0].MatchExpressions = []corev1.NodeSelectorRequirement{{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}}
+			},
+			denied: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTestKey(t)
+			s := newTestServer(t, testDaemonSet())
+			pod := testPod()
+			if tt.pod != nil {
+				pod = tt.pod()
+			}
+			if tt.mutate != nil {
+				tt.mutate(pod)
+			}
+			ar := newReview(t, "Pod", v1beta1.Create, "", "web", pod)
+			ar.Request.UserInfo = tt.user
+
+			resp := s.mutating(context.Background(), ar)
+			if resp.Allowed == tt.denied {
+				t.Fatalf("allowed = %v, want %v: %v", resp.Allowed, !tt.denied, resp.Result)
+			}
+			if pinned := resp.Patch != nil; pinned != tt.pinned {
+				t.Fatalf("pinned = %v, want %v: %s", pinned, tt.pinned, resp.Patch)
+			}
+		})
+	}
+}
+
+// sarClient answers SubjectAccessReviews with allowed
+type sarClient struct {
+	client.Client
+	allowed bool
+}
+
+func (c sarClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if sar, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+		sar.Status.Allowed = c.allowed
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestMutatingSkipAnnotation(t *testing.T) {
+	for _, allowed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("allowed %t", allowed), func(t *testing.T) {
+			withTestKey(t)
+			s := newTestServer(t)
+			s.client = sarClient{Client: s.client, allowed: allowed}
+			pod := testPod()
+			pod.Annotations = map[string]string{controllers.AnnotationSkip: "true"}
+			ar := newReview(t, "Pod", v1beta1.Create, "", "web", pod)
+			ar.Request.UserInfo = authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"}
+
+			// 未授权的注解不拒绝pod，只警告并正常固定
+			resp := s.mutating(context.Background(), ar)
+			if !resp.Allowed {
+				t.Fatalf("pod create denied: %v", resp.Result)
+			}
+			if warned := len(resp.Warnings) == 1; warned == allowed {
+				t.Fatalf("warnings %v, want a warning %t", resp.Warnings, !allowed)
+			}
+			var patch []patchOperation
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+			values := make(map[string]interface{}, len(patch))
+			for _, op := range patch {
+				values[op.Path] = op.Value
+			}
+			if _, pinned := values["/spec/nodeSelector"]; pinned == allowed {
+				t.Fatalf("pinned %t, want %t: %s", pinned, !allowed, resp.Patch)
+			}
+			raw, _ := values["/metadata/annotations/nodepool.sunkai.xyz~1assigned-by"].(string)
+			pod.Annotations[AssignedByAnnotationKey] = raw
+			if authorized := controllers.IsSkipAuthorized(pod); authorized != allowed {
+				t.Fatalf("skip recorded %t, want %t: %s", authorized, allowed, raw)
+			}
+		})
+	}
+}
+
+func TestMutatingWorkloads(t *testing.T) {
+	defer func(mutate bool) { MutateWorkloads = mutate }(MutateWorkloads)
+	MutateWorkloads = true
+	template := corev1.PodTemplateSpec{Spec: testPod().Spec}
+	tests := []struct {
+		name   string
+		kind   string
+		op     v1beta1.Operation
+		obj    interface{}
+		pinned bool
+	}{
+		{name: "deployment create", kind: "Deployment", op: v1beta1.Create, obj: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}, pinned: true},
+		{name: "deployment update", kind: "Deployment", op: v1beta1.Update, obj: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Template: template}}, pinned: true},
+		{name: "job create", kind: "Job", op: v1beta1.Create, obj: &batchv1.Job{Spec: batchv1.JobSpec{Template: template}}, pinned: true},
+		// Job的pod模板不可修改
+		{name: "job update", kind: "Job", op: v1beta1.Update, obj: &batchv1.Job{Spec: batchv1.JobSpec{Template: template}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			resp := s.mutating(context.Background(), newReview(t, tt.kind, tt.op, "", "web", tt.obj))
+			if !resp.Allowed {
+				t.Fatalf("%s denied: %v", tt.kind, resp.Result)
+			}
+			if pinned := resp.Patch != nil; pinned != tt.pinned {
+				t.Fatalf("pinned = %v, want %v: %s", pinned, tt.pinned, resp.Patch)
+			}
+		})
+	}
+}
+
+func TestMutatingEphemeralContainersIsNoop(t *testing.T) {
+	s := newTestServer(t)
+	pod := testPod()
+	pod.Spec.NodeName = "node-b"
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"},
+	}}
+	resp := s.mutating(context.Background(), newReview(t, "Pod", v1beta1.Update, "ephemeralcontainers", "web", pod))
+	if !resp.Allowed {
+		t.Fatalf("ephemeral container denied: %v", resp.Result)
+	}
+	if resp.Patch != nil {
+		t.Fatalf("ephemeral container patched: %s", resp.Patch)
+	}
+}
+
+func TestMutatingBinding(t *testing.T) {
+	withTestKey(t)
+	tests := []struct {
+		name     string
+		node     string
+		mode     string
+		pod      *corev1.Pod
+		allowed  bool
+		warnings int
+	}{
+		{name: "member node", node: "node-a", allowed: true},
+		{name: "foreign node", node: "node-b", allowed: false},
+		{name: "foreign node in warn mode", node: "node-b", mode: EnforcementWarn, allowed: true, warnings: 1},
+		{name: "foreign node in off mode", node: "node-b", mode: EnforcementOff, allowed: true},
+		{
+			name: "unrecorded skip annotation on foreign node",
+			node: "node-b",
+			pod: func() *corev1.Pod {
+				pod := testPod()
+				pod.Annotations = map[string]string{controllers.AnnotationSkip: "true"}
+				return pod
+			}(),
+			allowed: false,
+		},
+		{
+			name: "unsigned skip record on foreign node",
+			node: "node-b",
+			pod: func() *corev1.Pod {
+				pod := testPod()
+				pod.Annotations = map[string]string{
+					controllers.AnnotationSkip: "true",
+					AssignedByAnnotationKey:    `{"policy":"skip"}`,
+				}
+				return pod
+			}(),
+			allowed: false,
+		},
+		{
+			name: "authorized skip annotation on foreign node",
+			node: "node-b",
+			pod: func() *corev1.Pod {
+				pod := testPod()
+				pod.Annotations = map[string]string{controllers.AnnotationSkip: "true"}
+				assignment := Assignment{Policy: controllers.PolicySkip}
+				controllers.SignAssignment(&assignment, testNamespace, pod)
+				raw, _ := json.Marshal(assignment)
+				pod.Annotations[AssignedByAnnotationKey] = string(raw)
+				return pod
+			}(),
+			allowed: true,
+		},
+		{name: "daemonset pod on foreign node", node: "node-b", pod: daemonSetPod(), allowed: true},
+		{
+			name: "daemonset pod with another uid on foreign node",
+			node: "node-b",
+			pod: func() *corev1.Pod {
+				pod := daemonSetPod()
+				pod.OwnerReferences[0].UID = "2"
+				return pod
+			}(),
+			allowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := tt.pod
+			if pod == nil {
+				pod = testPod()
+			}
+			s := newTestServer(t, pod, testDaemonSet())
+			if tt.mode != "" {
+				ns := &corev1.Namespace{}
+				if err := s.client.Get(context.Background(), client.ObjectKey{Name: testNamespace}, ns); err != nil {
+					t.Fatal(err)
+				}
+				ns.Annotations = map[string]string{EnforcementAnnotationKey: tt.mode}
+				if err := s.client.Update(context.Background(), ns); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			binding := &corev1.Binding{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: pod.Name},
+				Target:     corev1.ObjectReference{Kind: "Node", Name: tt.node},
+			}
+			resp := s.mutating(context.Background(), newReview(t, "Binding", v1beta1.Create, "binding", pod.Name, binding))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v: %v", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if len(resp.Warnings) != tt.warnings {
+				t.Fatalf("warnings = %v, want %d", resp.Warnings, tt.warnings)
+			}
+			if resp.Patch != nil {
+				t.Fatalf("binding patched: %s", resp.Patch)
+			}
+		})
+	}
+}
+
+// failingClient fails every Get of the given type
+type failingClient struct {
+	client.Client
+	obj client.Object
+}
+
+func (c failingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if reflect.TypeOf(obj) == reflect.TypeOf(c.obj) {
+		return fmt.Errorf("get %T %s: connection refused", obj, key)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestMutatingBindingFailsClosed(t *testing.T) {
+	withTestKey(t)
+	defer func(fallback string) { controllers.FallbackPool = fallback }(controllers.FallbackPool)
+	controllers.FallbackPool = "shared"
+
+	fallbackPod := testPod()
+	assignment := Assignment{Policy: controllers.PolicyFallback, Fallback: "shared"}
+	controllers.SignAssignment(&assignment, testNamespace, fallbackPod)
+	raw, _ := json.Marshal(assignment)
+	fallbackPod.Annotations = map[string]string{AssignedByAnnotationKey: string(raw)}
+
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		fail client.Object
+	}{
+		{name: "pod get error", pod: testPod(), fail: &corev1.Pod{}},
+		{name: "node get error", pod: fallbackPod, fail: &corev1.Node{}},
+		{name: "nodepool get error", pod: testPod(), fail: &poolv1.NodePool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.pod)
+			s.client = failingClient{Client: s.client, obj: tt.fail}
+			binding := &corev1.Binding{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: tt.pod.Name},
+				Target:     corev1.ObjectReference{Kind: "Node", Name: "node-a"},
+			}
+			resp := s.mutating(context.Background(), newReview(t, "Binding", v1beta1.Create, "binding", tt.pod.Name, binding))
+			if resp.Allowed {
+				t.Fatalf("binding allowed although it could not be verified")
+			}
+		})
+	}
+
+	// namespace还没有nodepool时放行
+	s := newTestServer(t, testPod())
+	if err := s.client.Delete(context.Background(), &poolv1.NodePool{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: controllers.DefaultNodePoolName}}); err != nil {
+		t.Fatal(err)
+	}
+	binding := &corev1.Binding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testPod().Name},
+		Target:     corev1.ObjectReference{Kind: "Node", Name: "node-b"},
+	}
+	if resp := s.mutating(context.Background(), newReview(t, "Binding", v1beta1.Create, "binding", testPod().Name, binding)); !resp.Allowed {
+		t.Fatalf("binding in a namespace without nodepool denied: %v", resp.Result)
+	}
+}
+
+func TestReviewAuditMode(t *testing.T) {
+	s := newTestServer(t)
+	s.decisions = newDecisionLog(2)
+	ns := &corev1.Namespace{}
+	if err := s.client.Get(context.Background(), client.ObjectKey{Name: testNamespace}, ns); err != nil {
+		t.Fatal(err)
+	}
+	ns.Annotations = map[string]string{AuditAnnotationKey: "true"}
+	if err := s.client.Update(context.Background(), ns); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := testPod()
+	pod.Spec.NodeName = "node-b"
+	for i := 0; i < 3; i++ {
+		resp := s.review(context.Background(), newReview(t, "Pod", v1beta1.Create, "", "web", pod))
+		if !resp.Allowed || resp.Patch != nil {
+			t.Fatalf("audited pod was not admitted unchanged: %+v", resp)
+		}
+		if len(resp.Warnings) != 1 {
+			t.Fatalf("warnings = %v, want the would-be denial", resp.Warnings)
+		}
+	}
+
+	decisions := s.decisions.list()
+	if len(decisions) != 2 {
+		t.Fatalf("decision log kept %d entries, want 2", len(decisions))
+	}
+	if d := decisions[0]; d.Allowed || !d.Audit || d.Pool != testNamespace+"/"+controllers.DefaultNodePoolName {
+		t.Fatalf("unexpected decision %+v", d)
+	}
+}
+
+func TestMutatingEmptyPoolPolicy(t *testing.T) {
+	defer func(policy, fallback string) { EmptyPoolPolicy, controllers.FallbackPool = policy, fallback }(EmptyPoolPolicy, controllers.FallbackPool)
+	controllers.FallbackPool = "shared"
+
+	tests := []struct {
+		policy   string
+		allowed  bool
+		selector string
+	}{
+		{policy: EmptyPoolReject, allowed: false},
+		{policy: EmptyPoolWarn, allowed: true, selector: "orphan"},
+		{policy: EmptyPoolFallback, allowed: true, selector: "shared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			EmptyPoolPolicy = tt.policy
+			s := newTestServer(t)
+			ar := newReview(t, "Pod", v1beta1.Create, "", "web", testPod())
+			ar.Request.Namespace = "orphan"
+
+			resp := s.mutating(context.Background(), ar)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v: %v", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed {
+				return
+			}
+			if len(resp.Warnings) != 1 {
+				t.Fatalf("warnings = %v, want 1", resp.Warnings)
+			}
+			var patch []patchOperation
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatal(err)
+			}
+			selector, _ := patch[0].Value.(map[string]interface{})
+			if selector[controllers.LableNodePoolKey] != tt.selector {
+				t.Fatalf("pinned to %v, want %s", patch[0].Value, tt.selector)
+			}
+		})
+	}
+}
+
+func TestResourcePatches(t *testing.T) {
+	pool := &poolv1.NodePool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: controllers.DefaultNodePoolName},
+		Spec: poolv1.NodePoolSpec{Resources: &poolv1.NodePoolResources{
+			DefaultRequests:      corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m"), corev1.ResourceMemory: resource.MustParse("128Mi")},
+			DefaultLimits:        corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("400m")},
+			MaxLimitRequestRatio: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")},
+		}},
+		Status: poolv1.NodePoolStatus{MaxNodeAllocatable: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("4")}},
+	}
+
+	pod := testPod()
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name: "sidecar",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")},
+		},
+	})
+	patch, violations := resourcePatches(pod, pool)
+	if len(violations) > 0 {
+		t.Fatalf("unexpected violations %v", violations)
+	}
+	paths := make(map[string]bool, len(patch))
+	for _, op := range patch {
+		paths[op.Path] = true
+	}
+	for _, path := range []string{"/spec/containers/0/resources/requests", "/spec/containers/0/resources/limits"} {
+		if !paths[path] {
+			t.Fatalf("%s not defaulted: %+v", path, patch)
+		}
+	}
+	// sidecar设置了cpu limit和内存request，不应再补充
+	if len(paths) != 2 {
+		t.Fatalf("sidecar resources were overridden: %+v", patch)
+	}
+
+	pod = testPod()
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")}
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+	if _, violations = resourcePatches(pod, pool); len(violations) != 1 {
+		t.Fatalf("limit/request ratio not enforced: %v", violations)
+	}
+
+	pod = testPod()
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("6")}
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("6")}
+	if _, violations = resourcePatches(pod, pool); len(violations) != 1 {
+		t.Fatalf("request above the largest node admitted: %v", violations)
+	}
+}
+
+func TestTopologyPatches(t *testing.T) {
+	skew := int32(2)
+	pool := &poolv1.NodePool{Spec: poolv1.NodePoolSpec{Topology: &poolv1.NodePoolTopology{MaxSkew: &skew, SpreadPods: true}}}
+
+	pod := testPod()
+	if patch := topologyPatches(pod, pool); patch != nil {
+		t.Fatalf("pod without labels was spread: %+v", patch)
+	}
+
+	// 只有单个pod或版本的label时选不到同类pod
+	pod.Labels = map[string]string{appsv1.StatefulSetPodNameLabel: "web-0", appsv1.ControllerRevisionHashLabelKey: "web-5d8f"}
+	if patch := topologyPatches(pod, pool); patch != nil {
+		t.Fatalf("pod with only per-pod labels was spread: %+v", patch)
+	}
+
+	pod.Labels = map[string]string{
+		"app":                                  "web",
+		appsv1.StatefulSetPodNameLabel:         "web-0",
+		appsv1.ControllerRevisionHashLabelKey:  "web-5d8f",
+		appsv1.DefaultDeploymentUniqueLabelKey: "7c9b",
+	}
+	patch := topologyPatches(pod, pool)
+	if len(patch) != 1 || patch[0].Path != "/spec/topologySpreadConstraints" {
+		t.Fatalf("unexpected patch %+v", patch)
+	}
+	constraints, _ := patch[0].Value.([]corev1.TopologySpreadConstraint)
+	if len(constraints) != 1 || constraints[0].MaxSkew != skew {
+		t.Fatalf("unexpected constraint %+v", patch[0].Value)
+	}
+	if want := map[string]string{"app": "web"}; !reflect.DeepEqual(constraints[0].LabelSelector.MatchLabels, want) {
+		t.Fatalf("spread selector %v, want %v", constraints[0].LabelSelector.MatchLabels, want)
+	}
+
+	pod.Spec.TopologySpreadConstraints = constraints
+	if patch := topologyPatches(pod, pool); patch != nil {
+		t.Fatalf("pod with a zone constraint was spread again: %+v", patch)
+	}
+}
+
+func TestMutatingPodCreateInheritsParentPool(t *testing.T) {
+	child := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "tenant-ci",
+		Labels: map[string]string{controllers.HNCTreeLabel(testNamespace): "1"},
+	}}
+	s := newTestServer(t, child)
+	pod := testPod()
+	pod.Namespace = child.Name
+
+	admitted, resp, err := AdmitPod(context.Background(), s.client, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admitted == nil {
+		t.Fatalf("pod create denied: %v", resp.Result)
+	}
+	if admitted.Spec.NodeSelector[controllers.LableNodePoolKey] != testNamespace {
+		t.Fatalf("pod pinned to %v, want the parent's nodepool %s", admitted.Spec.NodeSelector, testNamespace)
+	}
+	assignment := Assignment{}
+	if err := json.Unmarshal([]byte(admitted.Annotations[AssignedByAnnotationKey]), &assignment); err != nil {
+		t.Fatal(err)
+	}
+	if assignment.Pool != testNamespace+"/"+controllers.DefaultNodePoolName {
+		t.Fatalf("pod admitted against %s, want the parent's nodepool", assignment.Pool)
+	}
+}
+
+func TestMutatingBindingAfterFallback(t *testing.T) {
+	withTestKey(t)
+	defer func(policy, fallback string) { EmptyPoolPolicy, controllers.FallbackPool = policy, fallback }(EmptyPoolPolicy, controllers.FallbackPool)
+	EmptyPoolPolicy, controllers.FallbackPool = EmptyPoolFallback, "shared"
+
+	empty := &poolv1.NodePool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "empty", Name: controllers.DefaultNodePoolName},
+		Spec:       poolv1.NodePoolSpec{NodeSelector: map[string]string{controllers.LableNodePoolKey: "empty"}},
+	}
+	shared := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-shared", Labels: map[string]string{controllers.LableNodePoolKey: "shared"}}}
+	s := newTestServer(t, empty, shared, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "empty"}})
+	ctx := context.Background()
+
+	pod := testPod()
+	pod.Namespace = empty.Namespace
+	admitted, resp, err := AdmitPod(ctx, s.client, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admitted == nil {
+		t.Fatalf("pod create denied: %v", resp.Result)
+	}
+	if admitted.Spec.NodeSelector[controllers.LableNodePoolKey] != "shared" {
+		t.Fatalf("pod pinned to %v, want the fallback nodepool", admitted.Spec.NodeSelector)
+	}
+	if err := s.client.Create(ctx, admitted); err != nil {
+		t.Fatal(err)
+	}
+
+	for node, allowed := range map[string]bool{"node-shared": true, "node-b": false} {
+		binding := &corev1.Binding{
+			ObjectMeta: metav1.ObjectMeta{Namespace: empty.Namespace, Name: pod.Name},
+			Target:     corev1.ObjectReference{Kind: "Node", Name: node},
+		}
+		ar := newReview(t, "Binding", v1beta1.Create, "binding", pod.Name, binding)
+		ar.Request.Namespace = empty.Namespace
+		if resp := s.mutating(ctx, ar); resp.Allowed != allowed {
+			t.Fatalf("binding to %s: allowed = %v, want %v: %v", node, resp.Allowed, allowed, resp.Result)
+		}
+	}
+
+	// 指定fallback nodepool的node
+	pod = testPod()
+	pod.Namespace = empty.Namespace
+	pod.Spec.NodeName = "node-shared"
+	if admitted, resp, err = AdmitPod(ctx, s.client, pod); err != nil || admitted == nil {
+		t.Fatalf("pod with nodeName in the fallback nodepool denied: %v %v", err, resp.Result)
+	}
+}
@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"nodepool/controllers"
+)
+
+// MutateWorkloads, also pin the pod templates of workload objects so the placement shows at the workload level
+var MutateWorkloads = false
+
+// podSpecPaths is the JSON pointer of the pod template spec of each workload kind.
+// DaemonSets are left out, their pods are exempt from nodepools.
+var podSpecPaths = map[string]string{
+	"Deployment":  "/spec/template/spec",
+	"ReplicaSet":  "/spec/template/spec",
+	"StatefulSet": "/spec/template/spec",
+	"Job":         "/spec/template/spec",
+	"CronJob":     "/spec/jobTemplate/spec/template/spec",
+}
+
+func isWorkloadKind(kind string) bool {
+	_, ok := podSpecPaths[kind]
+	return ok
+}
+
+// patchWorkload pins the pod template of the workload object to the nodepool of the namespace.
+// Templates are never pinned to the fallback nodepool, the empty pool policy only applies to pods.
+func (s *Server) patchWorkload(ctx context.Context, ar *v1beta1.AdmissionReview) ([]patchOperation, error) {
+	req := ar.Request
+	if controllers.InclusionExceptionNs(req.Namespace) {
+		return nil, nil
+	}
+	// Job的pod模板创建后不可修改，更新时的patch会让apiserver拒绝请求
+	if req.Kind.Kind == "Job" && req.Operation != v1beta1.Create {
+		return nil, nil
+	}
+
+	spec, err := workloadPodSpec(req.Kind.Kind, req.Object.Raw)
+	if err != nil {
+		return nil, err
+	}
+	value := req.Namespace
+	if s.client != nil {
+		// 子namespace继承祖先的nodepool
+		if pool, err := controllers.GetNamespacePool(ctx, s.client, req.Namespace); err == nil {
+			value = controllers.PoolSelectorValue(pool)
+		}
+	}
+	return patchPodSpec(podSpecPaths[req.Kind.Kind], spec, value), nil
+}
+
+// workloadPodSpec decodes the pod template spec of the workload object
+func workloadPodSpec(kind string, raw []byte) (*corev1.PodSpec, error) {
+	switch kind {
+	case "Deployment":
+		obj := appsv1.Deployment{}
+		err := json.Unmarshal(raw, &obj)
+		return &obj.Spec.Template.Spec, err
+	case "ReplicaSet":
+		obj := appsv1.ReplicaSet{}
+		err := json.Unmarshal(raw, &obj)
+		return &obj.Spec.Template.Spec, err
+	case "StatefulSet":
+		obj := appsv1.StatefulSet{}
+		err := json.Unmarshal(raw, &obj)
+		return &obj.Spec.Template.Spec, err
+	case "Job":
+		obj := batchv1.Job{}
+		err := json.Unmarshal(raw, &obj)
+		return &obj.Spec.Template.Spec, err
+	default:
+		obj := batchv1.CronJob{}
+		err := json.Unmarshal(raw, &obj)
+		return &obj.Spec.JobTemplate.Spec.Template.Spec, err
+	}
+}
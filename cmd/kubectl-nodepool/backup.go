@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+)
+
+const (
+	// backupAPIVersion, version of the backup format, restore refuses other versions
+	backupAPIVersion = "nodepool.sunkai.xyz/backup/v1"
+	backupKind       = "NodePoolBackup"
+	// backupConfigMapKey, key of the backup in the data of the ConfigMap
+	backupConfigMapKey = "backup.yaml"
+	// annotationPrefix, namespace annotations configuring nodepools
+	annotationPrefix = "nodepool.sunkai.xyz/"
+	// hostnameLabel, node label set by the kubelet to its hostname
+	hostnameLabel = "kubernetes.io/hostname"
+)
+
+const (
+	matchProviderID = "providerID"
+	matchHostname   = "hostname"
+	matchLabels     = "labels"
+)
+
+// backup is a snapshot of the nodepools, their namespaces and the nodes assigned to them
+type backup struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	CreatedAt  metav1.Time `json:"createdAt"`
+
+	NodePools  []backupPool      `json:"nodePools"`
+	Namespaces []backupNamespace `json:"namespaces"`
+	Nodes      []backupNode      `json:"nodes"`
+}
+
+type backupPool struct {
+	Namespace string              `json:"namespace"`
+	Name      string              `json:"name"`
+	Spec      poolv1.NodePoolSpec `json:"spec"`
+}
+
+// backupNamespace, a namespace with a nodepool and its nodepool annotations
+type backupNamespace struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// backupNode, a node assigned to a nodepool and the identifiers restore matches new nodes by
+type backupNode struct {
+	Name       string `json:"name"`
+	ProviderID string `json:"providerID,omitempty"`
+	// Labels, only the hostname label and the --match-labels keys of the backup, full label maps of large
+	// clusters do not fit in a ConfigMap
+	Labels map[string]string `json:"labels,omitempty"`
+	// Value, nodepool label value of the node
+	Value string `json:"value"`
+}
+
+// backup and restore flags
+var (
+	backupFile      string
+	backupConfigMap string
+	matchBy         string
+	hostnamePattern string
+	matchLabelKeys  string
+	overwrite       bool
+	dryRun          bool
+)
+
+var backupCommand = &command{
+	usage: "backup [-o <file>] [--configmap <namespace>/<name>] [--match-labels <keys>]",
+	help:  "Snapshot the nodepools, their namespaces and the node assignments",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&backupFile, "o", "", "Write the backup to this file instead of stdout")
+		fs.StringVar(&backupConfigMap, "configmap", "", "Store the backup in this ConfigMap, created if missing")
+		fs.StringVar(&matchLabelKeys, "match-labels", "", "Comma separated label keys kept with the nodes for restore --match=labels, besides the hostname label")
+	},
+	run: runBackup,
+}
+
+var restoreCommand = &command{
+	usage: "restore (-f <file> | --configmap <namespace>/<name>)",
+	help:  "Recreate missing nodepools and label new nodes matching the backed up ones",
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&backupFile, "f", "", "Read the backup from this file")
+		fs.StringVar(&backupConfigMap, "configmap", "", "Read the backup from this ConfigMap")
+		fs.StringVar(&matchBy, "match", matchHostname, "Identify the nodes by hostname, providerID or labels")
+		fs.StringVar(&hostnamePattern, "hostname-pattern", "", "With --match=hostname, compare the first group of this regexp instead of the whole hostname, eg: ^(.*)-[a-z0-9]{5}$")
+		fs.StringVar(&matchLabelKeys, "match-labels", "", "With --match=labels, comma separated label keys whose values identify the nodes, the backup must have been taken with them")
+		fs.BoolVar(&overwrite, "overwrite", false, "Relabel nodes already in a nodepool and restore the spec of existing nodepools")
+		fs.BoolVar(&dryRun, "dry-run", false, "Print the changes without applying them")
+	},
+	run: runRestore,
+}
+
+func runBackup(ctx context.Context, c *cli, _ []string) error {
+	b, err := takeBackup(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case backupConfigMap != "":
+		if err := saveBackupConfigMap(ctx, c.client, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "backup of %d nodepool(s) and %d node(s) stored in configmap/%s\n", len(b.NodePools), len(b.Nodes), backupConfigMap)
+	case backupFile != "":
+		if err := os.WriteFile(backupFile, data, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "backup of %d nodepool(s) and %d node(s) written to %s\n", len(b.NodePools), len(b.Nodes), backupFile)
+	default:
+		_, err = c.out.Write(data)
+	}
+	return err
+}
+
+// takeBackup snapshots the nodepools, the namespaces holding them and the labelled nodes
+func takeBackup(ctx context.Context, c client.Client) (*backup, error) {
+	b := &backup{APIVersion: backupAPIVersion, Kind: backupKind, CreatedAt: metav1.Now()}
+
+	pools := poolv1.NodePoolList{}
+	if err := c.List(ctx, &pools); err != nil {
+		return nil, err
+	}
+	namespaces := make(map[string]bool)
+	for _, pool := range pools.Items {
+		b.NodePools = append(b.NodePools, backupPool{Namespace: pool.Namespace, Name: pool.Name, Spec: pool.Spec})
+		namespaces[pool.Namespace] = true
+	}
+	sort.Slice(b.NodePools, func(i, j int) bool {
+		return b.NodePools[i].Namespace+"/"+b.NodePools[i].Name < b.NodePools[j].Namespace+"/"+b.NodePools[j].Name
+	})
+
+	nsList := corev1.NamespaceList{}
+	if err := c.List(ctx, &nsList); err != nil {
+		return nil, err
+	}
+	for _, ns := range nsList.Items {
+		if !namespaces[ns.Name] {
+			continue
+		}
+		binding := backupNamespace{Name: ns.Name}
+		for key, value := range ns.Annotations {
+			if strings.HasPrefix(key, annotationPrefix) {
+				if binding.Annotations == nil {
+					binding.Annotations = make(map[string]string)
+				}
+				binding.Annotations[key] = value
+			}
+		}
+		b.Namespaces = append(b.Namespaces, binding)
+	}
+	sort.Slice(b.Namespaces, func(i, j int) bool { return b.Namespaces[i].Name < b.Namespaces[j].Name })
+
+	nodes := corev1.NodeList{}
+	if err := c.List(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	keys := splitMatchLabelKeys()
+	for _, node := range nodes.Items {
+		// 释放中的node仍属于之前的nodepool
+		value, ok := controllers.NodePoolValue(&node)
+		if !ok || value == "" {
+			continue
+		}
+		labels := make(map[string]string, len(keys)+1)
+		for _, key := range append(keys, hostnameLabel) {
+			if v, ok := node.Labels[key]; ok {
+				labels[key] = v
+			}
+		}
+		b.Nodes = append(b.Nodes, backupNode{Name: node.Name, ProviderID: node.Spec.ProviderID, Labels: labels, Value: value})
+	}
+	sort.Slice(b.Nodes, func(i, j int) bool { return b.Nodes[i].Name < b.Nodes[j].Name })
+	return b, nil
+}
+
+func saveBackupConfigMap(ctx context.Context, c client.Client, data []byte) error {
+	ref := splitPoolRef(backupConfigMap)
+	if ref.Name == "" {
+		return fmt.Errorf("--configmap %s: expected <namespace>/<name>", backupConfigMap)
+	}
+	cm := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, cm)
+	if errors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ref.Namespace, Name: ref.Name},
+			Data:       map[string]string{backupConfigMapKey: string(data)},
+		}
+		return c.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[backupConfigMapKey] = string(data)
+	return c.Update(ctx, cm)
+}
+
+func loadBackup(ctx context.Context, c client.Client) (*backup, error) {
+	var data []byte
+	switch {
+	case backupConfigMap != "":
+		ref := splitPoolRef(backupConfigMap)
+		cm := &corev1.ConfigMap{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, cm); err != nil {
+			return nil, err
+		}
+		raw, ok := cm.Data[backupConfigMapKey]
+		if !ok {
+			return nil, fmt.Errorf("configmap/%s has no %s", backupConfigMap, backupConfigMapKey)
+		}
+		data = []byte(raw)
+	case backupFile != "":
+		raw, err := os.ReadFile(backupFile)
+		if err != nil {
+			return nil, err
+		}
+		data = raw
+	default:
+		return nil, fmt.Errorf("-f or --configmap is required")
+	}
+
+	b := &backup{}
+	if err := yaml.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	if b.APIVersion != backupAPIVersion || b.Kind != backupKind {
+		return nil, fmt.Errorf("unsupported backup %s %s, expected %s %s", b.APIVersion, b.Kind, backupAPIVersion, backupKind)
+	}
+	return b, nil
+}
+
+func runRestore(ctx context.Context, c *cli, _ []string) error {
+	key, err := nodeMatcher()
+	if err != nil {
+		return err
+	}
+	b, err := loadBackup(ctx, c.client)
+	if err != nil {
+		return err
+	}
+	if err := checkMatchLabels(b); err != nil {
+		return err
+	}
+	suffix := ""
+	if dryRun {
+		suffix = " (dry run)"
+	}
+
+	if err := restoreNamespaces(ctx, c, b, suffix); err != nil {
+		return err
+	}
+	if err := restorePools(ctx, c, b, suffix); err != nil {
+		return err
+	}
+	return restoreNodes(ctx, c, b, key, suffix)
+}
+
+// restoreNamespaces sets the nodepool annotations of the existing namespaces back
+func restoreNamespaces(ctx context.Context, c *cli, b *backup, suffix string) error {
+	for _, binding := range b.Namespaces {
+		ns := &corev1.Namespace{}
+		err := c.client.Get(ctx, types.NamespacedName{Name: binding.Name}, ns)
+		if errors.IsNotFound(err) {
+			fmt.Fprintf(c.out, "namespace/%s: missing, skipped\n", binding.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		patch := client.MergeFrom(ns.DeepCopy())
+		changed := false
+		for key, value := range binding.Annotations {
+			if current, ok := ns.Annotations[key]; ok && (current == value || !overwrite) {
+				continue
+			}
+			if ns.Annotations == nil {
+				ns.Annotations = make(map[string]string)
+			}
+			ns.Annotations[key] = value
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if !dryRun {
+			if err := c.client.Patch(ctx, ns, patch); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(c.out, "namespace/%s: annotations restored%s\n", ns.Name, suffix)
+	}
+	return nil
+}
+
+// restorePools creates the missing nodepools of existing namespaces
+func restorePools(ctx context.Context, c *cli, b *backup, suffix string) error {
+	for _, saved := range b.NodePools {
+		pool := &poolv1.NodePool{}
+		err := c.client.Get(ctx, types.NamespacedName{Namespace: saved.Namespace, Name: saved.Name}, pool)
+		switch {
+		case errors.IsNotFound(err):
+			ns := &corev1.Namespace{}
+			if err := c.client.Get(ctx, types.NamespacedName{Name: saved.Namespace}, ns); errors.IsNotFound(err) {
+				fmt.Fprintf(c.out, "nodepool/%s/%s: namespace missing, skipped\n", saved.Namespace, saved.Name)
+				continue
+			} else if err != nil {
+				return err
+			}
+			pool = &poolv1.NodePool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: saved.Namespace, Name: saved.Name},
+				Spec:       saved.Spec,
+			}
+			if !dryRun {
+				if err := c.client.Create(ctx, pool); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(c.out, "nodepool/%s/%s: created%s\n", saved.Namespace, saved.Name, suffix)
+		case err != nil:
+			return err
+		case !equality.Semantic.DeepEqual(pool.Spec, saved.Spec):
+			if !overwrite {
+				fmt.Fprintf(c.out, "nodepool/%s/%s: spec differs from the backup, kept, use --overwrite to restore it\n", saved.Namespace, saved.Name)
+				continue
+			}
+			pool.Spec = saved.Spec
+			if !dryRun {
+				if err := c.client.Update(ctx, pool); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(c.out, "nodepool/%s/%s: spec restored%s\n", saved.Namespace, saved.Name, suffix)
+		}
+	}
+	return nil
+}
+
+// restoreNodes labels the current nodes with the nodepool of the backed up node they match.
+// A backed up node is given to one node only; nodes already holding their backed up value are kept.
+func restoreNodes(ctx context.Context, c *cli, b *backup, key func(name, providerID string, labels map[string]string) string, suffix string) error {
+	// 按匹配键分组，每个备份的node只能被匹配一次
+	saved := make(map[string][]backupNode)
+	for _, node := range b.Nodes {
+		if k := key(node.Name, node.ProviderID, node.Labels); k != "" {
+			saved[k] = append(saved[k], node)
+		}
+	}
+	// take removes the backed up node matching the key, of the given value when not empty, preferring the same name
+	take := func(k, name, value string) *backupNode {
+		candidates := saved[k]
+		pick := -1
+		for i := range candidates {
+			if value != "" && candidates[i].Value != value {
+				continue
+			}
+			if pick < 0 || candidates[i].Name == name {
+				pick = i
+			}
+			if candidates[i].Name == name {
+				break
+			}
+		}
+		if pick < 0 {
+			return nil
+		}
+		taken := candidates[pick]
+		saved[k] = append(candidates[:pick:pick], candidates[pick+1:]...)
+		return &taken
+	}
+
+	nodes := corev1.NodeList{}
+	if err := c.client.List(ctx, &nodes); err != nil {
+		return err
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+	keys := make([]string, len(nodes.Items))
+	for i := range nodes.Items {
+		keys[i] = key(nodes.Items[i].Name, nodes.Items[i].Spec.ProviderID, nodes.Items[i].Labels)
+	}
+
+	// 已经属于备份中nodepool的node先占用匹配的备份
+	done := make([]bool, len(nodes.Items))
+	for i := range nodes.Items {
+		value, ok := controllers.NodePoolValue(&nodes.Items[i])
+		if !ok || value == "" {
+			continue
+		}
+		if keys[i] != "" && take(keys[i], nodes.Items[i].Name, value) != nil || !overwrite {
+			done[i] = true
+		}
+	}
+
+	restored, unmatched := 0, 0
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if done[i] {
+			continue
+		}
+		var match *backupNode
+		if keys[i] != "" {
+			match = take(keys[i], node.Name, "")
+		}
+		if match == nil {
+			unmatched++
+			continue
+		}
+		if !dryRun {
+			if err := setPoolLabel(ctx, c.client, node, match.Value); err != nil {
+				return err
+			}
+		}
+		restored++
+		fmt.Fprintf(c.out, "node/%s: %s=%s, matched node/%s by %s%s\n", node.Name, controllers.LableNodePoolKey, match.Value, match.Name, matchBy, suffix)
+	}
+
+	left := 0
+	for _, nodes := range saved {
+		left += len(nodes)
+	}
+	fmt.Fprintf(c.out, "%d node(s) restored, %d node(s) without a match, %d backed up node(s) not found%s\n", restored, unmatched, left, suffix)
+	return nil
+}
+
+// nodeMatcher returns the function computing the identifier of a node for --match, empty when the node has none
+func nodeMatcher() (func(name, providerID string, labels map[string]string) string, error) {
+	switch matchBy {
+	case matchProviderID:
+		return func(_, providerID string, _ map[string]string) string { return providerID }, nil
+	case matchHostname:
+		var pattern *regexp.Regexp
+		if hostnamePattern != "" {
+			var err error
+			if pattern, err = regexp.Compile(hostnamePattern); err != nil {
+				return nil, fmt.Errorf("--hostname-pattern: %v", err)
+			}
+		}
+		return func(name, _ string, labels map[string]string) string {
+			hostname := name
+			if value, ok := labels[hostnameLabel]; ok {
+				hostname = value
+			}
+			if pattern == nil {
+				return hostname
+			}
+			groups := pattern.FindStringSubmatch(hostname)
+			switch len(groups) {
+			case 0:
+				return ""
+			case 1:
+				return groups[0]
+			default:
+				return groups[1]
+			}
+		}, nil
+	case matchLabels:
+		keys := splitMatchLabelKeys()
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("--match=labels requires --match-labels")
+		}
+		return func(_, _ string, labels map[string]string) string {
+			values := make([]string, 0, len(keys))
+			for _, key := range keys {
+				value, ok := labels[key]
+				if !ok {
+					return ""
+				}
+				values = append(values, key+"="+value)
+			}
+			return strings.Join(values, ",")
+		}, nil
+	default:
+		return nil, fmt.Errorf("--match %s: expected %s, %s or %s", matchBy, matchProviderID, matchHostname, matchLabels)
+	}
+}
+
+// splitMatchLabelKeys the label keys of --match-labels
+func splitMatchLabelKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(matchLabelKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// checkMatchLabels fails restore --match=labels when no backed up node has the keys, the backup was taken without them
+func checkMatchLabels(b *backup) error {
+	if matchBy != matchLabels || len(b.Nodes) == 0 {
+		return nil
+	}
+	keys := splitMatchLabelKeys()
+	for _, node := range b.Nodes {
+		found := true
+		for _, key := range keys {
+			if _, ok := node.Labels[key]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			return nil
+		}
+	}
+	return fmt.Errorf("no backed up node has the labels %s, take the backup with --match-labels %s", matchLabelKeys, matchLabelKeys)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+)
+
+var describeCommand = &command{
+	usage: "describe <namespace>",
+	help:  "Show the members, conditions, releasing nodes and pending pods of the nodepools of a namespace",
+	args:  1,
+	run:   runDescribe,
+}
+
+func runDescribe(ctx context.Context, c *cli, args []string) error {
+	pools := poolv1.NodePoolList{}
+	if err := c.client.List(ctx, &pools, client.InNamespace(args[0])); err != nil {
+		return err
+	}
+	if len(pools.Items) == 0 {
+		return fmt.Errorf("no nodepools found in namespace %s", args[0])
+	}
+	for i := range pools.Items {
+		if i > 0 {
+			fmt.Fprintln(c.out)
+		}
+		if err := describePool(ctx, c.client, c.out, &pools.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func describePool(ctx context.Context, c client.Client, out io.Writer, pool *poolv1.NodePool) error {
+	w := newTabWriter(out)
+	fmt.Fprintf(w, "Name:\t%s/%s\n", pool.Namespace, pool.Name)
+	fmt.Fprintf(w, "Selector:\t%s\n", formatSelector(pool.Spec.NodeSelector))
+	if pool.Spec.MinNodes != nil || pool.Spec.MaxNodes != nil {
+		fmt.Fprintf(w, "Size bounds:\tmin %s, max %s\n", formatBound(pool.Spec.MinNodes), formatBound(pool.Spec.MaxNodes))
+	}
+	fmt.Fprintf(w, "Zones:\t%s\n", formatCounts(pool.Status.Zones))
+	fmt.Fprintf(w, "Regions:\t%s\n", formatCounts(pool.Status.Regions))
+
+	fmt.Fprintf(w, "Nodes:\t%d\n", len(pool.Status.Nodes))
+	if len(pool.Status.Nodes) > 0 {
+		fmt.Fprintln(w, "  NAME\tREADY\tSCHEDULABLE\tZONE\tCPU\tMEMORY")
+		for _, name := range pool.Status.Nodes {
+			node := &corev1.Node{}
+			err := c.Get(ctx, types.NamespacedName{Name: name}, node)
+			if errors.IsNotFound(err) {
+				fmt.Fprintf(w, "  %s\t<deleted>\t\t\t\t\n", name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "  %s\t%t\t%t\t%s\t%s\t%s\n", name, controllers.IsNodeReady(node), !node.Spec.Unschedulable,
+				valueOrNone(node.Labels[corev1.LabelTopologyZone]),
+				formatQuantity(node.Status.Allocatable[corev1.ResourceCPU], corev1.ResourceCPU),
+				formatQuantity(node.Status.Allocatable[corev1.ResourceMemory], corev1.ResourceMemory))
+		}
+	}
+
+	fmt.Fprintf(w, "Conditions:\t%d\n", len(pool.Status.Conditions))
+	if len(pool.Status.Conditions) > 0 {
+		fmt.Fprintln(w, "  TYPE\tSTATUS\tREASON\tAGE\tMESSAGE")
+		for _, cond := range pool.Status.Conditions {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", cond.Type, cond.Status, cond.Reason,
+				formatAge(cond.LastTransitionTime.Time), cond.Message)
+		}
+	}
+
+	if len(pool.Status.Releasing) > 0 {
+		fmt.Fprintf(w, "Releasing:\t%d\n", len(pool.Status.Releasing))
+		fmt.Fprintln(w, "  NODE\tPHASE\tPODS\tAGE\tMESSAGE")
+		for _, release := range pool.Status.Releasing {
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%s\t%s\n", release.Node, release.Phase, release.PodsRemaining,
+				formatAge(release.StartTime.Time), release.Message)
+		}
+	}
+
+	if pending := pool.Status.Pending; pending != nil {
+		since := ""
+		if pending.Since != nil {
+			since = fmt.Sprintf(" for %s", formatAge(pending.Since.Time))
+		}
+		fmt.Fprintf(w, "Pending pods:\t%d%s: %s\n", pending.Count, since, pending.Reason)
+		for _, name := range pending.Pods {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+	if len(pool.Status.DriftedPods) > 0 {
+		fmt.Fprintf(w, "Drifted pods:\t%d\n", len(pool.Status.DriftedPods))
+		for _, name := range pool.Status.DriftedPods {
+			fmt.Fprintf(w, "  %s\n", name)
+		}
+	}
+	if len(pool.Status.History) > 0 {
+		fmt.Fprintln(w, "History:")
+		fmt.Fprintln(w, "  NODE\tEVENT\tREASON\tACTOR\tAGE")
+		// 最近的在前
+		for i := len(pool.Status.History) - 1; i >= 0; i-- {
+			event := pool.Status.History[i]
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", event.Node, event.Type, event.Reason,
+				valueOrNone(event.Actor), formatAge(event.Time.Time))
+		}
+	}
+	return w.Flush()
+}
+
+func formatBound(bound *int32) string {
+	if bound == nil {
+		return "<none>"
+	}
+	return fmt.Sprintf("%d", *bound)
+}
+
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
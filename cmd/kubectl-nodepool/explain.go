@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/apiserver/webhook"
+	"nodepool/controllers"
+)
+
+// exceptionNamespaces, namespaces excluded by the manager's --exception-namespaces
+var exceptionNamespaces string
+
+// assignmentKeyFile, key of the manager's --assignment-key-file verifying the records of the webhook
+var assignmentKeyFile string
+
+var explainPodCommand = &command{
+	usage: "explain-pod <pod> [-n namespace]",
+	help:  "Explain why the webhook placed a pod where it did",
+	args:  1,
+	flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&exceptionNamespaces, "exception-namespaces", "kube-system", "Namespaces excluded from nodepools, must match the manager's flag")
+		fs.StringVar(&assignmentKeyFile, "assignment-key-file", "", "Key signing the records of the webhook, they are shown unverified without it")
+	},
+	run: runExplainPod,
+}
+
+func runExplainPod(ctx context.Context, c *cli, args []string) error {
+	controllers.ExceptionNs = strings.Split(exceptionNamespaces, ",")
+	if assignmentKeyFile != "" {
+		if err := controllers.LoadAssignmentKey(assignmentKeyFile); err != nil {
+			return err
+		}
+	}
+	pod := &corev1.Pod{}
+	if err := c.client.Get(ctx, types.NamespacedName{Namespace: c.namespace, Name: args[0]}, pod); err != nil {
+		return err
+	}
+	lines, err := explainPod(ctx, c.client, pod)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Pod %s/%s:\n", pod.Namespace, pod.Name)
+	for _, line := range lines {
+		fmt.Fprintf(c.out, "  - %s\n", line)
+	}
+	return nil
+}
+
+// explainPod retraces the admission and scheduling of the pod from what the webhook recorded on it
+func explainPod(ctx context.Context, c client.Client, pod *corev1.Pod) ([]string, error) {
+	var lines []string
+	if controllers.InclusionExceptionNs(pod.Namespace) {
+		return append(lines, fmt.Sprintf("namespace %s is excluded from nodepools, the webhook admits its pods unchanged", pod.Namespace)), nil
+	}
+	daemonSet, err := controllers.IsDaemonSetPod(ctx, c, pod)
+	if err != nil {
+		return nil, err
+	}
+	nodePod, err := controllers.IsNodePod(ctx, c, pod)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case daemonSet:
+		return append(lines, "pod of a DaemonSet, exempt from nodepools"), nil
+	case nodePod:
+		return append(lines, "static pod mirrored by the kubelet, exempt from nodepools"), nil
+	case controllers.IsSkipAuthorized(pod):
+		return append(lines, fmt.Sprintf("annotated %s=true by an authorized user, exempt from nodepools", controllers.AnnotationSkip)), nil
+	case pod.Annotations[controllers.AnnotationSkip] == "true" && len(controllers.AssignmentKey) == 0:
+		lines = append(lines, fmt.Sprintf("annotated %s=true, its authorization can not be verified without --assignment-key-file", controllers.AnnotationSkip))
+	case pod.Annotations[controllers.AnnotationSkip] == "true":
+		lines = append(lines, fmt.Sprintf("annotated %s=true but the webhook did not record its authorization, the annotation is ignored", controllers.AnnotationSkip))
+	}
+	if controllers.IsMirrorPod(pod) && !nodePod {
+		lines = append(lines, "carries the mirror pod annotation but is not owned by its node, the annotation is ignored")
+	}
+
+	// webhook记录的分配结果
+	pool, err := controllers.GetNamespacePool(ctx, c, pod.Namespace)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if raw, ok := pod.Annotations[webhook.AssignedByAnnotationKey]; ok {
+		assignment := webhook.Assignment{}
+		if err := json.Unmarshal([]byte(raw), &assignment); err != nil {
+			lines = append(lines, fmt.Sprintf("annotation %s is malformed: %v", webhook.AssignedByAnnotationKey, err))
+		} else {
+			lines = append(lines, explainAssignment(assignment, pool)...)
+			switch {
+			case len(controllers.AssignmentKey) == 0:
+				lines = append(lines, "the signature of the record is not verified without --assignment-key-file")
+			case controllers.PodAssignment(pod) == nil:
+				lines = append(lines, "the signature of the record does not match, it was not written by the webhook and is ignored")
+			}
+		}
+	} else {
+		lines = append(lines, fmt.Sprintf("no %s annotation: the pod was admitted before the webhook was installed, "+
+			"while it ran in audit mode or failed open", webhook.AssignedByAnnotationKey))
+	}
+
+	value, pinned := pod.Spec.NodeSelector[controllers.LableNodePoolKey]
+	if pinned {
+		lines = append(lines, fmt.Sprintf("nodeSelector %s=%s restricts the pod to nodes labelled into that nodepool", controllers.LableNodePoolKey, value))
+	} else {
+		lines = append(lines, fmt.Sprintf("no %s nodeSelector, the pod can be scheduled on any node", controllers.LableNodePoolKey))
+	}
+
+	if pool == nil {
+		lines = append(lines, fmt.Sprintf("namespace %s has no nodepool", pod.Namespace))
+		return lines, nil
+	}
+	if pinned && value != controllers.PoolSelectorValue(pool) {
+		lines = append(lines, fmt.Sprintf("%s=%s is not the value %s selected by nodepool %s/%s",
+			controllers.LableNodePoolKey, value, controllers.PoolSelectorValue(pool), pool.Namespace, pool.Name))
+	}
+
+	// 调度结果
+	if pod.Spec.NodeName != "" {
+		if controllers.NodeInPool(pod.Spec.NodeName, pool) {
+			lines = append(lines, fmt.Sprintf("running on node %s, a member of nodepool %s/%s", pod.Spec.NodeName, pool.Namespace, pool.Name))
+		} else {
+			lines = append(lines, fmt.Sprintf("running on node %s which is not a member of nodepool %s/%s, the pod drifted",
+				pod.Spec.NodeName, pool.Namespace, pool.Name))
+		}
+		return lines, nil
+	}
+	if !controllers.IsPodUnschedulable(pod) {
+		return append(lines, "not scheduled yet"), nil
+	}
+
+	nodes, nodePods, err := poolNodesWithPods(ctx, c, pool)
+	if err != nil {
+		return nil, err
+	}
+	_, reason := controllers.DiagnosePendingPods(controllers.PoolSelectorValue(pool), []*corev1.Pod{pod}, nodes, nodePods)
+	return append(lines, fmt.Sprintf("unschedulable: %s", reason)), nil
+}
+
+func explainAssignment(assignment webhook.Assignment, pool *poolv1.NodePool) []string {
+	var lines []string
+	switch assignment.Policy {
+	case webhook.PolicyNamespace:
+		lines = append(lines, fmt.Sprintf("admitted against nodepool %s at generation %d, the default nodepool of its namespace",
+			assignment.Pool, assignment.Generation))
+	case webhook.EmptyPoolFallback:
+		lines = append(lines, fmt.Sprintf("nodepool %s had no ready node at admission, the pod was pinned to the shared fallback nodepool %s",
+			valueOrNone(assignment.Pool), valueOrNone(assignment.Fallback)))
+	case webhook.EmptyPoolWarn:
+		lines = append(lines, fmt.Sprintf("nodepool %s had no ready node at admission, the pod was pinned to it anyway",
+			valueOrNone(assignment.Pool)))
+	default:
+		lines = append(lines, fmt.Sprintf("admitted against nodepool %s by policy %s", valueOrNone(assignment.Pool), assignment.Policy))
+	}
+	if pool != nil && assignment.Generation != 0 && pool.Generation != assignment.Generation {
+		lines = append(lines, fmt.Sprintf("nodepool %s/%s changed since admission, generation %d -> %d",
+			pool.Namespace, pool.Name, assignment.Generation, pool.Generation))
+	}
+	return lines
+}
+
+// poolNodesWithPods gets the member nodes of the nodepool and the pods running on them
+func poolNodesWithPods(ctx context.Context, c client.Client, pool *poolv1.NodePool) ([]corev1.Node, []corev1.Pod, error) {
+	nodes := make([]corev1.Node, 0, len(pool.Status.Nodes))
+	var nodePods []corev1.Pod
+	for _, name := range pool.Status.Nodes {
+		node := corev1.Node{}
+		err := c.Get(ctx, types.NamespacedName{Name: name}, &node)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		nodes = append(nodes, node)
+
+		pods := corev1.PodList{}
+		if err := c.List(ctx, &pods, client.MatchingFields{controllers.PodNodeNameField: name}); err != nil {
+			return nil, nil, err
+		}
+		nodePods = append(nodePods, pods.Items...)
+	}
+	return nodes, nodePods, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func newTabWriter(out io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+}
+
+// formatUsage formats used/allocatable of a resource, eg: 1500m/4 (37%)
+func formatUsage(used, allocatable corev1.ResourceList, name corev1.ResourceName) string {
+	alloc, ok := allocatable[name]
+	if !ok || alloc.IsZero() {
+		return "-"
+	}
+	u := used[name]
+	percent := float64(u.MilliValue()) / float64(alloc.MilliValue()) * 100
+	return fmt.Sprintf("%s/%s (%d%%)", formatQuantity(u, name), formatQuantity(alloc, name), int(percent))
+}
+
+// formatQuantity prints memory in Gi and cpu in cores or millicores
+func formatQuantity(q resource.Quantity, name corev1.ResourceName) string {
+	if name == corev1.ResourceMemory {
+		return fmt.Sprintf("%.1fGi", float64(q.Value())/(1<<30))
+	}
+	return q.String()
+}
+
+// formatCounts formats a topology count map, eg: zone-a=2,zone-b=1
+func formatCounts(counts map[string]int32) string {
+	if len(counts) == 0 {
+		return "<none>"
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", key, counts[key]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatSelector(selector map[string]string) string {
+	if len(selector) == 0 {
+		return "<none>"
+	}
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+selector[key])
+	}
+	return strings.Join(parts, ",")
+}
+
+func addResources(total, add corev1.ResourceList) {
+	for name, q := range add {
+		cur := total[name]
+		cur.Add(q)
+		total[name] = cur
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+)
+
+var listCommand = &command{
+	usage: "list [-n namespace]",
+	help:  "List nodepools with their node count, capacity and requested resources",
+	run:   runList,
+}
+
+func runList(ctx context.Context, c *cli, _ []string) error {
+	pools := poolv1.NodePoolList{}
+	var opts []client.ListOption
+	if !c.allNamespaces {
+		opts = append(opts, client.InNamespace(c.namespace))
+	}
+	if err := c.client.List(ctx, &pools, opts...); err != nil {
+		return err
+	}
+	if len(pools.Items) == 0 {
+		fmt.Fprintln(c.out, "No nodepools found.")
+		return nil
+	}
+
+	nodes := corev1.NodeList{}
+	if err := c.client.List(ctx, &nodes); err != nil {
+		return err
+	}
+	ready := make(map[string]bool, len(nodes.Items))
+	for i := range nodes.Items {
+		ready[nodes.Items[i].Name] = controllers.IsNodeReady(&nodes.Items[i])
+	}
+	used, err := requestsByNode(ctx, c.client)
+	if err != nil {
+		return err
+	}
+
+	w := newTabWriter(c.out)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tSELECTOR\tNODES\tREADY\tCPU\tMEMORY\tPODS")
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		readyNodes := 0
+		poolUsed := corev1.ResourceList{}
+		for _, name := range pool.Status.Nodes {
+			if ready[name] {
+				readyNodes++
+			}
+			addResources(poolUsed, used[name])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", pool.Namespace, pool.Name,
+			formatSelector(pool.Spec.NodeSelector), len(pool.Status.Nodes), readyNodes,
+			formatUsage(poolUsed, pool.Status.Allocatable, corev1.ResourceCPU),
+			formatUsage(poolUsed, pool.Status.Allocatable, corev1.ResourceMemory),
+			formatUsage(poolUsed, pool.Status.Allocatable, corev1.ResourcePods))
+	}
+	return w.Flush()
+}
+
+// requestsByNode sums the requests of the running pods per node, pods count as one pod each
+func requestsByNode(ctx context.Context, c client.Client) (map[string]corev1.ResourceList, error) {
+	pods := corev1.PodList{}
+	if err := c.List(ctx, &pods); err != nil {
+		return nil, err
+	}
+	used := make(map[string]corev1.ResourceList)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" || controllers.IsPodTerminated(pod) {
+			continue
+		}
+		if used[pod.Spec.NodeName] == nil {
+			used[pod.Spec.NodeName] = corev1.ResourceList{}
+		}
+		reqs := controllers.PodRequests(pod)
+		reqs[corev1.ResourcePods] = resource.MustParse("1")
+		addResources(used[pod.Spec.NodeName], reqs)
+	}
+	return used, nil
+}
@@ -0,0 +1,167 @@
+// kubectl-nodepool inspects and operates the nodepools of a cluster.
+// Installed on the PATH it runs as a kubectl plugin: kubectl nodepool <command>.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	poolv1 "nodepool/api/v1"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(poolv1.AddToScheme(scheme))
+}
+
+// cli is the state shared by the commands
+type cli struct {
+	client    client.Client
+	namespace string
+	// allNamespaces, the namespace was not given explicitly
+	allNamespaces bool
+	out           io.Writer
+}
+
+// command is a subcommand of kubectl-nodepool
+type command struct {
+	usage string
+	help  string
+	args  int
+	// offline, the command reads manifests instead of a cluster
+	offline bool
+	// flags registers the command's own flags
+	flags func(fs *flag.FlagSet)
+	run   func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands = map[string]*command{
+	"list":        listCommand,
+	"describe":    describeCommand,
+	"assign":      assignCommand,
+	"release":     releaseCommand,
+	"who-owns":    whoOwnsCommand,
+	"explain-pod": explainPodCommand,
+	"plan":        planCommand,
+	"backup":      backupCommand,
+	"restore":     restoreCommand,
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Inspect and operate nodepools.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Usage:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  kubectl nodepool %-40s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags of all commands: --kubeconfig, --context, -n/--namespace")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		usage(os.Stdout)
+		return
+	}
+	if err := run(context.Background(), os.Args[1], os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, name string, args []string, out io.Writer) error {
+	cmd, ok := commands[name]
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	kubeconfig := fs.String("kubeconfig", "", "Path to the kubeconfig file")
+	kubeContext := fs.String("context", "", "Name of the kubeconfig context to use")
+	namespace := fs.String("namespace", "", "Namespace of the command")
+	fs.StringVar(namespace, "n", "", "Namespace of the command (shorthand)")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kubectl nodepool %s\n\n%s\n\n", cmd.usage, cmd.help)
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != cmd.args {
+		fs.Usage()
+		return fmt.Errorf("%s expects %d argument(s), got %d", name, cmd.args, len(positional))
+	}
+	if cmd.offline {
+		return cmd.run(ctx, &cli{namespace: *namespace, allNamespaces: *namespace == "", out: out}, positional)
+	}
+
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: *kubeconfig, Precedence: clientcmd.NewDefaultClientConfigLoadingRules().Precedence},
+		&clientcmd.ConfigOverrides{CurrentContext: *kubeContext})
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	state := &cli{client: c, namespace: *namespace, out: out}
+	if state.namespace == "" {
+		state.allNamespaces = true
+		if state.namespace, _, err = config.Namespace(); err != nil {
+			return err
+		}
+	}
+	return cmd.run(ctx, state, positional)
+}
+
+// parseInterspersed parses flags placed before, between and after the positional arguments like kubectl does
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// splitPoolRef splits <namespace>[/<name>] into a nodepool reference, the name defaults to the default nodepool
+func splitPoolRef(ref string) poolv1.NodePoolReference {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 {
+		return poolv1.NodePoolReference{Namespace: parts[0], Name: parts[1]}
+	}
+	return poolv1.NodePoolReference{Namespace: parts[0]}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/apiserver/webhook"
+	"nodepool/controllers"
+)
+
+func newTestCli(objs ...client.Object) (*cli, *bytes.Buffer) {
+	pool := controllers.GenerateNodePoolObj(controllers.DefaultNodePoolName, "tenant")
+	pool.Generation = 2
+	pool.Status.Nodes = []string{"node-a"}
+	objs = append(objs, pool,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{controllers.LableNodePoolKey: "tenant"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}},
+	)
+	out := &bytes.Buffer{}
+	return &cli{
+		client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		namespace: "tenant",
+		out:       out,
+	}, out
+}
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	namespace := fs.String("n", "", "")
+	force := fs.Bool("force", false, "")
+	args, err := parseInterspersed(fs, []string{"node-a", "-n", "tenant", "tenant/default", "--force"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []string{"node-a", "tenant/default"}) || *namespace != "tenant" || !*force {
+		t.Fatalf("got args %v, namespace %q, force %t", args, *namespace, *force)
+	}
+}
+
+func TestWhoOwns(t *testing.T) {
+	c, out := newTestCli()
+	if err := runWhoOwns(context.Background(), c, []string{"node-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "tenant/default (member)") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
+
+func TestExplainPod(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "tenant",
+			Name:      "web",
+			Annotations: map[string]string{
+				webhook.AssignedByAnnotationKey: `{"pool":"tenant/default","generation":1,"policy":"namespace"}`,
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:     "node-b",
+			NodeSelector: map[string]string{controllers.LableNodePoolKey: "tenant"},
+		},
+	}
+	c, _ := newTestCli(pod)
+	lines, err := explainPod(context.Background(), c.client, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explanation := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"admitted against nodepool tenant/default at generation 1",
+		"changed since admission, generation 1 -> 2",
+		"not a member of nodepool tenant/default, the pod drifted",
+	} {
+		if !strings.Contains(explanation, want) {
+			t.Errorf("explanation misses %q:\n%s", want, explanation)
+		}
+	}
+}
+
+func TestAssignRespectsMaxNodes(t *testing.T) {
+	c, _ := newTestCli()
+	pool := &poolv1.NodePool{}
+	if err := c.client.Get(context.Background(), client.ObjectKey{Namespace: "tenant", Name: controllers.DefaultNodePoolName}, pool); err != nil {
+		t.Fatal(err)
+	}
+	max := int32(1)
+	pool.Spec.MaxNodes = &max
+	if err := c.client.Update(context.Background(), pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runAssign(context.Background(), c, []string{"node-b", "tenant"}); err == nil {
+		t.Fatal("assign above maxNodes succeeded")
+	}
+	node := &corev1.Node{}
+	if err := c.client.Get(context.Background(), client.ObjectKey{Name: "node-b"}, node); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.Labels[controllers.LableNodePoolKey]; ok {
+		t.Fatal("node labelled despite maxNodes")
+	}
+}
+
+const planDump = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Namespace
+  metadata:
+    name: tenant
+- apiVersion: nodes.sunkai.xyz/v1
+  kind: NodePool
+  metadata:
+    name: default
+    namespace: tenant
+    resourceVersion: "7"
+  spec:
+    nodeSelector:
+      nodepool: tenant
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node-a
+    labels:
+      nodepool: tenant
+  status:
+    allocatable: {cpu: "2", memory: 4Gi, pods: "110"}
+    conditions: [{type: Ready, status: "True"}]
+- apiVersion: v1
+  kind: Node
+  metadata:
+    name: node-b
+    labels:
+      nodepool: tenant
+  status:
+    allocatable: {cpu: "2", memory: 4Gi, pods: "110"}
+    conditions: [{type: Ready, status: "True"}]
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: small
+  namespace: tenant
+spec:
+  nodeName: node-b
+  nodeSelector:
+    nodepool: tenant
+  containers:
+  - name: app
+    resources:
+      requests: {cpu: "1"}
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: large
+  namespace: tenant
+spec:
+  nodeName: node-b
+  nodeSelector:
+    nodepool: tenant
+  containers:
+  - name: app
+    resources:
+      requests: {cpu: "1500m"}
+`
+
+func TestPlanRelabel(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "dump.yaml")
+	if err := os.WriteFile(dump, []byte(planDump), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := run(context.Background(), "plan", []string{"--from", dump, "--label", "node-b="}, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"tenant/default: 2 -> 1 nodes -node-b",
+		"tenant/large: displaced from node node-b, fits on node node-a",
+		"tenant/small: displaced from node node-b, unschedulable",
+		"Summary: 1 nodepool(s) changed, 2 pod(s) displaced, 1 unschedulable, 0 rejected",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan misses %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestReplacementPodCopiesMetadata(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       "tenant",
+		Name:            "web-0",
+		Labels:          map[string]string{"app": "web"},
+		Annotations:     map[string]string{"note": "kept"},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "web"}},
+	}}
+	r := replacementPod(pod)
+	r.Labels["app"] = "changed"
+	r.Annotations[webhook.AssignedByAnnotationKey] = "{}"
+	r.OwnerReferences[0].Name = "changed"
+	if pod.Labels["app"] != "web" || len(pod.Annotations) != 1 || pod.OwnerReferences[0].Name != "web" {
+		t.Fatalf("replacement pod shares the metadata of the displaced pod: %+v", pod.ObjectMeta)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	defer func(by, keys string) { matchBy, matchLabelKeys = by, keys }(matchBy, matchLabelKeys)
+	old := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpu-x1y2z", Labels: map[string]string{
+			controllers.LableNodePoolKey:        "tenant",
+			hostnameLabel:                       "gpu-x1y2z",
+			"slot":                              "7",
+			"feature.node.kubernetes.io/cpu-id": "GenuineIntel",
+		}},
+		Spec: corev1.NodeSpec{ProviderID: "aws:///zone-a/i-1"},
+	}
+	c, _ := newTestCli(old)
+	backupFile = filepath.Join(t.TempDir(), "backup.yaml")
+	backupConfigMap = ""
+	matchLabelKeys = "slot"
+	if err := runBackup(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 只保存匹配用的label
+	b, err := loadBackup(context.Background(), c.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range b.Nodes {
+		if want := map[string]string{hostnameLabel: "gpu-x1y2z", "slot": "7"}; node.Name == old.Name && !reflect.DeepEqual(node.Labels, want) {
+			t.Fatalf("backed up node %+v, want the labels %v", node, want)
+		}
+	}
+	matchLabelKeys = ""
+
+	// 云厂商重建了node，标签丢失
+	recreated := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "gpu-a8b9c"},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///zone-a/i-2"},
+	}
+	c = &cli{
+		client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(recreated,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant"}}).Build(),
+		out: &bytes.Buffer{},
+	}
+
+	matchBy, hostnamePattern = matchProviderID, ""
+	if err := runRestore(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	node := &corev1.Node{}
+	if err := c.client.Get(context.Background(), client.ObjectKey{Name: "gpu-a8b9c"}, node); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.Labels[controllers.LableNodePoolKey]; ok {
+		t.Fatal("node with another providerID matched")
+	}
+	if err := c.client.Get(context.Background(), client.ObjectKey{Namespace: "tenant", Name: controllers.DefaultNodePoolName}, &poolv1.NodePool{}); err != nil {
+		t.Fatalf("nodepool not restored: %v", err)
+	}
+
+	matchBy, hostnamePattern = matchHostname, `^(.*)-[a-z0-9]{5}$`
+	if err := runRestore(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.client.Get(context.Background(), client.ObjectKey{Name: "gpu-a8b9c"}, node); err != nil {
+		t.Fatal(err)
+	}
+	if node.Labels[controllers.LableNodePoolKey] != "tenant" {
+		t.Fatalf("node labels %v, want %s=tenant", node.Labels, controllers.LableNodePoolKey)
+	}
+
+	// 备份时没有保存的label不能用来匹配
+	matchBy, matchLabelKeys = matchLabels, "feature.node.kubernetes.io/cpu-id"
+	if err := runRestore(context.Background(), c, nil); err == nil {
+		t.Fatal("restore matched by labels missing from the backup")
+	}
+}
+
+func TestRestoreMatchesByHostnameByDefault(t *testing.T) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	restoreCommand.flags(fs)
+	if def := fs.Lookup("match").DefValue; def != matchHostname {
+		t.Fatalf("restore --match defaults to %s, want %s", def, matchHostname)
+	}
+}
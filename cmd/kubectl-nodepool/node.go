@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/controllers"
+)
+
+var (
+	// force, ignore the size bounds of the nodepools
+	force bool
+	// freePool, label value given to released nodes instead of removing the label
+	freePool string
+)
+
+var assignCommand = &command{
+	usage: "assign <node> <namespace>[/<nodepool>]",
+	help:  "Label a node into a nodepool, the previous nodepool releases it",
+	args:  2,
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&force, "force", false, "Ignore the minNodes and maxNodes of the nodepools")
+	},
+	run: runAssign,
+}
+
+var releaseCommand = &command{
+	usage: "release <node>",
+	help:  "Remove a node from its nodepool",
+	args:  1,
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&force, "force", false, "Ignore the minNodes of the nodepool")
+		fs.StringVar(&freePool, "free-pool", "", "Label the node into the shared nodepool with this value instead of removing the label")
+	},
+	run: runRelease,
+}
+
+var whoOwnsCommand = &command{
+	usage: "who-owns <node>",
+	help:  "Show the nodepool a node belongs to and any release or move in progress",
+	args:  1,
+	run:   runWhoOwns,
+}
+
+func runAssign(ctx context.Context, c *cli, args []string) error {
+	node := &corev1.Node{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: args[0]}, node); err != nil {
+		return err
+	}
+	target, err := controllers.GetNodePool(ctx, c.client, splitPoolRef(args[1]))
+	if err != nil {
+		return err
+	}
+	value := controllers.PoolSelectorValue(target)
+	if value == "" {
+		return fmt.Errorf("nodepool %s/%s does not select a %s label", target.Namespace, target.Name, controllers.LableNodePoolKey)
+	}
+	if node.Labels[controllers.LableNodePoolKey] == value {
+		fmt.Fprintf(c.out, "node/%s already in nodepool %s/%s\n", node.Name, target.Namespace, target.Name)
+		return nil
+	}
+
+	if !force {
+		if target.Spec.MaxNodes != nil && len(target.Status.Nodes)+1 > int(*target.Spec.MaxNodes) {
+			return fmt.Errorf("nodepool %s/%s would grow above its maximum of %d nodes, use --force to assign anyway",
+				target.Namespace, target.Name, *target.Spec.MaxNodes)
+		}
+		if err := checkMinNodes(ctx, c.client, node); err != nil {
+			return err
+		}
+	}
+
+	if err := setPoolLabel(ctx, c.client, node, value); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "node/%s assigned to nodepool %s/%s\n", node.Name, target.Namespace, target.Name)
+	return nil
+}
+
+func runRelease(ctx context.Context, c *cli, args []string) error {
+	node := &corev1.Node{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: args[0]}, node); err != nil {
+		return err
+	}
+	if _, ok := node.Labels[controllers.LableNodePoolKey]; !ok {
+		fmt.Fprintf(c.out, "node/%s is not in a nodepool\n", node.Name)
+		return nil
+	}
+	if !force {
+		if err := checkMinNodes(ctx, c.client, node); err != nil {
+			return err
+		}
+	}
+
+	if err := setPoolLabel(ctx, c.client, node, freePool); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "node/%s released\n", node.Name)
+	return nil
+}
+
+// checkMinNodes refuses to shrink the nodepool the node belongs to below its minNodes
+func checkMinNodes(ctx context.Context, c client.Client, node *corev1.Node) error {
+	pools := poolv1.NodePoolList{}
+	if err := c.List(ctx, &pools); err != nil {
+		return err
+	}
+	current := controllers.FindNodepoolByNodeObj(node, &pools)
+	if current == nil || current.Spec.MinNodes == nil {
+		return nil
+	}
+	if len(current.Status.Nodes)-1 < int(*current.Spec.MinNodes) {
+		return fmt.Errorf("nodepool %s/%s would shrink below its minimum of %d nodes, use --force to release anyway",
+			current.Namespace, current.Name, *current.Spec.MinNodes)
+	}
+	return nil
+}
+
+// setPoolLabel sets the nodepool label of the node, an empty value removes it
+func setPoolLabel(ctx context.Context, c client.Client, node *corev1.Node, value string) error {
+	patch := client.MergeFrom(node.DeepCopy())
+	if value == "" {
+		delete(node.Labels, controllers.LableNodePoolKey)
+	} else {
+		if node.Labels == nil {
+			node.Labels = make(map[string]string)
+		}
+		node.Labels[controllers.LableNodePoolKey] = value
+	}
+	return c.Patch(ctx, node, patch)
+}
+
+func runWhoOwns(ctx context.Context, c *cli, args []string) error {
+	node := &corev1.Node{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: args[0]}, node); err != nil {
+		return err
+	}
+	pools := poolv1.NodePoolList{}
+	if err := c.client.List(ctx, &pools); err != nil {
+		return err
+	}
+
+	w := newTabWriter(c.out)
+	fmt.Fprintf(w, "Node:\t%s\n", node.Name)
+	label, labelled := node.Labels[controllers.LableNodePoolKey]
+	if labelled {
+		fmt.Fprintf(w, "Label:\t%s=%s\n", controllers.LableNodePoolKey, label)
+	} else {
+		fmt.Fprintf(w, "Label:\t<none>\n")
+	}
+
+	// node所属的nodepool，释放中的node仍属于之前的nodepool
+	if pool := controllers.FindNodepoolByNodeObj(node, &pools); pool != nil {
+		state := "member"
+		if !controllers.NodeInPool(node.Name, pool) {
+			state = "joining, not yet in status"
+		}
+		fmt.Fprintf(w, "Nodepool:\t%s/%s (%s)\n", pool.Namespace, pool.Name, state)
+	} else if labelled {
+		fmt.Fprintf(w, "Nodepool:\t<none>, no nodepool selects %s=%s\n", controllers.LableNodePoolKey, label)
+	} else {
+		fmt.Fprintf(w, "Nodepool:\t<none>\n")
+	}
+
+	// status中仍然列出该node的其他nodepool
+	value, _ := controllers.NodePoolValue(node)
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		if controllers.NodeInPool(node.Name, pool) && controllers.PoolSelectorValue(pool) != value {
+			fmt.Fprintf(w, "Listed by:\t%s/%s (leaving)\n", pool.Namespace, pool.Name)
+		}
+	}
+
+	if from, ok := node.Annotations[controllers.AnnotationReleasingFrom]; ok {
+		line := fmt.Sprintf("from %s=%s", controllers.LableNodePoolKey, from)
+		if pool := controllers.FindNodepoolBySelectorValue(from, &pools); pool != nil {
+			for _, release := range pool.Status.Releasing {
+				if release.Node == node.Name {
+					line = fmt.Sprintf("%s, %s: %s", line, release.Phase, release.Message)
+				}
+			}
+		}
+		fmt.Fprintf(w, "Releasing:\t%s\n", line)
+	}
+	if move, ok := node.Annotations[controllers.AnnotationMove]; ok {
+		fmt.Fprintf(w, "Moving:\tby nodepoolmove %s\n", move)
+	}
+	if node.Spec.Unschedulable {
+		fmt.Fprintf(w, "Cordoned:\ttrue\n")
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == controllers.TaintUnassigned {
+			fmt.Fprintf(w, "Tainted:\t%s:%s, waiting to be reassigned\n", taint.Key, taint.Effect)
+		}
+	}
+	return w.Flush()
+}
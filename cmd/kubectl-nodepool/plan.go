@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	poolv1 "nodepool/api/v1"
+	"nodepool/apiserver/webhook"
+	"nodepool/controllers"
+)
+
+// stringList is a flag which can be repeated
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// plan flags, the webhook settings must match the manager's flags
+var (
+	planFrom    stringList
+	planChanges stringList
+	planLabels  stringList
+)
+
+var planCommand = &command{
+	usage:   "plan --from <dump.yaml> [-f <changes.yaml>] [--label <node>=<value>]",
+	help:    "Preview offline which nodepools gain or lose nodes and which pods would be displaced or become unschedulable",
+	offline: true,
+	flags: func(fs *flag.FlagSet) {
+		fs.Var(&planFrom, "from", "Manifests of the current cluster, eg: kubectl get nodes,namespaces,nodepools,pods,daemonsets -A -o yaml, can be repeated")
+		fs.Var(&planChanges, "f", "Manifests replacing objects of the current cluster with the same kind, namespace and name, can be repeated")
+		fs.Var(&planLabels, "label", "Change the nodepool label of a node, <node>= removes it, can be repeated")
+		fs.StringVar(&exceptionNamespaces, "exception-namespaces", "kube-system", "Namespaces excluded from nodepools, must match the manager's flag")
+		fs.StringVar(&webhook.EmptyPoolPolicy, "empty-pool-policy", webhook.EmptyPoolWarn, "Empty pool policy of the webhook, must match the manager's flag")
+		fs.StringVar(&controllers.FallbackPool, "fallback-pool", "", "Fallback nodepool of the webhook, must match the manager's flag")
+		fs.StringVar(&assignmentKeyFile, "assignment-key-file", "", "Key signing the records of the webhook, skip annotations are only trusted with it, must match the manager's flag")
+	},
+	run: runPlan,
+}
+
+// planState is a set of cluster objects the plan is computed on
+type planState struct {
+	nodes      map[string]*corev1.Node
+	namespaces map[string]*corev1.Namespace
+	pools      map[types.NamespacedName]*poolv1.NodePool
+	pods       map[types.NamespacedName]*corev1.Pod
+	daemonSets map[types.NamespacedName]*appsv1.DaemonSet
+}
+
+func newPlanState() *planState {
+	return &planState{
+		nodes:      make(map[string]*corev1.Node),
+		namespaces: make(map[string]*corev1.Namespace),
+		pools:      make(map[types.NamespacedName]*poolv1.NodePool),
+		pods:       make(map[types.NamespacedName]*corev1.Pod),
+		daemonSets: make(map[types.NamespacedName]*appsv1.DaemonSet),
+	}
+}
+
+func runPlan(ctx context.Context, c *cli, _ []string) error {
+	controllers.ExceptionNs = strings.Split(exceptionNamespaces, ",")
+	if len(planFrom) == 0 {
+		return fmt.Errorf("--from is required")
+	}
+	if assignmentKeyFile != "" {
+		if err := controllers.LoadAssignmentKey(assignmentKeyFile); err != nil {
+			return err
+		}
+	}
+
+	before := newPlanState()
+	for _, path := range planFrom {
+		if err := before.load(path); err != nil {
+			return err
+		}
+	}
+	after := before.clone()
+	for _, path := range planChanges {
+		if err := after.load(path); err != nil {
+			return err
+		}
+	}
+	for _, change := range planLabels {
+		parts := strings.SplitN(change, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("--label %s: expected <node>=<value>", change)
+		}
+		if err := after.relabel(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+
+	before.reconcile()
+	after.reconcile()
+	p, err := computePlan(ctx, before, after)
+	if err != nil {
+		return err
+	}
+	p.print(c.out)
+	return nil
+}
+
+// load adds the nodes, namespaces, nodepools, pods and DaemonSets of a manifest file, replacing objects with the same key
+func (s *planState) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if obj.Object == nil {
+			continue
+		}
+		if obj.IsList() {
+			err = obj.EachListItem(func(item runtime.Object) error {
+				return s.add(item.(*unstructured.Unstructured))
+			})
+		} else {
+			err = s.add(obj)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+func (s *planState) add(obj *unstructured.Unstructured) error {
+	var typed client.Object
+	switch obj.GetKind() {
+	case "Node":
+		typed = &corev1.Node{}
+	case "Namespace":
+		typed = &corev1.Namespace{}
+	case "NodePool":
+		typed = &poolv1.NodePool{}
+	case "Pod":
+		typed = &corev1.Pod{}
+	case "DaemonSet":
+		typed = &appsv1.DaemonSet{}
+	default:
+		// 与nodepool无关的对象
+		return nil
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, typed); err != nil {
+		return fmt.Errorf("%s %s: %v", obj.GetKind(), obj.GetName(), err)
+	}
+	// fake client创建对象时不能带resourceVersion
+	typed.SetResourceVersion("")
+
+	switch o := typed.(type) {
+	case *corev1.Node:
+		s.nodes[o.Name] = o
+	case *corev1.Namespace:
+		s.namespaces[o.Name] = o
+	case *poolv1.NodePool:
+		s.pools[client.ObjectKeyFromObject(o)] = o
+	case *corev1.Pod:
+		s.pods[client.ObjectKeyFromObject(o)] = o
+	case *appsv1.DaemonSet:
+		s.daemonSets[client.ObjectKeyFromObject(o)] = o
+	}
+	return nil
+}
+
+func (s *planState) clone() *planState {
+	c := newPlanState()
+	for k, v := range s.nodes {
+		c.nodes[k] = v.DeepCopy()
+	}
+	for k, v := range s.namespaces {
+		c.namespaces[k] = v.DeepCopy()
+	}
+	for k, v := range s.pools {
+		c.pools[k] = v.DeepCopy()
+	}
+	for k, v := range s.pods {
+		c.pods[k] = v.DeepCopy()
+	}
+	for k, v := range s.daemonSets {
+		c.daemonSets[k] = v.DeepCopy()
+	}
+	return c
+}
+
+func (s *planState) relabel(name, value string) error {
+	node, ok := s.nodes[name]
+	if !ok {
+		return fmt.Errorf("node %s not found in the manifests", name)
+	}
+	if value == "" {
+		delete(node.Labels, controllers.LableNodePoolKey)
+		return nil
+	}
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	node.Labels[controllers.LableNodePoolKey] = value
+	return nil
+}
+
+func (s *planState) nodeList() *corev1.NodeList {
+	list := &corev1.NodeList{}
+	names := make([]string, 0, len(s.nodes))
+	for name := range s.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list.Items = append(list.Items, *s.nodes[name])
+	}
+	return list
+}
+
+// reconcile recomputes the status of the nodepools from the node labels like NodePoolReconciler does
+func (s *planState) reconcile() {
+	nodeList := s.nodeList()
+	for _, pool := range s.pools {
+		_, nodes := controllers.FindMatchNodesByNodepool(nodeList, pool)
+		pool.Status.Nodes = nodes
+		pool.Status.MaxNodeAllocatable = controllers.MaxAllocatable(nodeList, nodes)
+		pool.Status.Allocatable = controllers.SumAllocatable(nodeList, nodes)
+		pool.Status.Zones, pool.Status.Regions = controllers.TopologyCounts(nodeList, nodes)
+	}
+}
+
+// client serves the state to the webhook
+func (s *planState) client() client.Client {
+	objs := make([]client.Object, 0, len(s.nodes)+len(s.namespaces)+len(s.pools)+len(s.daemonSets))
+	for _, node := range s.nodes {
+		objs = append(objs, node.DeepCopy())
+	}
+	for _, ns := range s.namespaces {
+		objs = append(objs, ns.DeepCopy())
+	}
+	for _, pool := range s.pools {
+		objs = append(objs, pool.DeepCopy())
+	}
+	for _, ds := range s.daemonSets {
+		objs = append(objs, ds.DeepCopy())
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+// poolByValue returns the nodepool selecting the nodepool label value
+func (s *planState) poolByValue(value string) *poolv1.NodePool {
+	for _, pool := range s.pools {
+		if controllers.PoolSelectorValue(pool) == value {
+			return pool
+		}
+	}
+	return nil
+}
+
+// poolChange is the membership difference of a nodepool
+type poolChange struct {
+	key          types.NamespacedName
+	before       int
+	after        int
+	gained, lost []string
+}
+
+// podOutcome is what happens to a pod in the proposed state
+type podOutcome struct {
+	key     types.NamespacedName
+	message string
+	// unschedulable, rejected, the pod can not run after the change
+	unschedulable bool
+	rejected      bool
+}
+
+type plan struct {
+	pools     []poolChange
+	displaced []podOutcome
+	// emptied, nodepools left without a ready node
+	emptied []types.NamespacedName
+}
+
+func computePlan(ctx context.Context, before, after *planState) (*plan, error) {
+	p := &plan{}
+
+	keys := make(map[types.NamespacedName]bool)
+	for key := range before.pools {
+		keys[key] = true
+	}
+	for key := range after.pools {
+		keys[key] = true
+	}
+	for key := range keys {
+		var was, is []string
+		if pool, ok := before.pools[key]; ok {
+			was = pool.Status.Nodes
+		}
+		if pool, ok := after.pools[key]; ok {
+			is = pool.Status.Nodes
+		}
+		change := poolChange{key: key, before: len(was), after: len(is), gained: difference(is, was), lost: difference(was, is)}
+		if len(change.gained)+len(change.lost) > 0 {
+			p.pools = append(p.pools, change)
+		}
+	}
+	sort.Slice(p.pools, func(i, j int) bool { return p.pools[i].key.String() < p.pools[j].key.String() })
+
+	outcomes, err := displacedPods(ctx, after.client(), after)
+	if err != nil {
+		return nil, err
+	}
+	p.displaced = outcomes
+
+	// 失去所有ready node的nodepool，新建的pod由empty pool policy处理
+	for _, change := range p.pools {
+		pool, ok := after.pools[change.key]
+		if !ok || after.readyMembers(pool) > 0 {
+			continue
+		}
+		if was, ok := before.pools[change.key]; ok && before.readyMembers(was) > 0 {
+			p.emptied = append(p.emptied, change.key)
+		}
+	}
+	return p, nil
+}
+
+// displacedPods finds the pods running on nodes which leave their nodepool and places their replacements
+// with the webhook and a greedy fit onto the remaining members
+func displacedPods(ctx context.Context, c client.Client, after *planState) ([]podOutcome, error) {
+	keys := make([]types.NamespacedName, 0, len(after.pods))
+	for key := range after.pods {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	// 留在原node上的pod
+	staying := make([]corev1.Pod, 0, len(keys))
+	var displaced []*corev1.Pod
+	for _, key := range keys {
+		pod := after.pods[key]
+		if pod.Spec.NodeName == "" || controllers.IsPodTerminated(pod) {
+			continue
+		}
+		exempt, err := exemptFromPlan(ctx, c, pod)
+		if err != nil {
+			return nil, err
+		}
+		if exempt {
+			staying = append(staying, *pod)
+			continue
+		}
+		pool := after.poolByValue(pod.Spec.NodeSelector[controllers.LableNodePoolKey])
+		if pool == nil || controllers.NodeInPool(pod.Spec.NodeName, pool) {
+			staying = append(staying, *pod)
+			continue
+		}
+		displaced = append(displaced, pod)
+	}
+
+	var outcomes []podOutcome
+	for _, pod := range displaced {
+		outcome := podOutcome{key: client.ObjectKeyFromObject(pod)}
+		admitted, resp, err := webhook.AdmitPod(ctx, c, replacementPod(pod))
+		if err != nil {
+			return nil, err
+		}
+		if admitted == nil {
+			outcome.rejected = true
+			outcome.message = fmt.Sprintf("displaced from node %s, its replacement would be rejected: %s", pod.Spec.NodeName, resp.Result.Message)
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+
+		value := admitted.Spec.NodeSelector[controllers.LableNodePoolKey]
+		pool := after.poolByValue(value)
+		var nodes []corev1.Node
+		if pool != nil {
+			for _, name := range pool.Status.Nodes {
+				nodes = append(nodes, *after.nodes[name])
+			}
+		}
+		node := fitPod(admitted, nodes, staying)
+		if node == "" {
+			_, reason := controllers.DiagnosePendingPods(value, []*corev1.Pod{admitted}, nodes, staying)
+			outcome.unschedulable = true
+			outcome.message = fmt.Sprintf("displaced from node %s, unschedulable: %s", pod.Spec.NodeName, reason)
+		} else {
+			outcome.message = fmt.Sprintf("displaced from node %s, fits on node %s", pod.Spec.NodeName, node)
+			placed := *admitted
+			placed.Spec.NodeName = node
+			staying = append(staying, placed)
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes, nil
+}
+
+// fitPod returns the first schedulable node the pod fits on
+func fitPod(pod *corev1.Pod, nodes []corev1.Node, pods []corev1.Pod) string {
+	reqs := controllers.PodRequests(pod)
+	for i := range nodes {
+		if !controllers.IsNodeSchedulableFor(&nodes[i], pod) {
+			continue
+		}
+		if controllers.FitsResources(reqs, controllers.NodeFreeResources(&nodes[i], pods)) {
+			return nodes[i].Name
+		}
+	}
+	return ""
+}
+
+// exemptFromPlan pods are not bound to nodepools, their owners are looked up among the loaded objects
+func exemptFromPlan(ctx context.Context, c client.Reader, pod *corev1.Pod) (bool, error) {
+	if controllers.InclusionExceptionNs(pod.Namespace) || controllers.IsSkipAuthorized(pod) {
+		return true, nil
+	}
+	return controllers.IsNodePod(ctx, c, pod)
+}
+
+// replacementPod is the pod its controller would create instead of the displaced one
+func replacementPod(pod *corev1.Pod) *corev1.Pod {
+	// 复制元数据，准入的修改不能影响planState中的pod
+	meta := pod.ObjectMeta.DeepCopy()
+	r := &corev1.Pod{}
+	r.Namespace = pod.Namespace
+	r.Name = pod.Name
+	r.Labels = meta.Labels
+	r.Annotations = meta.Annotations
+	r.OwnerReferences = meta.OwnerReferences
+	r.Spec = *pod.Spec.DeepCopy()
+	r.Spec.NodeName = ""
+	delete(r.Spec.NodeSelector, controllers.LableNodePoolKey)
+	return r
+}
+
+// readyMembers counts the ready member nodes of the nodepool
+func (s *planState) readyMembers(pool *poolv1.NodePool) int {
+	ready := 0
+	for _, name := range pool.Status.Nodes {
+		if node, ok := s.nodes[name]; ok && controllers.IsNodeReady(node) {
+			ready++
+		}
+	}
+	return ready
+}
+
+func (p *plan) print(out io.Writer) {
+	unschedulable, rejected := 0, 0
+	fmt.Fprintln(out, "Nodepools:")
+	if len(p.pools) == 0 {
+		fmt.Fprintln(out, "  no changes")
+	}
+	for _, change := range p.pools {
+		fmt.Fprintf(out, "  %s: %d -> %d nodes", change.key, change.before, change.after)
+		for _, name := range change.gained {
+			fmt.Fprintf(out, " +%s", name)
+		}
+		for _, name := range change.lost {
+			fmt.Fprintf(out, " -%s", name)
+		}
+		fmt.Fprintln(out)
+	}
+
+	fmt.Fprintln(out, "Pods:")
+	if len(p.displaced) == 0 {
+		fmt.Fprintln(out, "  none displaced")
+	}
+	for _, outcome := range p.displaced {
+		if outcome.unschedulable {
+			unschedulable++
+		}
+		if outcome.rejected {
+			rejected++
+		}
+		fmt.Fprintf(out, "  %s: %s\n", outcome.key, outcome.message)
+	}
+
+	for _, key := range p.emptied {
+		fmt.Fprintf(out, "Warning: nodepool %s has no ready node left, new pods of namespace %s are handled by the %s empty pool policy\n",
+			key, key.Namespace, webhook.EmptyPoolPolicy)
+	}
+	fmt.Fprintf(out, "Summary: %d nodepool(s) changed, %d pod(s) displaced, %d unschedulable, %d rejected\n",
+		len(p.pools), len(p.displaced), unschedulable, rejected)
+}
+
+// difference returns the names of a which are not in b
+func difference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, name := range b {
+		in[name] = true
+	}
+	var diff []string
+	for _, name := range a {
+		if !in[name] {
+			diff = append(diff, name)
+		}
+	}
+	return diff
+}
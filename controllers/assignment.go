@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// LabelPool is set on admitted pods to the nodepool label value they are pinned to
+	LabelPool = "nodepool.sunkai.xyz/pool"
+	// AnnotationAssignedBy records the nodepool a pod was admitted against, see Assignment
+	AnnotationAssignedBy = "nodepool.sunkai.xyz/assigned-by"
+
+	// PolicyNamespace, the pod was pinned to the nodepool of its namespace
+	PolicyNamespace = "namespace"
+	// PolicySkip, the creator of the pod was allowed to skip the nodepool of its namespace
+	PolicySkip = "skip"
+	// PolicyFallback, the nodepool of the namespace had no ready node, the pod was pinned to the fallback nodepool
+	PolicyFallback = "fallback"
+)
+
+var (
+	// AssignmentKey signs the assignments recorded by the webhook, no assignment is trusted while it is empty
+	AssignmentKey []byte
+	// FallbackPool, nodepool label value of the shared nodepool used by the fallback empty pool policy of the webhook
+	FallbackPool = ""
+)
+
+// LoadAssignmentKey reads AssignmentKey from the file
+func LoadAssignmentKey(path string) error {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return fmt.Errorf("assignment key file %s is empty", path)
+	}
+	AssignmentKey = key
+	return nil
+}
+
+// Assignment is the value of the assigned-by annotation
+type Assignment struct {
+	// Pool, namespace/name of the nodepool of the namespace, empty when it did not exist
+	Pool string `json:"pool,omitempty"`
+	// Generation, generation of the nodepool at admission
+	Generation int64 `json:"generation,omitempty"`
+	// Policy, PolicyNamespace, PolicySkip or the empty pool policy applied
+	Policy string `json:"policy"`
+	// Fallback, FallbackPool the pod was pinned to because the nodepool of its namespace had no ready node
+	Fallback string `json:"fallback,omitempty"`
+	// Signature, HMAC of the assignment with AssignmentKey, bound to the namespace and name of the pod
+	Signature string `json:"signature,omitempty"`
+}
+
+// SignAssignment signs the assignment of the pod admitted into the namespace, the namespace of the pod may still be
+// empty at admission
+func SignAssignment(assignment *Assignment, namespace string, pod *corev1.Pod) {
+	assignment.Signature = assignmentSignature(*assignment, namespace, pod)
+}
+
+// assignmentSignature computes the signature of the assignment without its Signature field.
+// The name is not set yet at admission for pods created with generateName, which is signed instead.
+func assignmentSignature(assignment Assignment, namespace string, pod *corev1.Pod) string {
+	assignment.Signature = ""
+	record, _ := json.Marshal(assignment)
+	name := pod.GenerateName
+	if name == "" {
+		name = pod.Name
+	}
+	mac := hmac.New(sha256.New, AssignmentKey)
+	mac.Write([]byte(namespace + "/" + name + "\n"))
+	mac.Write(record)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PodAssignment The assignment recorded on the pod by the webhook, nil when missing, malformed or not signed with
+// AssignmentKey. The creator of the pod can write the annotation as well, only the signature tells it was the webhook.
+func PodAssignment(pod *corev1.Pod) *Assignment {
+	raw, ok := pod.Annotations[AnnotationAssignedBy]
+	if !ok || len(AssignmentKey) == 0 {
+		return nil
+	}
+	assignment := &Assignment{}
+	if err := json.Unmarshal([]byte(raw), assignment); err != nil {
+		return nil
+	}
+	want := assignmentSignature(*assignment, pod.Namespace, pod)
+	if !hmac.Equal([]byte(assignment.Signature), []byte(want)) {
+		return nil
+	}
+	return assignment
+}
+
+// IsSkipAuthorized Whether the pod carries the skip annotation and the webhook recorded that its creator was allowed to.
+// Neither annotation is trusted alone, both may have been set while the webhook was down or failing open.
+func IsSkipAuthorized(pod *corev1.Pod) bool {
+	if pod.Annotations[AnnotationSkip] != "true" {
+		return false
+	}
+	assignment := PodAssignment(pod)
+	return assignment != nil && assignment.Policy == PolicySkip
+}
+
+// FallbackPoolValue The nodepool label value the pod was pinned to by the fallback empty pool policy, empty otherwise.
+// Only the signed assignment of the webhook is trusted, and only while it names the configured FallbackPool.
+func FallbackPoolValue(pod *corev1.Pod) string {
+	assignment := PodAssignment(pod)
+	if FallbackPool == "" || assignment == nil || assignment.Policy != PolicyFallback || assignment.Fallback != FallbackPool {
+		return ""
+	}
+	return FallbackPool
+}
+
+// InFallbackPool Whether the pod was pinned to the fallback nodepool at admission and the node belongs to it
+func InFallbackPool(ctx context.Context, c client.Reader, pod *corev1.Pod, nodeName string) (bool, error) {
+	value := FallbackPoolValue(pod)
+	if value == "" {
+		return false, nil
+	}
+	node := &corev1.Node{}
+	err := c.Get(ctx, types.NamespacedName{Name: nodeName}, node)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	nodeValue, ok := NodePoolValue(node)
+	return ok && nodeValue == value, nil
+}
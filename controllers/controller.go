@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
@@ -8,8 +10,9 @@ var ExceptionNs = make([]string, 1)
 
 func NameSpaceControllerRun(mgr ctrl.Manager)  {
 	if err := (&NamespaceReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("nodepool-namespace"),
 	}).SetupWithManager(mgr); err != nil {
 		ctrl.Log.Error(err, "unable to create controller", "controller", "namespace")
 		panic(err)
@@ -19,8 +22,9 @@ func NameSpaceControllerRun(mgr ctrl.Manager)  {
 
 func NodePoolControllerRun(mgr ctrl.Manager)  {
 	if err := (&NodePoolReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("nodepool"),
 	}).SetupWithManager(mgr); err != nil {
 		ctrl.Log.Error(err, "unable to create controller", "controller", "nodepool")
 		panic(err)
@@ -29,10 +33,65 @@ func NodePoolControllerRun(mgr ctrl.Manager)  {
 
 func NodeControllerRun(mgr ctrl.Manager)  {
 	if err := (&NodeReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("nodepool-node"),
+		KubeClient: kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+	}).SetupWithManager(mgr); err != nil {
+		ctrl.Log.Error(err, "unable to create controller", "controller", "node")
+		panic(err)
+	}
+}
+
+func NodePoolMoveControllerRun(mgr ctrl.Manager) {
+	if err := (&NodePoolMoveReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("nodepool-move"),
+		KubeClient: kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+	}).SetupWithManager(mgr); err != nil {
+		ctrl.Log.Error(err, "unable to create controller", "controller", "nodepoolmove")
+		panic(err)
+	}
+}
+
+func DiagnosticsControllerRun(mgr ctrl.Manager) {
+	if err := (&DiagnosticsReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		ctrl.Log.Error(err, "unable to create controller", "controller", "node")
+		ctrl.Log.Error(err, "unable to create controller", "controller", "diagnostics")
+		panic(err)
+	}
+}
+
+func RulesControllerRun(mgr ctrl.Manager) {
+	if err := (&RulesReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("nodepool-rules"),
+	}).SetupWithManager(mgr); err != nil {
+		ctrl.Log.Error(err, "unable to create controller", "controller", "noderules")
+		panic(err)
+	}
+}
+
+func FieldIndexerRun(mgr ctrl.Manager) {
+	if err := SetupFieldIndexes(mgr); err != nil {
+		ctrl.Log.Error(err, "unable to set up field indexes")
+		panic(err)
+	}
+}
+
+func DriftControllerRun(mgr ctrl.Manager) {
+	if err := (&DriftReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("nodepool-drift"),
+		KubeClient: kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+		Limiter:    flowcontrol.NewTokenBucketRateLimiter(float32(DriftEvictionQPS), 1),
+	}).SetupWithManager(mgr); err != nil {
+		ctrl.Log.Error(err, "unable to create controller", "controller", "drift")
 		panic(err)
 	}
 }
@@ -0,0 +1,265 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	poolv1 "nodepool/api/v1"
+)
+
+// diagnosticsRecheckInterval re-evaluates capacity while pods are pending, node capacity changes are not watched
+const diagnosticsRecheckInterval = time.Minute
+
+// DiagnosticsReconciler summarizes unschedulable pods of a namespace on its nodepool
+type DiagnosticsReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools,verbs=get;list;watch
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+
+// Reconcile, 统计namespace下无法调度的pod，并和nodepool的容量进行对比
+func (r *DiagnosticsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	pool := poolv1.NodePool{}
+	err := r.Get(ctx, req.NamespacedName, &pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		l.Error(err, fmt.Sprintf("error on getting nodepool:%v", req))
+		return ctrl.Result{}, err
+	}
+
+	if InclusionExceptionNs(pool.Namespace) || pool.Name != DefaultNodePoolName {
+		return ctrl.Result{}, nil
+	}
+
+	// 包括继承该nodepool的子namespace的pod
+	podList, err := ListPoolPods(ctx, r.Client, &pool)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on getting pods of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+
+	pending := make([]*corev1.Pod, 0)
+	for i := 0; i < len(podList.Items); i++ {
+		if IsPodUnschedulable(&podList.Items[i]) {
+			pending = append(pending, &podList.Items[i])
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreationTimestamp.Before(&pending[j].CreationTimestamp)
+	})
+
+	cond := metav1.Condition{
+		Type:               poolv1.ConditionCapacityExhausted,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoPendingPods",
+		Message:            "no pod is waiting for capacity",
+		ObservedGeneration: pool.Generation,
+	}
+	var summary *poolv1.PendingPods
+
+	if len(pending) > 0 {
+		nodes := make([]corev1.Node, 0, len(pool.Status.Nodes))
+		nodePods := make([]corev1.Pod, 0)
+		for _, name := range pool.Status.Nodes {
+			node := corev1.Node{}
+			if err = r.Get(ctx, types.NamespacedName{Name: name}, &node); err != nil {
+				if errors.IsNotFound(err) {
+					continue
+				}
+				l.Error(err, fmt.Sprintf("error on getting node:%s", name))
+				return ctrl.Result{}, err
+			}
+			nodes = append(nodes, node)
+
+			pods := corev1.PodList{}
+			if err = r.List(ctx, &pods, client.MatchingFields{PodNodeNameField: name}); err != nil {
+				l.Error(err, fmt.Sprintf("error on getting pods of node:%s", name))
+				return ctrl.Result{}, err
+			}
+			nodePods = append(nodePods, pods.Items...)
+		}
+
+		exhausted, reason := DiagnosePendingPods(PoolSelectorValue(&pool), pending, nodes, nodePods)
+		names := make([]string, 0, len(pending))
+		for _, pod := range pending {
+			names = append(names, PoolPodName(&pool, pod))
+		}
+		if len(names) > poolv1.MaxPendingPods {
+			names = names[:poolv1.MaxPendingPods]
+		}
+		since := pending[0].CreationTimestamp
+		summary = &poolv1.PendingPods{
+			Count:  int32(len(pending)),
+			Pods:   names,
+			Since:  &since,
+			Reason: reason,
+		}
+
+		cond.Reason = "PodsPending"
+		cond.Message = reason
+		if exhausted {
+			cond.Status = metav1.ConditionTrue
+			cond.Reason = "InsufficientCapacity"
+		}
+	}
+
+	err = PatchPoolStatus(ctx, r.Client, &pool, FieldOwnerDiagnostics, func(pool *poolv1.NodePool) {
+		pool.Status.Pending = summary
+		meta.SetStatusCondition(&pool.Status.Conditions, cond)
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to update pending pods of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+
+	if summary != nil {
+		return ctrl.Result{RequeueAfter: diagnosticsRecheckInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// DiagnosePendingPods Explain why the pending pods do not fit on the nodes of the pool.
+// exhausted is true when at least one pod does not fit on any schedulable node because of its resource requests.
+func DiagnosePendingPods(poolName string, pending []*corev1.Pod, nodes []corev1.Node, nodePods []corev1.Pod) (exhausted bool, reason string) {
+	if len(nodes) == 0 {
+		return true, fmt.Sprintf("pool %s: has no nodes", poolName)
+	}
+
+	free := make(map[string]corev1.ResourceList, len(nodes))
+	for i := 0; i < len(nodes); i++ {
+		free[nodes[i].Name] = NodeFreeResources(&nodes[i], nodePods)
+	}
+
+	for _, pod := range pending {
+		reqs := PodRequests(pod)
+		schedulable, fit := 0, 0
+		fitByResource := make(map[corev1.ResourceName]int, len(reqs))
+		for i := 0; i < len(nodes); i++ {
+			node := &nodes[i]
+			if !IsNodeSchedulableFor(node, pod) {
+				continue
+			}
+			schedulable++
+			if FitsResources(reqs, free[node.Name]) {
+				fit++
+			}
+			for name, q := range reqs {
+				if FitsResources(corev1.ResourceList{name: q}, free[node.Name]) {
+					fitByResource[name]++
+				}
+			}
+		}
+
+		if schedulable == 0 {
+			return true, fmt.Sprintf("pool %s: 0/%d nodes are schedulable (cordoned, not ready or tainted)", poolName, len(nodes))
+		}
+		if fit > 0 {
+			continue
+		}
+
+		// 找出最稀缺的资源
+		names := make([]string, 0, len(reqs))
+		for name := range reqs {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+		scarce := corev1.ResourceName("")
+		for _, name := range names {
+			rn := corev1.ResourceName(name)
+			if q := reqs[rn]; q.IsZero() {
+				continue
+			}
+			if scarce == "" || fitByResource[rn] < fitByResource[scarce] {
+				scarce = rn
+			}
+		}
+		if scarce == "" {
+			return true, fmt.Sprintf("pool %s: 0/%d nodes can fit pod %s", poolName, len(nodes), pod.Name)
+		}
+		return true, fmt.Sprintf("pool %s: %d/%d nodes have %s free", poolName, fitByResource[scarce], len(nodes),
+			formatQuantity(scarce, reqs[scarce]))
+	}
+
+	return false, fmt.Sprintf("pool %s: %d pod(s) pending although nodes have enough capacity, check affinity, ports and volumes",
+		poolName, len(pending))
+}
+
+// IsPodUnschedulable Whether the scheduler failed to find a node for the pod
+func IsPodUnschedulable(pod *corev1.Pod) bool {
+	if pod.Spec.NodeName != "" || pod.Status.Phase != corev1.PodPending || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled {
+			return cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable
+		}
+	}
+	return false
+}
+
+// podSchedulingChanged only passes pod updates which change whether the pod is unschedulable
+var podSchedulingChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPod, ok := e.ObjectOld.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		newPod, ok := e.ObjectNew.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		return IsPodUnschedulable(oldPod) != IsPodUnschedulable(newPod)
+	},
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DiagnosticsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("diagnostics").
+		For(&poolv1.NodePool{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(PodToNamespacePool(mgr.GetClient())),
+			builder.WithPredicates(podSchedulingChanged)).
+		Complete(r)
+}
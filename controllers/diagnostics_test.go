@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// readyNode a ready node with the given allocatable cpu and memory
+func readyNode(name, cpu, memory string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+			},
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// requestingPod a pod with one container requesting cpu and memory, bound to node when set
+func requestingPod(name, node, cpu, memory string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: corev1.PodSpec{
+			NodeName: node,
+			Containers: []corev1.Container{{Name: "app", Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+			}}}},
+		},
+	}
+}
+
+func TestPodRequests(t *testing.T) {
+	container := func(cpu, memory string) corev1.Container {
+		return corev1.Container{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		}}}
+	}
+	tests := []struct {
+		name   string
+		spec   corev1.PodSpec
+		cpu    string
+		memory string
+	}{
+		{
+			name: "containers are summed",
+			spec: corev1.PodSpec{Containers: []corev1.Container{container("100m", "64Mi"), container("200m", "64Mi")}},
+			cpu:  "300m", memory: "128Mi",
+		},
+		{
+			name: "init containers below the sum",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{container("250m", "32Mi"), container("250m", "32Mi")},
+				Containers:     []corev1.Container{container("100m", "64Mi"), container("200m", "64Mi")},
+			},
+			cpu: "300m", memory: "128Mi",
+		},
+		{
+			name: "largest init container above the sum",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{container("1", "32Mi"), container("500m", "1Gi")},
+				Containers:     []corev1.Container{container("100m", "64Mi"), container("200m", "64Mi")},
+			},
+			cpu: "1", memory: "1Gi",
+		},
+		{
+			name: "overhead is added",
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{container("100m", "64Mi")},
+				Overhead: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("50m"),
+					corev1.ResourceMemory: resource.MustParse("16Mi"),
+				},
+			},
+			cpu: "150m", memory: "80Mi",
+		},
+		{name: "no requests", spec: corev1.PodSpec{Containers: []corev1.Container{{}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs := PodRequests(&corev1.Pod{Spec: tt.spec})
+			if tt.cpu == "" {
+				if len(reqs) != 0 {
+					t.Fatalf("requests %v, want none", reqs)
+				}
+				return
+			}
+			cpu, memory := reqs[corev1.ResourceCPU], reqs[corev1.ResourceMemory]
+			if cpu.Cmp(resource.MustParse(tt.cpu)) != 0 || memory.Cmp(resource.MustParse(tt.memory)) != 0 {
+				t.Fatalf("requests cpu %s memory %s, want %s %s", cpu.String(), memory.String(), tt.cpu, tt.memory)
+			}
+		})
+	}
+}
+
+func TestDiagnosePendingPods(t *testing.T) {
+	tainted := readyNode("node-b", "4", "8Gi")
+	tainted.Spec.Taints = []corev1.Taint{{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule}}
+	cordoned := readyNode("node-b", "4", "8Gi")
+	cordoned.Spec.Unschedulable = true
+	notReady := readyNode("node-b", "4", "8Gi")
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+	tolerating := requestingPod("pending", "", "1", "1Gi")
+	tolerating.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}
+
+	tests := []struct {
+		name      string
+		pending   *corev1.Pod
+		nodes     []corev1.Node
+		nodePods  []corev1.Pod
+		exhausted bool
+		reason    string
+	}{
+		{
+			name:      "empty pool",
+			pending:   requestingPod("pending", "", "1", "1Gi"),
+			exhausted: true,
+			reason:    "has no nodes",
+		},
+		{
+			name:      "insufficient cpu",
+			pending:   requestingPod("pending", "", "2", "1Gi"),
+			nodes:     []corev1.Node{readyNode("node-a", "4", "8Gi"), readyNode("node-b", "4", "8Gi")},
+			nodePods:  []corev1.Pod{*requestingPod("busy-a", "node-a", "3", "1Gi"), *requestingPod("busy-b", "node-b", "3", "1Gi")},
+			exhausted: true,
+			reason:    "0/2 nodes have 2 CPU free",
+		},
+		{
+			name:      "memory free on one node",
+			pending:   requestingPod("pending", "", "1", "4Gi"),
+			nodes:     []corev1.Node{readyNode("node-a", "4", "8Gi"), readyNode("node-b", "4", "8Gi")},
+			nodePods:  []corev1.Pod{*requestingPod("busy-a", "node-a", "1", "6Gi")},
+			exhausted: false,
+			reason:    "pending although nodes have enough capacity",
+		},
+		{
+			name:      "insufficient memory on every node",
+			pending:   requestingPod("pending", "", "1", "4Gi"),
+			nodes:     []corev1.Node{readyNode("node-a", "4", "8Gi"), readyNode("node-b", "4", "8Gi")},
+			nodePods:  []corev1.Pod{*requestingPod("busy-a", "node-a", "1", "6Gi"), *requestingPod("busy-b", "node-b", "1", "6Gi")},
+			exhausted: true,
+			reason:    "0/2 nodes have 4Gi memory free",
+		},
+		{
+			name:    "terminated pods free their requests",
+			pending: requestingPod("pending", "", "2", "1Gi"),
+			nodes:   []corev1.Node{readyNode("node-a", "4", "8Gi")},
+			nodePods: []corev1.Pod{func() corev1.Pod {
+				pod := *requestingPod("done", "node-a", "3", "1Gi")
+				pod.Status.Phase = corev1.PodSucceeded
+				return pod
+			}()},
+			exhausted: false,
+		},
+		{
+			name:      "tainted node",
+			pending:   requestingPod("pending", "", "1", "1Gi"),
+			nodes:     []corev1.Node{tainted},
+			exhausted: true,
+			reason:    "0/1 nodes are schedulable",
+		},
+		{
+			name:      "tolerated taint",
+			pending:   tolerating,
+			nodes:     []corev1.Node{tainted},
+			exhausted: false,
+		},
+		{
+			name:      "cordoned node",
+			pending:   requestingPod("pending", "", "1", "1Gi"),
+			nodes:     []corev1.Node{cordoned},
+			exhausted: true,
+			reason:    "0/1 nodes are schedulable",
+		},
+		{
+			name:      "not ready node",
+			pending:   requestingPod("pending", "", "1", "1Gi"),
+			nodes:     []corev1.Node{notReady},
+			exhausted: true,
+			reason:    "0/1 nodes are schedulable",
+		},
+		{
+			name: "init container larger than the node",
+			pending: func() *corev1.Pod {
+				pod := requestingPod("pending", "", "1", "1Gi")
+				pod.Spec.InitContainers = []corev1.Container{{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse("6"),
+				}}}}
+				return pod
+			}(),
+			nodes:     []corev1.Node{readyNode("node-a", "4", "8Gi")},
+			exhausted: true,
+			reason:    "0/1 nodes have 6 CPU free",
+		},
+		{
+			name: "init containers fit one at a time",
+			pending: func() *corev1.Pod {
+				pod := requestingPod("pending", "", "1", "1Gi")
+				init := corev1.Container{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse("3"),
+				}}}
+				pod.Spec.InitContainers = []corev1.Container{init, init}
+				return pod
+			}(),
+			nodes:     []corev1.Node{readyNode("node-a", "4", "8Gi")},
+			exhausted: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exhausted, reason := DiagnosePendingPods("tenant/default", []*corev1.Pod{tt.pending}, tt.nodes, tt.nodePods)
+			if exhausted != tt.exhausted {
+				t.Fatalf("exhausted = %v, want %v: %s", exhausted, tt.exhausted, reason)
+			}
+			if !strings.Contains(reason, tt.reason) {
+				t.Fatalf("reason %q, want it to contain %q", reason, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	poolv1 "nodepool/api/v1"
+)
+
+var (
+	// EvictDriftedPods, evict pods running outside of their namespace's nodepool
+	EvictDriftedPods = false
+	// DriftEvictionQPS, max evictions per second issued by the drift detector across all nodepools
+	DriftEvictionQPS = 0.1
+)
+
+// driftRetryInterval is how long to wait before retrying evictions that were rate limited or refused
+const driftRetryInterval = 30 * time.Second
+
+// DriftReconciler finds pods running on nodes outside of their namespace's nodepool
+type DriftReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
+	KubeClient kubernetes.Interface
+	Limiter    flowcontrol.RateLimiter
+}
+
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools,verbs=get;list;watch
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods/eviction,verbs=create
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile, 检查namespace下的pod是否运行在nodepool之外的node上
+func (r *DriftReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	pool := poolv1.NodePool{}
+	err := r.Get(ctx, req.NamespacedName, &pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		l.Error(err, fmt.Sprintf("error on getting nodepool:%v", req))
+		return ctrl.Result{}, err
+	}
+
+	// webhook只会把pod固定到namespace默认的nodepool
+	if InclusionExceptionNs(pool.Namespace) || pool.Name != DefaultNodePoolName {
+		return ctrl.Result{}, nil
+	}
+
+	// 包括继承该nodepool的子namespace的pod
+	podList, err := ListPoolPods(ctx, r.Client, &pool)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on getting pods of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+
+	drifted, err := FindDriftedPods(ctx, r.Client, podList, &pool)
+	if err == nil {
+		drifted, err = r.withoutFallbackPods(ctx, drifted)
+	}
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on getting owners and nodes of drifted pods of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+	names := make([]string, 0, len(drifted))
+	for _, pod := range drifted {
+		names = append(names, PoolPodName(&pool, pod))
+	}
+	sort.Strings(names)
+
+	known := make(map[string]bool, len(pool.Status.DriftedPods))
+	for _, name := range pool.Status.DriftedPods {
+		known[name] = true
+	}
+	for _, pod := range drifted {
+		if !known[PoolPodName(&pool, pod)] {
+			r.Recorder.Eventf(&pool, corev1.EventTypeWarning, "PodDrifted",
+				"pod %s/%s is running on node %s which is not in nodepool", pod.Namespace, pod.Name, pod.Spec.NodeName)
+		}
+	}
+
+	total := len(names)
+	if len(names) > poolv1.MaxDriftedPods {
+		names = names[:poolv1.MaxDriftedPods]
+	}
+	if len(names) == 0 {
+		names = nil
+	}
+
+	cond := metav1.Condition{
+		Type:               poolv1.ConditionPodsDrifted,
+		Status:             metav1.ConditionFalse,
+		Reason:             "AllPodsInPool",
+		Message:            "all pods are running on nodes of the nodepool",
+		ObservedGeneration: pool.Generation,
+	}
+	if total > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "PodsOutsidePool"
+		cond.Message = fmt.Sprintf("%d pod(s) are running on nodes outside of the nodepool", total)
+	}
+
+	changed := false
+	err = PatchPoolStatus(ctx, r.Client, &pool, FieldOwnerDrift, func(pool *poolv1.NodePool) {
+		changed = !reflect.DeepEqual(pool.Status.DriftedPods, names)
+		pool.Status.DriftedPods = names
+		meta.SetStatusCondition(&pool.Status.Conditions, cond)
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to update drifted pods of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+	if changed {
+		l.Info(fmt.Sprintf("nodepool:%s/%s has %d drifted pod(s)", pool.Namespace, pool.Name, total))
+	}
+
+	if !EvictDriftedPods || total == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	// nodepool中没有node时驱逐只会让pod处于Pending状态
+	if len(pool.Status.Nodes) == 0 {
+		l.Info(fmt.Sprintf("nodepool:%s/%s has no nodes, skip evicting drifted pods", pool.Namespace, pool.Name))
+		return ctrl.Result{}, nil
+	}
+
+	return r.evictDriftedPods(ctx, &pool, drifted)
+}
+
+// evictDriftedPods evicts drifted pods so that their controllers recreate them inside the nodepool
+func (r *DriftReconciler) evictDriftedPods(ctx context.Context, pool *poolv1.NodePool, pods []*corev1.Pod) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	retry := false
+	for _, pod := range pods {
+		if !IsPodEvictable(pod) || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if !r.Limiter.TryAccept() {
+			retry = true
+			break
+		}
+
+		evicted, err := EvictPod(ctx, r.KubeClient, pod)
+		if err != nil {
+			l.Error(err, fmt.Sprintf("failed to evict drifted pod:%s/%s", pod.Namespace, pod.Name))
+			return ctrl.Result{}, err
+		}
+		if !evicted {
+			l.Info(fmt.Sprintf("eviction of drifted pod:%s/%s refused by PodDisruptionBudget", pod.Namespace, pod.Name))
+			retry = true
+			continue
+		}
+		r.Recorder.Eventf(pool, corev1.EventTypeNormal, "DriftedPodEvicted",
+			"evicted pod %s/%s from node %s", pod.Namespace, pod.Name, pod.Spec.NodeName)
+		l.Info(fmt.Sprintf("evicted drifted pod:%s/%s from node:%s", pod.Namespace, pod.Name, pod.Spec.NodeName))
+	}
+
+	if retry {
+		return ctrl.Result{RequeueAfter: driftRetryInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// FindDriftedPods Find scheduled pods whose node is not a member of the nodepool, the owners of DaemonSet and mirror
+// pods are read with c
+func FindDriftedPods(ctx context.Context, c client.Reader, pods *corev1.PodList, pool *poolv1.NodePool) ([]*corev1.Pod, error) {
+	members := make(map[string]bool, len(pool.Status.Nodes))
+	for _, node := range pool.Status.Nodes {
+		members[node] = true
+	}
+
+	drifted := make([]*corev1.Pod, 0)
+	for i := 0; i < len(pods.Items); i++ {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" || IsPodTerminated(pod) {
+			continue
+		}
+		if members[pod.Spec.NodeName] || IsSkipAuthorized(pod) {
+			continue
+		}
+		// 不受nodepool约束的pod
+		nodePod, err := IsNodePod(ctx, c, pod)
+		if err != nil {
+			return nil, err
+		}
+		if !nodePod {
+			drifted = append(drifted, pod)
+		}
+	}
+	return drifted, nil
+}
+
+// withoutFallbackPods drops the pods pinned to the fallback nodepool at admission which run on a node of it
+func (r *DriftReconciler) withoutFallbackPods(ctx context.Context, pods []*corev1.Pod) ([]*corev1.Pod, error) {
+	drifted := pods[:0]
+	for _, pod := range pods {
+		fallback, err := InFallbackPool(ctx, r.Client, pod, pod.Spec.NodeName)
+		if err != nil {
+			return nil, err
+		}
+		if !fallback {
+			drifted = append(drifted, pod)
+		}
+	}
+	return drifted, nil
+}
+
+// podPlacementChanged only passes pod updates which may change the drift result
+var podPlacementChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPod, ok := e.ObjectOld.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		newPod, ok := e.ObjectNew.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		return oldPod.Spec.NodeName != newPod.Spec.NodeName || oldPod.Status.Phase != newPod.Status.Phase
+	},
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DriftReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("drift").
+		For(&poolv1.NodePool{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}},
+			handler.EnqueueRequestsFromMapFunc(PodToNamespacePool(mgr.GetClient())),
+			builder.WithPredicates(podPlacementChanged)).
+		Complete(r)
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func testPod(name, node string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func newDriftReconciler(t *testing.T, objs ...client.Object) *DriftReconciler {
+	c := newTestClient(t, objs...)
+	return &DriftReconciler{
+		Client:   c,
+		Scheme:   c.Scheme(),
+		Recorder: record.NewFakeRecorder(100),
+		Limiter:  flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+}
+
+func setPoolNodes(t *testing.T, c client.Client, nodes ...string) {
+	pool := getTestPool(t, c)
+	pool.Status.Nodes = nodes
+	if err := c.Status().Update(context.Background(), pool); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withTestKey signs assignments with a test key until the test ends
+func withTestKey(t *testing.T) {
+	key := AssignmentKey
+	t.Cleanup(func() { AssignmentKey = key })
+	AssignmentKey = []byte("test-key")
+}
+
+// assignPod records the assignment on the pod like the webhook does
+func assignPod(pod *corev1.Pod, assignment Assignment) {
+	SignAssignment(&assignment, pod.Namespace, pod)
+	raw, _ := json.Marshal(assignment)
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[AnnotationAssignedBy] = string(raw)
+}
+
+func TestDriftReconcileFallbackPods(t *testing.T) {
+	withTestKey(t)
+	defer func(fallback string) { FallbackPool = fallback }(FallbackPool)
+	FallbackPool = "shared"
+
+	fallback := testPod("fallback", "node-shared")
+	assignPod(fallback, Assignment{Pool: "tenant/default", Policy: PolicyFallback, Fallback: "shared"})
+	// 只有被webhook固定到当前fallback nodepool的pod才可以运行在fallback nodepool上
+	forged := testPod("forged", "node-shared")
+	forged.Labels = map[string]string{LabelPool: "shared"}
+	forged.Annotations = map[string]string{AnnotationAssignedBy: `{"pool":"tenant/default","policy":"fallback","fallback":"shared"}`}
+	previous := testPod("previous", "node-old")
+	assignPod(previous, Assignment{Pool: "tenant/default", Policy: PolicyFallback, Fallback: "old"})
+
+	r := newDriftReconciler(t, testNode("node-a", testNamespace), testNode("node-shared", "shared"), testNode("node-old", "old"),
+		testPod("member", "node-a"), fallback, forged, previous)
+	setPoolNodes(t, r.Client, "node-a")
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	if drifted := getTestPool(t, r.Client).Status.DriftedPods; fmt.Sprint(drifted) != "[forged previous]" {
+		t.Fatalf("drifted pods %v, want [forged previous]", drifted)
+	}
+}
+
+// controlledPod returns a pod of a ReplicaSet, which can be evicted
+func controlledPod(name, node string) *corev1.Pod {
+	pod := testPod(name, node)
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", Controller: &controller}}
+	return pod
+}
+
+// ownedPod returns a pod controlled by the object
+func ownedPod(name, node string, owner client.Object, kind string) *corev1.Pod {
+	pod := testPod(name, node)
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1", Kind: kind, Name: owner.GetName(), UID: owner.GetUID(), Controller: &controller,
+	}}
+	return pod
+}
+
+func TestFindDriftedPods(t *testing.T) {
+	withTestKey(t)
+	terminated := testPod("terminated", "node-b")
+	terminated.Status.Phase = corev1.PodSucceeded
+
+	// UID与newTestClient生成的一致
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "agent"}}
+	ds.UID = types.UID(fmt.Sprintf("%T/%s/%s", ds, ds.Namespace, ds.Name))
+	daemon := ownedPod("daemon", "node-b", ds, "DaemonSet")
+	forgedDaemon := ownedPod("forged-daemon", "node-b", ds, "DaemonSet")
+	forgedDaemon.OwnerReferences[0].UID = "other"
+
+	node := testNode("node-b", "other")
+	node.UID = types.UID(fmt.Sprintf("%T/%s/%s", node, node.Namespace, node.Name))
+	mirror := ownedPod("mirror", "node-b", node, "Node")
+	mirror.OwnerReferences[0].APIVersion = "v1"
+	mirror.Annotations = map[string]string{MirrorPodAnnotationKey: "hash"}
+	forgedMirror := testPod("forged-mirror", "node-b")
+	forgedMirror.Annotations = map[string]string{MirrorPodAnnotationKey: "hash"}
+
+	skip := testPod("skip", "node-b")
+	skip.Annotations = map[string]string{AnnotationSkip: "true"}
+	assignPod(skip, Assignment{Policy: PolicySkip})
+	forgedSkip := testPod("forged-skip", "node-b")
+	forgedSkip.Annotations = map[string]string{AnnotationSkip: "true", AnnotationAssignedBy: `{"policy":"skip"}`}
+	// 签名与pod名称绑定，不能复制到其他pod
+	copiedSkip := testPod("copied-skip", "node-b")
+	copiedSkip.Annotations = skip.Annotations
+
+	objs := []client.Object{ds, node}
+	pods := &corev1.PodList{}
+	for _, pod := range []*corev1.Pod{
+		testPod("member", "node-a"), testPod("pending", ""), testPod("outside", "node-b"), terminated,
+		daemon, forgedDaemon, mirror, forgedMirror, skip, forgedSkip, copiedSkip,
+	} {
+		pods.Items = append(pods.Items, *pod)
+	}
+	pool := &poolv1.NodePool{Status: poolv1.NodePoolStatus{Nodes: []string{"node-a"}}}
+
+	drifted, err := FindDriftedPods(context.Background(), newTestClient(t, objs...), pods, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pod := range drifted {
+		got = append(got, pod.Name)
+	}
+	want := []string{"outside", "forged-daemon", "forged-mirror", "forged-skip", "copied-skip"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("drifted pods %v, want %v", got, want)
+	}
+}
+
+func TestDriftReconcileCondition(t *testing.T) {
+	r := newDriftReconciler(t, testPod("member", "node-a"))
+	setPoolNodes(t, r.Client, "node-a")
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	pool := getTestPool(t, r.Client)
+	cond := meta.FindStatusCondition(pool.Status.Conditions, poolv1.ConditionPodsDrifted)
+	if cond == nil || cond.Status != metav1.ConditionFalse || len(pool.Status.DriftedPods) != 0 {
+		t.Fatalf("condition %+v, drifted pods %v, want no drift", cond, pool.Status.DriftedPods)
+	}
+
+	// 超过MaxDriftedPods的pod只计数不列出
+	total := poolv1.MaxDriftedPods + 10
+	var want []string
+	for i := 0; i < total; i++ {
+		pod := testPod(fmt.Sprintf("web-%03d", i), "node-b")
+		if err := r.Create(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, pod.Name)
+	}
+	sort.Strings(want)
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	pool = getTestPool(t, r.Client)
+	cond = meta.FindStatusCondition(pool.Status.Conditions, poolv1.ConditionPodsDrifted)
+	if cond == nil || cond.Status != metav1.ConditionTrue || cond.Message != fmt.Sprintf("%d pod(s) are running on nodes outside of the nodepool", total) {
+		t.Fatalf("condition %+v, want %d drifted pods", cond, total)
+	}
+	if fmt.Sprint(pool.Status.DriftedPods) != fmt.Sprint(want[:poolv1.MaxDriftedPods]) {
+		t.Fatalf("drifted pods %v, want the first %d of %v", pool.Status.DriftedPods, poolv1.MaxDriftedPods, want)
+	}
+	if events := drainEvents(r.Recorder.(*record.FakeRecorder)); len(events) != total {
+		t.Fatalf("%d PodDrifted events, want %d", len(events), total)
+	}
+}
+
+func TestDriftEviction(t *testing.T) {
+	defer func(evict bool) { EvictDriftedPods = evict }(EvictDriftedPods)
+	EvictDriftedPods = true
+
+	tests := []struct {
+		name    string
+		limiter flowcontrol.RateLimiter
+		refuse  bool
+		nodes   []string
+		evicted bool
+		retry   bool
+	}{
+		{name: "evicted", nodes: []string{"node-a"}, evicted: true},
+		{name: "rate limited", limiter: flowcontrol.NewFakeNeverRateLimiter(), nodes: []string{"node-a"}, retry: true},
+		{name: "refused by PodDisruptionBudget", refuse: true, nodes: []string{"node-a"}, retry: true},
+		{name: "nodepool without nodes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newDriftReconciler(t, controlledPod("web", "node-b"), testPod("bare", "node-b"))
+			r.KubeClient = newEvictionClient(evictFrom(r.Client))
+			if tt.refuse {
+				r.KubeClient = newEvictionClient(func(namespace, name string) error {
+					return errors.NewTooManyRequests("disruption budget", 0)
+				})
+			}
+			if tt.limiter != nil {
+				r.Limiter = tt.limiter
+			}
+			setPoolNodes(t, r.Client, tt.nodes...)
+			ctx := context.Background()
+
+			result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if retry := result.RequeueAfter == driftRetryInterval; retry != tt.retry {
+				t.Fatalf("result %+v, want retry %t", result, tt.retry)
+			}
+			err = r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "web"}, &corev1.Pod{})
+			if evicted := errors.IsNotFound(err); evicted != tt.evicted {
+				t.Fatalf("pod evicted %t, want %t: %v", evicted, tt.evicted, err)
+			}
+			// 没有controller的pod驱逐后不会被重建
+			if err = r.Get(ctx, client.ObjectKey{Namespace: testNamespace, Name: "bare"}, &corev1.Pod{}); err != nil {
+				t.Fatalf("pod without controller evicted: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// MirrorPodAnnotationKey is set by the kubelet on mirror pods of static pods
+	MirrorPodAnnotationKey = "kubernetes.io/config.mirror"
+)
+
+// EvictPod Evict the pod through the Eviction API so that PodDisruptionBudgets are honored.
+// evicted is false when the eviction was refused by a PodDisruptionBudget and should be retried later.
+func EvictPod(ctx context.Context, kc kubernetes.Interface, pod *corev1.Pod) (evicted bool, err error) {
+	eviction := &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+	}
+	err = kc.PolicyV1().Evictions(pod.Namespace).Evict(ctx, eviction)
+	switch {
+	case err == nil, errors.IsNotFound(err):
+		return true, nil
+	case errors.IsTooManyRequests(err):
+		// PodDisruptionBudget不允许驱逐
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// IsMirrorPod Whether the pod carries the mirror annotation of static pods, the annotation can be set by any creator
+// of the pod, see IsNodePod
+func IsMirrorPod(pod *corev1.Pod) bool {
+	_, ok := pod.Annotations[MirrorPodAnnotationKey]
+	return ok
+}
+
+// PodDaemonSet The apps/v1 DaemonSet controlling the pod, nil when the pod claims none or the DaemonSet it names does
+// not exist with the same UID. The owner reference is written by the creator of the pod, so it is only trusted once
+// resolved.
+func PodDaemonSet(ctx context.Context, c client.Reader, pod *corev1.Pod) (*appsv1.DaemonSet, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil || ref.APIVersion != "apps/v1" || ref.Kind != "DaemonSet" {
+		return nil, nil
+	}
+	ds := &appsv1.DaemonSet{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: ref.Name}, ds)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ds.UID != ref.UID {
+		return nil, nil
+	}
+	return ds, nil
+}
+
+// IsDaemonSetPod Whether the pod is controlled by an existing apps/v1 DaemonSet, see PodDaemonSet
+func IsDaemonSetPod(ctx context.Context, c client.Reader, pod *corev1.Pod) (bool, error) {
+	ds, err := PodDaemonSet(ctx, c, pod)
+	return ds != nil, err
+}
+
+// isNodeMirrorPod Whether the pod is a mirror pod owned by the node it runs on, as the kubelet creates them
+func isNodeMirrorPod(ctx context.Context, c client.Reader, pod *corev1.Pod) (bool, error) {
+	ref := metav1.GetControllerOf(pod)
+	if !IsMirrorPod(pod) || ref == nil || ref.Kind != "Node" || ref.Name != pod.Spec.NodeName {
+		return false, nil
+	}
+	node := &corev1.Node{}
+	err := c.Get(ctx, types.NamespacedName{Name: ref.Name}, node)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return node.UID == ref.UID, nil
+}
+
+// IsNodePod Whether the pod runs on its node regardless of nodepools: the mirror of a static pod or a pod of a
+// DaemonSet. Both are checked against the node or DaemonSet owning the pod.
+func IsNodePod(ctx context.Context, c client.Reader, pod *corev1.Pod) (bool, error) {
+	mirror, err := isNodeMirrorPod(ctx, c, pod)
+	if err != nil || mirror {
+		return mirror, err
+	}
+	return IsDaemonSetPod(ctx, c, pod)
+}
+
+// IsPodTerminated Whether the pod has finished and no longer occupies its node
+func IsPodTerminated(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+// IsPodEvictable Whether evicting the pod lets its controller recreate it elsewhere, node pods are left out by the caller
+func IsPodEvictable(pod *corev1.Pod) bool {
+	if IsPodTerminated(pod) {
+		return false
+	}
+	return metav1.GetControllerOf(pod) != nil
+}
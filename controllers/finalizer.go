@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// NodePoolFinalizer releases the member nodes before the nodepool is removed
+	NodePoolFinalizer = "nodes.sunkai.xyz/release-nodes"
+
+	// TaintUnassigned keeps pods off released nodes until they are assigned to a nodepool again
+	TaintUnassigned = "nodepool.sunkai.xyz/unassigned"
+)
+
+var (
+	// FreePool, nodepool label value given to nodes released by a deleted nodepool, the label is removed when empty
+	FreePool = ""
+	// TaintReleasedNodes, taint nodes released by a deleted nodepool until they are reassigned
+	TaintReleasedNodes = false
+)
+
+// finalize releases the member nodes of a deleted nodepool and removes the finalizer
+func (r *NodePoolReconciler) finalize(ctx context.Context, pool *poolv1.NodePool) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(pool, NodePoolFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	release, err := r.shouldReleaseNodes(ctx, pool)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if release {
+		if err = r.releaseNodes(ctx, pool); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 其他namespace的ResourceQuota和LimitRange不会被级联删除
+	if ManageQuota && pool.Name == DefaultNodePoolName {
+		if err = r.deleteQuotas(ctx, pool, []string{pool.Namespace}); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	controllerutil.RemoveFinalizer(pool, NodePoolFinalizer)
+	err = r.Update(ctx, pool)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to remove finalizer of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// shouldReleaseNodes whether nobody will select the nodes of the nodepool after it is gone.
+// A deleted default nodepool of a live namespace is recreated and keeps its nodes.
+func (r *NodePoolReconciler) shouldReleaseNodes(ctx context.Context, pool *poolv1.NodePool) (bool, error) {
+	value := PoolSelectorValue(pool)
+	if value == "" {
+		return false, nil
+	}
+
+	poolList := poolv1.NodePoolList{}
+	if err := r.List(ctx, &poolList); err != nil {
+		return false, err
+	}
+	for i := 0; i < len(poolList.Items); i++ {
+		other := &poolList.Items[i]
+		if other.UID != pool.UID && other.DeletionTimestamp.IsZero() && PoolSelectorValue(other) == value {
+			return false, nil
+		}
+	}
+
+	if pool.Name != DefaultNodePoolName || InclusionExceptionNs(pool.Namespace) {
+		return true, nil
+	}
+	ns := corev1.Namespace{}
+	err := r.Get(ctx, types.NamespacedName{Name: pool.Namespace}, &ns)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return !ns.DeletionTimestamp.IsZero(), nil
+}
+
+// releaseNodes returns the nodes of the nodepool to FreePool, or unlabels them
+func (r *NodePoolReconciler) releaseNodes(ctx context.Context, pool *poolv1.NodePool) error {
+	l := log.FromContext(ctx)
+
+	value := PoolSelectorValue(pool)
+	nodeList := corev1.NodeList{}
+	if err := r.List(ctx, &nodeList); err != nil {
+		l.Error(err, "error on getting all nodes")
+		return err
+	}
+
+	for i := 0; i < len(nodeList.Items); i++ {
+		node := &nodeList.Items[i]
+		labelled := node.Labels[LableNodePoolKey] == value
+		releasing := node.Annotations[AnnotationReleasingFrom] == value
+		if !labelled && !releasing {
+			continue
+		}
+
+		patch := client.MergeFrom(node.DeepCopy())
+		if releasing {
+			delete(node.Annotations, AnnotationReleasingFrom)
+			if _, ok := node.Annotations[AnnotationCordoned]; ok {
+				node.Spec.Unschedulable = false
+				delete(node.Annotations, AnnotationCordoned)
+			}
+		}
+		if labelled {
+			if FreePool != "" {
+				node.Labels[LableNodePoolKey] = FreePool
+			} else {
+				delete(node.Labels, LableNodePoolKey)
+			}
+			if TaintReleasedNodes && !hasTaint(node, TaintUnassigned) {
+				node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{
+					Key:    TaintUnassigned,
+					Effect: corev1.TaintEffectNoSchedule,
+				})
+			}
+		}
+		if err := r.Patch(ctx, node, patch); err != nil {
+			l.Error(err, fmt.Sprintf("failed to release node:%s of nodepool:%s/%s", node.Name, pool.Namespace, pool.Name))
+			return err
+		}
+		l.Info(fmt.Sprintf("node:%s released by deleted nodepool:%s/%s", node.Name, pool.Namespace, pool.Name))
+	}
+	return nil
+}
+
+// removeUnassignedTaint drops the unassigned taint once the node was assigned to an existing nodepool
+func (r *NodeReconciler) removeUnassignedTaint(ctx context.Context, node *corev1.Node) error {
+	if !hasTaint(node, TaintUnassigned) {
+		return nil
+	}
+	patch := client.MergeFrom(node.DeepCopy())
+	taints := make([]corev1.Taint, 0, len(node.Spec.Taints))
+	for _, taint := range node.Spec.Taints {
+		if taint.Key != TaintUnassigned {
+			taints = append(taints, taint)
+		}
+	}
+	node.Spec.Taints = taints
+	return r.Patch(ctx, node, patch)
+}
+
+func hasTaint(node *corev1.Node, key string) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			return true
+		}
+	}
+	return false
+}
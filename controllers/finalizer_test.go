@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// deleteTestPool deletes the nodepool of testNamespace, the finalizer keeps it until reconciled
+func deleteTestPool(t *testing.T, c client.Client) {
+	t.Helper()
+	if err := c.Delete(context.Background(), getTestPool(t, c)); err != nil {
+		t.Fatal(err)
+	}
+	if getTestPool(t, c).DeletionTimestamp.IsZero() {
+		t.Fatal("nodepool deleted without running its finalizer")
+	}
+}
+
+func TestFinalizeReleasesNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		freePool string
+		taint    bool
+	}{
+		{name: "unlabel"},
+		{name: "free pool", freePool: "free"},
+		{name: "free pool tainted", freePool: "free", taint: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(free string, taint bool) { FreePool, TaintReleasedNodes = free, taint }(FreePool, TaintReleasedNodes)
+			FreePool, TaintReleasedNodes = tt.freePool, tt.taint
+
+			releasing := testNode("node-b", moveTarget)
+			releasing.Spec.Unschedulable = true
+			releasing.Annotations = map[string]string{AnnotationReleasingFrom: testNamespace, AnnotationCordoned: "true"}
+			c := newTestClient(t, testNode("node-a", testNamespace), releasing, testNode("node-c", moveTarget))
+			r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+			ctx := context.Background()
+
+			// namespace被删除后nodepool不会再被创建
+			if err := c.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}); err != nil {
+				t.Fatal(err)
+			}
+			deleteTestPool(t, c)
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Get(ctx, testPoolKey, &poolv1.NodePool{}); !errors.IsNotFound(err) {
+				t.Fatalf("finalizer of the nodepool not removed: %v", err)
+			}
+
+			member := getTestNode(t, c, "node-a")
+			if value, ok := NodePoolValue(member); (tt.freePool == "" && ok) || value != tt.freePool {
+				t.Fatalf("released node labelled %q, want %q", value, tt.freePool)
+			}
+			if hasTaint(member, TaintUnassigned) != tt.taint {
+				t.Fatalf("released node taints %v, want tainted %t", member.Spec.Taints, tt.taint)
+			}
+
+			// 正在释放的node只恢复调度，不修改标签
+			node := getTestNode(t, c, "node-b")
+			if _, ok := node.Annotations[AnnotationReleasingFrom]; ok || node.Spec.Unschedulable {
+				t.Fatalf("releasing node not handed over: %+v", node)
+			}
+			if value, _ := NodePoolValue(node); value != moveTarget || hasTaint(node, TaintUnassigned) {
+				t.Fatalf("releasing node relabelled %q, taints %v", value, node.Spec.Taints)
+			}
+			if value, _ := NodePoolValue(getTestNode(t, c, "node-c")); value != moveTarget {
+				t.Fatalf("node of another nodepool relabelled %q", value)
+			}
+		})
+	}
+}
+
+func TestFinalizeRecreatedDefaultPool(t *testing.T) {
+	defer func(taint bool) { TaintReleasedNodes = taint }(TaintReleasedNodes)
+	TaintReleasedNodes = true
+	c := newTestClient(t, testNode("node-a", testNamespace))
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+	ctx := context.Background()
+
+	// namespace还在，默认nodepool会被重新创建，node保持不变
+	deleteTestPool(t, c)
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	node := getTestNode(t, c, "node-a")
+	if value, _ := NodePoolValue(node); value != testNamespace || hasTaint(node, TaintUnassigned) {
+		t.Fatalf("node of a recreated nodepool released: label %q, taints %v", value, node.Spec.Taints)
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	pool := getTestPool(t, c)
+	if !pool.DeletionTimestamp.IsZero() {
+		t.Fatal("default nodepool not recreated")
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	if pool = getTestPool(t, c); !NodeInPool("node-a", pool) {
+		t.Fatalf("recreated nodepool lost its node: %v", pool.Status.Nodes)
+	}
+}
+
+func TestShouldReleaseNodes(t *testing.T) {
+	shared := GenerateNodePoolObj("shared", moveTarget)
+	shared.Spec.NodeSelector = map[string]string{LableNodePoolKey: testNamespace}
+	other := GenerateNodePoolObj("batch", testNamespace)
+	other.Spec.NodeSelector = map[string]string{LableNodePoolKey: "batch"}
+	tests := []struct {
+		name      string
+		pool      types.NamespacedName
+		objs      []client.Object
+		nsDeleted bool
+		want      bool
+	}{
+		{name: "default nodepool of a live namespace", pool: testPoolKey},
+		{name: "default nodepool of a deleted namespace", pool: testPoolKey, nsDeleted: true, want: true},
+		{name: "selector shared with another nodepool", pool: testPoolKey, objs: []client.Object{shared}, nsDeleted: true},
+		{name: "other nodepool of a live namespace", pool: client.ObjectKeyFromObject(other), objs: []client.Object{other}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, tt.objs...)
+			r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+			ctx := context.Background()
+			if tt.nsDeleted {
+				if err := c.Delete(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pool := &poolv1.NodePool{}
+			if err := c.Get(ctx, tt.pool, pool); err != nil {
+				t.Fatal(err)
+			}
+			release, err := r.shouldReleaseNodes(ctx, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if release != tt.want {
+				t.Fatalf("release nodes %t, want %t", release, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnassignedTaintRemovedOnReassign(t *testing.T) {
+	defer func(free string) { FreePool = free }(FreePool)
+	FreePool = "free"
+	node := testNode("node-a", FreePool)
+	node.Spec.Taints = []corev1.Taint{{Key: TaintUnassigned, Effect: corev1.TaintEffectNoSchedule}}
+	c := newTestClient(t, node, GenerateNodePoolObj(DefaultNodePoolName, FreePool))
+	r := &NodeReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "node-a"}}
+
+	// 仍在FreePool中的node保留污点
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if !hasTaint(getTestNode(t, c, "node-a"), TaintUnassigned) {
+		t.Fatal("taint of an unassigned node removed")
+	}
+
+	node = getTestNode(t, c, "node-a")
+	node.Labels[LableNodePoolKey] = testNamespace
+	if err := c.Update(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if hasTaint(getTestNode(t, c, "node-a"), TaintUnassigned) {
+		t.Fatal("taint of a reassigned node not removed")
+	}
+}
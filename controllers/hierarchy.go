@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// AnnotationInherit set to "false" on a child namespace gives it its own default nodepool
+const AnnotationInherit = "nodepool.sunkai.xyz/inherit"
+
+// hncTreeLabelSuffix, HNC labels a namespace with <ancestor>.tree.hnc.x-k8s.io/depth for each of its ancestors.
+// The labels are maintained by HNC and its webhook rejects changes made by users, so they are the only parent
+// records trusted: a namespace can not attach itself to the nodepool of another tenant.
+const hncTreeLabelSuffix = ".tree.hnc.x-k8s.io/depth"
+
+// HNCTreeLabel The label HNC sets on the descendants of the namespace, its value is their depth below it
+func HNCTreeLabel(ancestor string) string {
+	return ancestor + hncTreeLabelSuffix
+}
+
+// maxNamespaceDepth bounds the walk up the namespace hierarchy
+const maxNamespaceDepth = 16
+
+// NamespaceParent returns the parent namespace the namespace inherits its nodepool from, empty when it does not inherit
+func NamespaceParent(ns *corev1.Namespace) string {
+	if ns.Annotations[AnnotationInherit] == "false" {
+		return ""
+	}
+	for key, depth := range ns.Labels {
+		if depth != "1" || !strings.HasSuffix(key, hncTreeLabelSuffix) {
+			continue
+		}
+		parent := strings.TrimSuffix(key, hncTreeLabelSuffix)
+		if parent == ns.Name || InclusionExceptionNs(parent) {
+			return ""
+		}
+		return parent
+	}
+	return ""
+}
+
+// resolveNamespacePool walks up from the namespace to the first ancestor which does not inherit, the namespace
+// whose default nodepool pods of the namespace are pinned to. A parent takes precedence over the own nodepool of
+// the namespace, which becomes redundant, see ConditionRedundant.
+// It returns that namespace and its default nodepool, nil when it has none yet.
+// A cycle in the hierarchy resolves to the namespace itself.
+func resolveNamespacePool(ctx context.Context, c client.Reader, namespace string) (string, *poolv1.NodePool, error) {
+	owner, err := resolvePoolNamespace(ctx, c, namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	pool := &poolv1.NodePool{}
+	err = c.Get(ctx, types.NamespacedName{Namespace: owner, Name: DefaultNodePoolName}, pool)
+	if errors.IsNotFound(err) {
+		return owner, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return owner, pool, nil
+}
+
+// resolvePoolNamespace walks up from the namespace to the first ancestor which does not inherit
+func resolvePoolNamespace(ctx context.Context, c client.Reader, namespace string) (string, error) {
+	current := namespace
+	seen := map[string]bool{current: true}
+	for {
+		ns := &corev1.Namespace{}
+		err := c.Get(ctx, types.NamespacedName{Name: current}, ns)
+		if errors.IsNotFound(err) {
+			return current, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		parent := NamespaceParent(ns)
+		if parent == "" {
+			return current, nil
+		}
+		if seen[parent] || len(seen) > maxNamespaceDepth {
+			// 层级有环，不继承
+			return namespace, nil
+		}
+
+		// 父namespace不存在时不继承
+		err = c.Get(ctx, types.NamespacedName{Name: parent}, &corev1.Namespace{})
+		if errors.IsNotFound(err) {
+			return current, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		seen[parent] = true
+		current = parent
+	}
+}
+
+// PoolNamespace returns the namespace whose default nodepool pods of the namespace are pinned to,
+// the namespace itself unless it inherits the nodepool of an ancestor
+func PoolNamespace(ctx context.Context, c client.Reader, namespace string) (string, error) {
+	return resolvePoolNamespace(ctx, c, namespace)
+}
+
+// PoolNamespaces returns the namespaces whose pods are pinned to the default nodepool: its own namespace
+// and the descendants inheriting it, found level by level through the NamespaceParentField index.
+// None are pinned to the redundant default nodepool of a namespace which inherits itself.
+func PoolNamespaces(ctx context.Context, c client.Reader, pool *poolv1.NodePool) ([]string, error) {
+	namespaces := []string{pool.Namespace}
+	if pool.Name != DefaultNodePoolName {
+		return namespaces, nil
+	}
+	owner, err := PoolNamespace(ctx, c, pool.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if owner != pool.Namespace {
+		return nil, nil
+	}
+	seen := map[string]bool{pool.Namespace: true}
+	for i := 0; i < len(namespaces); i++ {
+		children := corev1.NamespaceList{}
+		if err := c.List(ctx, &children, client.MatchingFields{NamespaceParentField: namespaces[i]}); err != nil {
+			return nil, err
+		}
+		for j := range children.Items {
+			name := children.Items[j].Name
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			// 有环的层级不继承
+			owner, err := PoolNamespace(ctx, c, name)
+			if err != nil {
+				return nil, err
+			}
+			if owner == pool.Namespace {
+				namespaces = append(namespaces, name)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// ListPoolPods lists the pods of the namespaces pinned to the nodepool
+func ListPoolPods(ctx context.Context, c client.Reader, pool *poolv1.NodePool) (*corev1.PodList, error) {
+	namespaces, err := PoolNamespaces(ctx, c, pool)
+	if err != nil {
+		return nil, err
+	}
+	podList := &corev1.PodList{}
+	for _, namespace := range namespaces {
+		pods := corev1.PodList{}
+		if err := c.List(ctx, &pods, client.InNamespace(namespace)); err != nil {
+			return nil, err
+		}
+		podList.Items = append(podList.Items, pods.Items...)
+	}
+	return podList, nil
+}
+
+// ListPoolPodsOnNode lists the pods bound to the node of the namespaces pinned to the nodepool
+func ListPoolPodsOnNode(ctx context.Context, c client.Reader, pool *poolv1.NodePool, node string) ([]corev1.Pod, error) {
+	namespaces, err := PoolNamespaces(ctx, c, pool)
+	if err != nil {
+		return nil, err
+	}
+	pinned := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		pinned[namespace] = true
+	}
+	podList := corev1.PodList{}
+	if err := c.List(ctx, &podList, client.MatchingFields{PodNodeNameField: node}); err != nil {
+		return nil, err
+	}
+	pods := podList.Items[:0]
+	for i := range podList.Items {
+		if pinned[podList.Items[i].Namespace] {
+			pods = append(pods, podList.Items[i])
+		}
+	}
+	return pods, nil
+}
+
+// PoolPodName names a pod in the status of its nodepool, pods of inheriting namespaces are prefixed by their namespace
+func PoolPodName(pool *poolv1.NodePool, pod *corev1.Pod) string {
+	if pod.Namespace == pool.Namespace {
+		return pod.Name
+	}
+	return pod.Namespace + "/" + pod.Name
+}
+
+// PodToNamespacePool Map a pod to the nodepool of its namespace, inherited from an ancestor or its own
+func PodToNamespacePool(c client.Reader) func(obj client.Object) []reconcile.Request {
+	return func(obj client.Object) []reconcile.Request {
+		owner, err := PoolNamespace(context.Background(), c, obj.GetNamespace())
+		if err != nil {
+			owner = obj.GetNamespace()
+		}
+		return []reconcile.Request{{
+			NamespacedName: types.NamespacedName{Namespace: owner, Name: DefaultNodePoolName},
+		}}
+	}
+}
+
+// NamespaceToChildren Map a namespace to the namespaces naming it as their parent
+func NamespaceToChildren(c client.Reader) func(obj client.Object) []reconcile.Request {
+	return func(obj client.Object) []reconcile.Request {
+		children := corev1.NamespaceList{}
+		if err := c.List(context.Background(), &children, client.MatchingFields{NamespaceParentField: obj.GetName()}); err != nil {
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(children.Items))
+		for i := range children.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: children.Items[i].Name}})
+		}
+		return requests
+	}
+}
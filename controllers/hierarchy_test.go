@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func testChildNamespace(name, parent string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{HNCTreeLabel(parent): "1"},
+	}}
+}
+
+func TestNamespaceInheritsPool(t *testing.T) {
+	own := testChildNamespace("tenant-own", testNamespace)
+	own.Annotations = map[string]string{AnnotationInherit: "false"}
+	c := newTestClient(t,
+		testChildNamespace("tenant-ci", testNamespace),
+		testChildNamespace("tenant-ci-x", "tenant-ci"),
+		own,
+		testChildNamespace("loop-a", "loop-b"),
+		testChildNamespace("loop-b", "loop-a"),
+	)
+	r := &NamespaceReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+
+	// 有环的层级不继承
+	for _, name := range []string{"loop-a", "loop-b"} {
+		if owner, err := PoolNamespace(ctx, c, name); err != nil || owner != name {
+			t.Fatalf("namespace %s in a cycle resolves to %s, %v", name, owner, err)
+		}
+	}
+
+	// 继承的namespace不创建nodepool，其余的创建自己的
+	want := map[string]string{
+		"tenant-ci":   testNamespace,
+		"tenant-ci-x": testNamespace,
+		"tenant-own":  "tenant-own",
+	}
+	for name := range want {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, owner := range want {
+		err := c.Get(ctx, types.NamespacedName{Namespace: name, Name: DefaultNodePoolName}, &poolv1.NodePool{})
+		if created := err == nil; created != (owner == name) {
+			t.Errorf("namespace %s: default nodepool created %t, err %v", name, created, err)
+		} else if err != nil && !errors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		pool, err := GetNamespacePool(ctx, c, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pool.Namespace != owner {
+			t.Errorf("namespace %s resolves to the nodepool of %s, want %s", name, pool.Namespace, owner)
+		}
+	}
+
+	namespaces, err := PoolNamespaces(ctx, c, getTestPool(t, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(namespaces) != fmt.Sprint([]string{testNamespace, "tenant-ci", "tenant-ci-x"}) {
+		t.Fatalf("nodepool of %s is used by namespaces %v", testNamespace, namespaces)
+	}
+}
+
+func TestListPoolPodsOnNode(t *testing.T) {
+	child := testPod("job", "node-a")
+	child.Namespace = "tenant-ci"
+	other := testPod("web", "node-a")
+	other.Namespace = "other"
+	c := newTestClient(t,
+		testChildNamespace("tenant-ci", testNamespace),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+		testPod("web", "node-a"), testPod("api", "node-b"), child, other,
+	)
+
+	pods, err := ListPoolPodsOnNode(context.Background(), c, getTestPool(t, c), "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(pods))
+	for i := range pods {
+		got = append(got, pods[i].Namespace+"/"+pods[i].Name)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint([]string{"tenant-ci/job", "tenant/web"}) {
+		t.Fatalf("pods of the nodepool on node-a: %v", got)
+	}
+}
+
+func TestNamespaceGainsParent(t *testing.T) {
+	// namespace先创建了自己的nodepool，之后才被挂到父namespace下
+	child := testChildNamespace("tenant-ci", testNamespace)
+	c := newTestClient(t, child, GenerateNodePoolObj(DefaultNodePoolName, child.Name))
+	recorder := record.NewFakeRecorder(100)
+	r := &NamespaceReconciler{Client: c, Scheme: c.Scheme(), Recorder: recorder}
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: child.Name, Name: DefaultNodePoolName}
+	reconcile := func() *poolv1.NodePool {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: child.Name}}); err != nil {
+			t.Fatal(err)
+		}
+		pool := &poolv1.NodePool{}
+		if err := c.Get(ctx, key, pool); err != nil {
+			t.Fatalf("redundant nodepool of %s deleted: %v", child.Name, err)
+		}
+		return pool
+	}
+
+	pool, err := GetNamespacePool(ctx, c, child.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.Namespace != testNamespace {
+		t.Fatalf("namespace with a parent resolves to the nodepool of %s", pool.Namespace)
+	}
+
+	// 多余的nodepool只报告，不删除
+	redundant := reconcile()
+	if !meta.IsStatusConditionTrue(redundant.Status.Conditions, poolv1.ConditionRedundant) || redundant.DeletionTimestamp != nil {
+		t.Fatalf("redundant nodepool of %s not reported: %+v", child.Name, redundant.Status.Conditions)
+	}
+	reconcile()
+	if events := drainEvents(recorder); len(events) != 1 || !strings.Contains(events[0], "RedundantNodePool") {
+		t.Fatalf("events %v, want a single RedundantNodePool event", events)
+	}
+	if namespaces, err := PoolNamespaces(ctx, c, redundant); err != nil || len(namespaces) != 0 {
+		t.Fatalf("namespaces %v pinned to the redundant nodepool: %v", namespaces, err)
+	}
+
+	// 不再继承后恢复
+	ns := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: child.Name}, ns); err != nil {
+		t.Fatal(err)
+	}
+	ns.Annotations = map[string]string{AnnotationInherit: "false"}
+	if err := c.Update(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	if pool := reconcile(); meta.IsStatusConditionTrue(pool.Status.Conditions, poolv1.ConditionRedundant) {
+		t.Fatalf("nodepool of %s still redundant: %+v", child.Name, pool.Status.Conditions)
+	}
+}
+
+func TestNamespaceParentUntrusted(t *testing.T) {
+	// 只信任HNC维护的depth=1的tree label
+	forged := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "intruder",
+		Labels: map[string]string{"nodepool.sunkai.xyz/parent": testNamespace, HNCTreeLabel(testNamespace): "2"},
+	}}
+	if parent := NamespaceParent(forged); parent != "" {
+		t.Fatalf("namespace %s inherits from %s", forged.Name, parent)
+	}
+	// 例外namespace不能作为父namespace
+	defer func(ns []string) { ExceptionNs = ns }(ExceptionNs)
+	ExceptionNs = []string{"kube-system"}
+	system := testChildNamespace("system-child", "kube-system")
+	if parent := NamespaceParent(system); parent != "" {
+		t.Fatalf("namespace %s inherits from %s", system.Name, parent)
+	}
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+)
+
+// departedNodes gets the nodes listed in the status of the nodepool which are not in members,
+// nil for the deleted ones.
+func (r *NodePoolReconciler) departedNodes(ctx context.Context, pool *poolv1.NodePool, members []string) (map[string]*corev1.Node, error) {
+	is := make(map[string]bool, len(members))
+	for _, name := range members {
+		is[name] = true
+	}
+
+	departed := make(map[string]*corev1.Node)
+	for _, name := range pool.Status.Nodes {
+		if is[name] {
+			continue
+		}
+		node := &corev1.Node{}
+		err := r.Get(ctx, types.NamespacedName{Name: name}, node)
+		if errors.IsNotFound(err) {
+			departed[name] = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		departed[name] = node
+	}
+	return departed, nil
+}
+
+// recordMembership appends the nodes joining and leaving the nodepool to its history.
+// The transitions are taken from the change of status.nodes, which only NodePoolReconciler writes,
+// so the history matches the membership even when reconciles of nodes and nodepools interleave.
+func recordMembership(pool *poolv1.NodePool, nodes []string, nodeList *corev1.NodeList, departed map[string]*corev1.Node) {
+	now := metav1.Now()
+	was := make(map[string]bool, len(pool.Status.Nodes))
+	for _, name := range pool.Status.Nodes {
+		was[name] = true
+	}
+	is := make(map[string]bool, len(nodes))
+	for _, name := range nodes {
+		is[name] = true
+	}
+
+	var events []poolv1.MembershipEvent
+	for _, name := range pool.Status.Nodes {
+		if is[name] {
+			continue
+		}
+		event := poolv1.MembershipEvent{Node: name, Type: poolv1.MembershipLeft, Time: now, Reason: poolv1.MembershipReasonLabelChanged}
+		node, found := departed[name]
+		switch {
+		case found && node == nil:
+			event.Reason = poolv1.MembershipReasonNodeDeleted
+		case findNodeRelease(pool, name) != nil:
+			// 驱逐完成后离开的node
+			event.Reason = poolv1.MembershipReasonDrained
+		}
+		if node != nil {
+			event.Actor = labelManager(node)
+		}
+		events = append(events, event)
+	}
+	for _, name := range nodes {
+		if was[name] {
+			continue
+		}
+		event := poolv1.MembershipEvent{Node: name, Type: poolv1.MembershipJoined, Time: now, Reason: poolv1.MembershipReasonLabelChanged}
+		for i := range nodeList.Items {
+			if nodeList.Items[i].Name == name {
+				event.Actor = labelManager(&nodeList.Items[i])
+			}
+		}
+		events = append(events, event)
+	}
+	pool.Status.History = appendHistory(pool.Status.History, events...)
+}
+
+// appendHistory appends the events and drops the oldest entries beyond MaxHistory
+func appendHistory(history []poolv1.MembershipEvent, events ...poolv1.MembershipEvent) []poolv1.MembershipEvent {
+	history = append(history, events...)
+	if len(history) > poolv1.MaxHistory {
+		history = append([]poolv1.MembershipEvent(nil), history[len(history)-poolv1.MaxHistory:]...)
+	}
+	return history
+}
+
+// labelManager returns the field manager owning the nodepool label of the node, the one which last set it.
+// A removed label has no owner left, the result is empty.
+func labelManager(node *corev1.Node) string {
+	manager := ""
+	var latest *metav1.Time
+	for _, entry := range node.ManagedFields {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		fields := map[string]map[string]map[string]interface{}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields["f:metadata"]["f:labels"]["f:"+LableNodePoolKey]; !ok {
+			continue
+		}
+		// apply和update可能同时拥有该字段，取最近的一个
+		if manager == "" || entry.Time != nil && (latest == nil || latest.Before(entry.Time)) {
+			manager = entry.Manager
+			latest = entry.Time
+		}
+	}
+	return manager
+}
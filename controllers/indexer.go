@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PodNodeNameField indexes pods by the node they are bound to
+	PodNodeNameField = "spec.nodeName"
+	// NodePoolValueField indexes nodes by the nodepool value they belong to, see NodePoolValue
+	NodePoolValueField = "nodepool"
+	// PoolSelectorField indexes nodepools by the nodepool label value they select
+	PoolSelectorField = "spec.nodeSelector.nodepool"
+	// PoolNodesField indexes nodepools by their member nodes
+	PoolNodesField = "status.nodes"
+	// NamespaceParentField indexes namespaces by the parent they inherit their nodepool from, see NamespaceParent
+	NamespaceParentField = "nodepool.parent"
+)
+
+// fieldIndex is a cache index shared by the reconcilers
+type fieldIndex struct {
+	obj     client.Object
+	field   string
+	extract client.IndexerFunc
+}
+
+var fieldIndexes = []fieldIndex{
+	{&corev1.Pod{}, PodNodeNameField, func(obj client.Object) []string {
+		pod := obj.(*corev1.Pod)
+		if pod.Spec.NodeName == "" {
+			return nil
+		}
+		return []string{pod.Spec.NodeName}
+	}},
+	{&corev1.Node{}, NodePoolValueField, func(obj client.Object) []string {
+		value, ok := NodePoolValue(obj.(*corev1.Node))
+		if !ok || value == "" {
+			return nil
+		}
+		return []string{value}
+	}},
+	{&poolv1.NodePool{}, PoolSelectorField, func(obj client.Object) []string {
+		value := PoolSelectorValue(obj.(*poolv1.NodePool))
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	}},
+	{&poolv1.NodePool{}, PoolNodesField, func(obj client.Object) []string {
+		return obj.(*poolv1.NodePool).Status.Nodes
+	}},
+	{&corev1.Namespace{}, NamespaceParentField, func(obj client.Object) []string {
+		parent := NamespaceParent(obj.(*corev1.Namespace))
+		if parent == "" {
+			return nil
+		}
+		return []string{parent}
+	}},
+}
+
+// SetupFieldIndexes registers the cache indexes shared by the reconcilers
+func SetupFieldIndexes(mgr ctrl.Manager) error {
+	indexer := mgr.GetFieldIndexer()
+	for _, index := range fieldIndexes {
+		if err := indexer.IndexField(context.Background(), index.obj, index.field, index.extract); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	nodesv1 "nodepool/api/v1"
+	"nodepool/apiserver/webhook"
+	"nodepool/controllers"
+)
+
+const (
+	timeout  = 20 * time.Second
+	interval = 250 * time.Millisecond
+)
+
+// createNamespace creates a namespace and its default service account, which no controller-manager creates in envtest
+func createNamespace(ctx context.Context, name string) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: name, Name: "default"}}
+	err := k8sClient.Create(ctx, sa)
+	if !errors.IsAlreadyExists(err) {
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+func defaultPoolKey(ns string) types.NamespacedName {
+	return types.NamespacedName{Namespace: ns, Name: controllers.DefaultNodePoolName}
+}
+
+func getPool(ctx context.Context, key types.NamespacedName) func() (*nodesv1.NodePool, error) {
+	return func() (*nodesv1.NodePool, error) {
+		pool := &nodesv1.NodePool{}
+		err := k8sClient.Get(ctx, key, pool)
+		return pool, err
+	}
+}
+
+func poolNodes(ctx context.Context, key types.NamespacedName) func() []string {
+	return func() []string {
+		pool, err := getPool(ctx, key)()
+		if err != nil {
+			return nil
+		}
+		return pool.Status.Nodes
+	}
+}
+
+func poolHistory(ctx context.Context, key types.NamespacedName) func() []string {
+	return func() []string {
+		pool, err := getPool(ctx, key)()
+		if err != nil {
+			return nil
+		}
+		events := make([]string, 0, len(pool.Status.History))
+		for _, event := range pool.Status.History {
+			events = append(events, fmt.Sprintf("%s %s %s", event.Node, event.Type, event.Reason))
+		}
+		return events
+	}
+}
+
+func createNode(ctx context.Context, name, pool string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{controllers.LableNodePoolKey: pool},
+	}}
+	Expect(k8sClient.Create(ctx, node)).To(Succeed())
+	return node
+}
+
+var _ = Describe("NodePool", func() {
+	ctx := context.Background()
+
+	Context("when a namespace is created", func() {
+		It("creates the default nodepool selecting the namespace's nodes", func() {
+			createNamespace(ctx, "tenant-create")
+
+			Eventually(getPool(ctx, defaultPoolKey("tenant-create")), timeout, interval).Should(
+				WithTransform(func(pool *nodesv1.NodePool) map[string]string { return pool.Spec.NodeSelector },
+					Equal(map[string]string{controllers.LableNodePoolKey: "tenant-create"})))
+			pool, err := getPool(ctx, defaultPoolKey("tenant-create"))()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pool.Finalizers).To(ContainElement(controllers.NodePoolFinalizer))
+		})
+
+		It("recreates a deleted default nodepool", func() {
+			createNamespace(ctx, "tenant-recreate")
+			key := defaultPoolKey("tenant-recreate")
+			Eventually(getPool(ctx, key), timeout, interval).ShouldNot(BeNil())
+			pool, err := getPool(ctx, key)()
+			Expect(err).NotTo(HaveOccurred())
+			uid := pool.UID
+
+			Expect(k8sClient.Delete(ctx, pool)).To(Succeed())
+			Eventually(func() types.UID {
+				pool, err := getPool(ctx, key)()
+				if err != nil {
+					return ""
+				}
+				return pool.UID
+			}, timeout, interval).ShouldNot(Or(BeEmpty(), Equal(uid)))
+		})
+	})
+
+	Context("when the node selector of the default nodepool is changed", func() {
+		It("reverts the node selector", func() {
+			createNamespace(ctx, "tenant-revert")
+			key := defaultPoolKey("tenant-revert")
+			Eventually(func() error {
+				_, err := getPool(ctx, key)()
+				return err
+			}, timeout, interval).Should(Succeed())
+
+			Eventually(func() error {
+				pool, err := getPool(ctx, key)()
+				if err != nil {
+					return err
+				}
+				pool.Spec.NodeSelector = map[string]string{controllers.LableNodePoolKey: "somewhere-else"}
+				return k8sClient.Update(ctx, pool)
+			}, timeout, interval).Should(Succeed())
+
+			Eventually(func() map[string]string {
+				pool, err := getPool(ctx, key)()
+				if err != nil {
+					return nil
+				}
+				return pool.Spec.NodeSelector
+			}, timeout, interval).Should(Equal(map[string]string{controllers.LableNodePoolKey: "tenant-revert"}))
+		})
+	})
+
+	Context("in an exception namespace", func() {
+		It("deletes nodepools", func() {
+			createNamespace(ctx, exceptionNs)
+			pool := &nodesv1.NodePool{
+				ObjectMeta: metav1.ObjectMeta{Namespace: exceptionNs, Name: controllers.DefaultNodePoolName},
+				Spec: nodesv1.NodePoolSpec{
+					NodeSelector: map[string]string{controllers.LableNodePoolKey: exceptionNs},
+				},
+			}
+			Expect(k8sClient.Create(ctx, pool)).To(Succeed())
+
+			Eventually(func() bool {
+				_, err := getPool(ctx, defaultPoolKey(exceptionNs))()
+				return errors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("when nodes join and leave", func() {
+		It("keeps the member nodes in the status", func() {
+			createNamespace(ctx, "tenant-a")
+			createNamespace(ctx, "tenant-b")
+			keyA, keyB := defaultPoolKey("tenant-a"), defaultPoolKey("tenant-b")
+
+			node := createNode(ctx, "node-join", "tenant-a")
+			Eventually(poolNodes(ctx, keyA), timeout, interval).Should(ConsistOf("node-join"))
+
+			By("moving the node to another nodepool")
+			patch := client.MergeFrom(node.DeepCopy())
+			node.Labels[controllers.LableNodePoolKey] = "tenant-b"
+			Expect(k8sClient.Patch(ctx, node, patch)).To(Succeed())
+			Eventually(poolNodes(ctx, keyA), timeout, interval).Should(BeEmpty())
+			Eventually(poolNodes(ctx, keyB), timeout, interval).Should(ConsistOf("node-join"))
+
+			By("deleting the node")
+			Expect(k8sClient.Delete(ctx, node)).To(Succeed())
+			Eventually(poolNodes(ctx, keyB), timeout, interval).Should(BeEmpty())
+
+			By("recording the transitions in the history")
+			Expect(poolHistory(ctx, keyA)()).To(Equal([]string{"node-join Joined LabelChanged", "node-join Left LabelChanged"}))
+			Expect(poolHistory(ctx, keyB)()).To(Equal([]string{"node-join Joined LabelChanged", "node-join Left NodeDeleted"}))
+		})
+	})
+})
+
+var _ = Describe("Webhook", func() {
+	ctx := context.Background()
+
+	It("pins created pods to the default nodepool", func() {
+		createNamespace(ctx, "tenant-pods")
+		Eventually(func() error {
+			_, err := getPool(ctx, defaultPoolKey("tenant-pods"))()
+			return err
+		}, timeout, interval).Should(Succeed())
+
+		automount := false
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-pods", Name: "web"},
+			Spec: corev1.PodSpec{
+				AutomountServiceAccountToken: &automount,
+				Containers:                   []corev1.Container{{Name: "web", Image: "nginx"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		created := &corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), created)).To(Succeed())
+		Expect(created.Spec.NodeSelector).To(HaveKeyWithValue(controllers.LableNodePoolKey, "tenant-pods"))
+		Expect(created.Labels).To(HaveKeyWithValue(webhook.PoolLabelKey, "tenant-pods"))
+		Expect(created.Annotations).To(HaveKey(webhook.AssignedByAnnotationKey))
+	})
+
+	It("pins pods of child namespaces to the nodepool of their parent", func() {
+		createNamespace(ctx, "tenant-parent")
+		Eventually(func() error {
+			_, err := getPool(ctx, defaultPoolKey("tenant-parent"))()
+			return err
+		}, timeout, interval).Should(Succeed())
+
+		child := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "tenant-child",
+			Labels: map[string]string{controllers.HNCTreeLabel("tenant-parent"): "1"},
+		}}
+		Expect(k8sClient.Create(ctx, child)).To(Succeed())
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: child.Name, Name: "default"}}
+		if err := k8sClient.Create(ctx, sa); !errors.IsAlreadyExists(err) {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Consistently(func() bool {
+			_, err := getPool(ctx, defaultPoolKey(child.Name))()
+			return errors.IsNotFound(err)
+		}, 2*time.Second, interval).Should(BeTrue())
+
+		automount := false
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: child.Name, Name: "web"},
+			Spec: corev1.PodSpec{
+				AutomountServiceAccountToken: &automount,
+				Containers:                   []corev1.Container{{Name: "web", Image: "nginx"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		created := &corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), created)).To(Succeed())
+		Expect(created.Spec.NodeSelector).To(HaveKeyWithValue(controllers.LableNodePoolKey, "tenant-parent"))
+	})
+
+	It("leaves pods of exception namespaces alone", func() {
+		automount := false
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "system"},
+			Spec: corev1.PodSpec{
+				AutomountServiceAccountToken: &automount,
+				Containers:                   []corev1.Container{{Name: "system", Image: "pause"}},
+			},
+		}
+		sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "default"}}
+		if err := k8sClient.Create(ctx, sa); !errors.IsAlreadyExists(err) {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		created := &corev1.Pod{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), created)).To(Succeed())
+		Expect(created.Spec.NodeSelector).NotTo(HaveKey(controllers.LableNodePoolKey))
+	})
+})
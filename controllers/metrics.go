@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	// orphanedNodes counts nodes carrying a nodepool label that no nodepool selects
+	orphanedNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nodepool_orphaned_nodes",
+		Help: "Number of nodes labelled with a nodepool that does not exist",
+	})
+	// ruleConflicts counts nodes matched by rules assigning them to different nodepools
+	ruleConflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nodepool_rule_conflicts",
+		Help: "Number of nodes matched by node rules assigning them to different nodepools",
+	})
+	// ruleUnmatchedNodes counts nodes matched by no rule
+	ruleUnmatchedNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "nodepool_rule_unmatched_nodes",
+		Help: "Number of nodes matched by no node rule",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedNodes, ruleConflicts, ruleUnmatchedNodes)
+}
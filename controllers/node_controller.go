@@ -19,11 +19,15 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sync"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	poolv1 "nodepool/api/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -31,104 +35,100 @@ import (
 // NodePoolReconciler reconciles a NodePool object
 type NodeReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
+	KubeClient kubernetes.Interface
+
+	// orphans, nodes already reported as orphaned
+	orphans   map[string]bool
+	orphansMu sync.Mutex
 }
 
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods/eviction,verbs=create
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 // Reconcile, node发生变动。增、删、改
+// Membership of the nodepools is kept by NodePoolReconciler, the node reconciler drains released nodes,
+// removes the unassigned taint and reports orphaned nodes.
 func (r *NodeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
-	nodeExist := true
 	node := corev1.Node{}
 	err := r.Get(ctx, req.NamespacedName, &node)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			// node被删除，nodepool通过watch更新
 			l.Info(fmt.Sprintf("node:%v not exist", req))
-			nodeExist = false
-		} else {
-			l.Error(err, fmt.Sprintf("error on getting node:%v", req))
-			return ctrl.Result{}, err
+			r.reportOrphanedNode(ctx, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: req.Name}}, true)
+			return ctrl.Result{}, nil
 		}
+		l.Error(err, fmt.Sprintf("error on getting node:%v", req))
+		return ctrl.Result{}, err
 	}
 
-	poolList := poolv1.NodePoolList{}
-	err = r.List(ctx, &poolList)
+	pools, err := NodeCandidatePools(ctx, r.Client, &node)
 	if err != nil {
-		l.Error(err, fmt.Sprintf("error on getting all nodePool"))
+		l.Error(err, fmt.Sprintf("error on getting nodepools of node:%s", node.Name))
 		return ctrl.Result{}, err
 	}
 
-	// node被删除
-	if !nodeExist {
-		// 找到node所属的nodepool
-		pool := FindNodepoolByNodeName(req.Name, &poolList)
-		if pool == nil {
-			// node没有加入任何nodepool
-			return ctrl.Result{}, nil
+	// node的nodepool标签发生变化时，先驱逐之前nodepool的pod再移交node
+	if DrainOnRelease {
+		result, done, err := r.reconcileRelease(ctx, &node, pools)
+		if err != nil || !done {
+			return result, err
 		}
+	}
 
-		// 删除nodepool中的node
-		pool.Status.Nodes = deleteNodeFromPoolnodes(req.Name, pool.Status.Nodes)
-		err = r.Status().Update(ctx, pool)
+	pool := FindNodepoolByNodeObj(&node, pools)
+	if pool == nil {
+		l.Info(fmt.Sprintf("node: %v not match any nodepool", node.Name))
+	} else if node.Labels[LableNodePoolKey] != FreePool {
+		// node重新分配给nodepool后删除污点
+		err = r.removeUnassignedTaint(ctx, &node)
 		if err != nil {
-			l.Error(err, fmt.Sprintf("failed to delete node from nodepool:%v", pool))
+			l.Error(err, fmt.Sprintf("failed to remove taint %s from node:%s", TaintUnassigned, node.Name))
 			return ctrl.Result{}, err
 		}
-		return ctrl.Result{}, nil
 	}
 
-	// node增加、修改
-	found := false
-	pool := FindNodepoolByNodeObj(&node, &poolList)
-	if pool == nil {
-		l.Info(fmt.Sprintf("node: %v not match any nodepool", node.Name))
-	}
+	r.reportOrphanedNode(ctx, &node, pool == nil)
+	return ctrl.Result{}, nil
+}
 
-	if found {
-		needUpdate := false
-		needUpdate, pool.Status.Nodes = AddNodeUnique(pool.Status.Nodes, node.Name)
-		if needUpdate {
-			err = r.Status().Update(ctx, pool)
-			if err != nil {
-				l.Error(err, fmt.Sprintf("failed to add node: %v to nodepool:%v/%v",
-					node.Name, pool.Namespace, pool.Name))
-				return ctrl.Result{}, err
-			}
-			l.Info(fmt.Sprintf("add node: %v to nodepool: %v/%v",
-				node.Name, pool.Namespace, pool.Name))
-		}
-		return ctrl.Result{}, nil
-	}
+// reportOrphanedNode reports a node labelled with a nodepool value no nodepool selects
+func (r *NodeReconciler) reportOrphanedNode(ctx context.Context, node *corev1.Node, unmatched bool) {
+	l := log.FromContext(ctx)
 
-	// 不知道node属于哪个nodepool，比如node的lables被移除
-	nodeList := corev1.NodeList{}
-	err = r.List(ctx, &nodeList)
-	if err != nil {
-		l.Error(err, fmt.Sprintf("error on getting all node"))
-		return ctrl.Result{}, err
+	r.orphansMu.Lock()
+	defer r.orphansMu.Unlock()
+	if r.orphans == nil {
+		r.orphans = make(map[string]bool)
 	}
 
-	for _, pool := range poolList.Items {
-		neeedUpdate, nodes := FindMatchNodesByNodepool(&nodeList, &pool)
-		if neeedUpdate {
-			pool.Status.Nodes = nodes
-			err = r.Status().Update(ctx, &pool)
-			if err != nil {
-				l.Error(err, fmt.Sprintf("failed to add node to nodepool:%v", pool))
-				return ctrl.Result{}, err
-			}
-			l.Info(fmt.Sprintf("update nodepool:%s/%s, nodes: %v", pool.Namespace, pool.Name, nodes))
-		}
+	value, ok := NodePoolValue(node)
+	if !unmatched || !ok || value == "" || value == FreePool {
+		delete(r.orphans, node.Name)
+		orphanedNodes.Set(float64(len(r.orphans)))
+		return
 	}
-	return ctrl.Result{}, nil
+	if !r.orphans[node.Name] {
+		r.orphans[node.Name] = true
+		r.Recorder.Eventf(node, corev1.EventTypeWarning, "OrphanedNode",
+			"node is labelled %s=%s but no nodepool selects it", LableNodePoolKey, value)
+		l.Info(fmt.Sprintf("node:%s is orphaned, no nodepool selects %s=%s", node.Name, LableNodePoolKey, value))
+	}
+	orphanedNodes.Set(float64(len(r.orphans)))
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *NodeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Node{}).
+		For(&corev1.Node{}, builder.WithPredicates(nodeMembershipChanged)).
 		Complete(r)
 }
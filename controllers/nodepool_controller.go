@@ -21,11 +21,19 @@ import (
 	"fmt"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"reflect"
+	"sort"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	poolv1 "nodepool/api/v1"
 )
@@ -33,12 +41,16 @@ import (
 // NodePoolReconciler reconciles a NodePool object
 type NodePoolReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -66,6 +78,11 @@ func (r *NodePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
+	// nodepool被删除时释放其中的node
+	if exist && !pool.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, &pool)
+	}
+
 	// 判断ns是否需要创建nodepool
 	if InclusionExceptionNs(req.Namespace) {
 		// 不需要创建nodepool，但是nodepool已经存在了就删除掉
@@ -82,6 +99,30 @@ func (r *NodePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	if !exist {
 		// 默认的nodepool被删除时自动创建
 		if req.Name == DefaultNodePoolName {
+			// namespace正在删除时不再创建
+			ns := corev1.Namespace{}
+			err = r.Get(ctx, types.NamespacedName{Name: req.Namespace}, &ns)
+			if err != nil {
+				if errors.IsNotFound(err) {
+					return ctrl.Result{}, nil
+				}
+				l.Error(err, fmt.Sprintf("error on getting namespace:%s", req.Namespace))
+				return ctrl.Result{}, err
+			}
+			if !ns.DeletionTimestamp.IsZero() {
+				return ctrl.Result{}, nil
+			}
+			// 继承祖先nodepool的namespace删除自己的nodepool后不再创建
+			owner, err := PoolNamespace(ctx, r.Client, req.Namespace)
+			if err != nil {
+				l.Error(err, fmt.Sprintf("error on resolving the nodepool of namespace:%s", req.Namespace))
+				return ctrl.Result{}, err
+			}
+			if owner != req.Namespace {
+				l.Info(fmt.Sprintf("namespace:%s inherits the nodepool of namespace:%s", req.Namespace, owner))
+				return ctrl.Result{}, nil
+			}
+
 			pool := GenerateNodePoolObj(DefaultNodePoolName, req.Namespace)
 			err = r.Create(ctx, pool)
 			if err != nil {
@@ -89,6 +130,8 @@ func (r *NodePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 				return ctrl.Result{}, err
 			}
 			l.Info(fmt.Sprintf("default nodepool: %s/%s not exist and created", pool.Namespace, pool.Name))
+			// 新建的nodepool会再次触发调谐
+			return ctrl.Result{}, nil
 		} else {
 			// 非默认的nodepool被删除无需处理
 			l.Info(fmt.Sprintf("nodepool: %s/%s not exist", pool.Namespace, pool.Name))
@@ -97,8 +140,16 @@ func (r *NodePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	} else {
 		// nodepool 更新时恢复其spec中的默认字段
 		genPool := GenerateNodePoolObj(DefaultNodePoolName, pool.Namespace)
+		needUpdate := false
 		if !reflect.DeepEqual(pool.Spec.NodeSelector, genPool.Spec.NodeSelector) {
 			pool.Spec.NodeSelector = genPool.Spec.NodeSelector
+			needUpdate = true
+		}
+		if !controllerutil.ContainsFinalizer(&pool, NodePoolFinalizer) {
+			controllerutil.AddFinalizer(&pool, NodePoolFinalizer)
+			needUpdate = true
+		}
+		if needUpdate {
 			err = r.Update(ctx, &pool)
 			if err != nil {
 				l.Error(err, "error on update nodepool")
@@ -108,21 +159,62 @@ func (r *NodePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
+	// 只获取属于该nodepool的node
 	nodeList := corev1.NodeList{}
-	err = r.List(ctx, &nodeList)
+	err = r.List(ctx, &nodeList, client.MatchingFields{NodePoolValueField: PoolSelectorValue(&pool)})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on getting nodes of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+
+	_, nodes := FindMatchNodesByNodepool(&nodeList, &pool)
+
+	// 标签变化离开nodepool的node先驱逐pod
+	releasing, err := r.releaseDepartedNodes(ctx, &pool, nodes)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to release nodes of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+	if len(releasing) > 0 {
+		nodes = append(nodes, releasing...)
+		sort.Strings(nodes)
+	}
+
+	// 离开nodepool的node，记录history用
+	departed, err := r.departedNodes(ctx, &pool, nodes)
 	if err != nil {
-		l.Error(err, fmt.Sprintf("error on getting all nodes"))
+		l.Error(err, fmt.Sprintf("error on getting departed nodes of nodepool:%s/%s", pool.Namespace, pool.Name))
 		return ctrl.Result{}, err
 	}
 
-	needUpdate, nodes := FindMatchNodesByNodepool(&nodeList, &pool)
-	if needUpdate {
+	err = PatchPoolStatus(ctx, r.Client, &pool, FieldOwnerNodePool, func(pool *poolv1.NodePool) {
+		recordMembership(pool, nodes, &nodeList, departed)
 		pool.Status.Nodes = nodes
-		err = r.Status().Update(ctx, &pool)
-		if err != nil {
-			l.Error(err, fmt.Sprintf("failed to add node to nodepool:%v", pool))
-			return ctrl.Result{}, err
+		pool.Status.Releasing = pruneNodeReleases(pool.Status.Releasing, &nodeList, nodes)
+		for _, name := range releasing {
+			if findNodeRelease(pool, name) == nil {
+				pool.Status.Releasing = append(pool.Status.Releasing, poolv1.NodeRelease{
+					Node:      name,
+					Phase:     poolv1.ReleasePhaseDraining,
+					StartTime: metav1.Now(),
+					Message:   "node cordoned",
+				})
+			}
 		}
+		pool.Status.MaxNodeAllocatable = MaxAllocatable(&nodeList, nodes)
+		pool.Status.Allocatable = SumAllocatable(&nodeList, nodes)
+		pool.Status.Zones, pool.Status.Regions = TopologyCounts(&nodeList, nodes)
+		setTopologyCondition(pool)
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to update status of nodepool:%s/%s", pool.Namespace, pool.Name))
+		return ctrl.Result{}, err
+	}
+
+	// 根据nodepool的容量维护ns的ResourceQuota和LimitRange
+	err = r.reconcileQuota(ctx, &pool)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
 	return ctrl.Result{}, nil
 }
@@ -131,5 +223,14 @@ func (r *NodePoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 func (r *NodePoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&poolv1.NodePool{}).
+		Watches(&source.Kind{Type: &corev1.Node{}},
+			handler.EnqueueRequestsFromMapFunc(NodeToPools(mgr.GetClient())),
+			builder.WithPredicates(nodeMembershipChanged)).
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(NamespaceToPools(mgr.GetClient()))).
+		Owns(&corev1.ResourceQuota{}).
+		Owns(&corev1.LimitRange{}).
+		Watches(&source.Kind{Type: &corev1.ResourceQuota{}}, handler.EnqueueRequestsFromMapFunc(QuotaToPool)).
+		Watches(&source.Kind{Type: &corev1.LimitRange{}}, handler.EnqueueRequestsFromMapFunc(QuotaToPool)).
 		Complete(r)
 }
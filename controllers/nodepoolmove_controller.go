@@ -0,0 +1,394 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	poolv1 "nodepool/api/v1"
+)
+
+const (
+	// AnnotationMove marks a node as being moved by the named NodePoolMove
+	AnnotationMove = "nodepool.sunkai.xyz/move"
+	// AnnotationMovedBy records the NodePoolMove which relabelled the node, the node rules leave it alone
+	AnnotationMovedBy = "nodepool.sunkai.xyz/moved-by"
+
+	// NodePoolMoveFinalizer uncordons the nodes and removes their move annotation before the move is removed
+	NodePoolMoveFinalizer = "nodes.sunkai.xyz/restore-nodes"
+)
+
+// moveRetryInterval is how often the progress of a move is checked
+const moveRetryInterval = 10 * time.Second
+
+// NodePoolMoveReconciler reconciles a NodePoolMove object
+type NodePoolMoveReconciler struct {
+	client.Client
+	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
+	KubeClient kubernetes.Interface
+}
+
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepoolmoves,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepoolmoves/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepoolmoves/finalizers,verbs=update
+//+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods/eviction,verbs=create
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile, 按阶段推进node在nodepool之间的迁移
+func (r *NodePoolMoveReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	move := poolv1.NodePoolMove{}
+	err := r.Get(ctx, req.NamespacedName, &move)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		l.Error(err, fmt.Sprintf("error on getting nodepoolmove:%v", req))
+		return ctrl.Result{}, err
+	}
+
+	if !move.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, r.finalize(ctx, &move)
+	}
+	terminal := move.Status.Phase == poolv1.MovePhaseCompleted || move.Status.Phase == poolv1.MovePhaseFailed
+	if !terminal && !controllerutil.ContainsFinalizer(&move, NodePoolMoveFinalizer) {
+		controllerutil.AddFinalizer(&move, NodePoolMoveFinalizer)
+		if err = r.Update(ctx, &move); err != nil {
+			l.Error(err, fmt.Sprintf("failed to add finalizer to nodepoolmove:%s", move.Name))
+			return ctrl.Result{}, err
+		}
+	}
+
+	switch move.Status.Phase {
+	case "":
+		return ctrl.Result{Requeue: true}, r.setPhase(ctx, &move, poolv1.MovePhasePending, "move accepted")
+	case poolv1.MovePhasePending:
+		return r.validate(ctx, &move)
+	case poolv1.MovePhaseDraining:
+		return r.drain(ctx, &move)
+	case poolv1.MovePhaseRelabelling:
+		return r.relabel(ctx, &move)
+	default:
+		// Completed和Failed是终态
+		return ctrl.Result{}, nil
+	}
+}
+
+// validate checks the source and target nodepools can give and take the nodes, then cordons the nodes
+func (r *NodePoolMoveReconciler) validate(ctx context.Context, move *poolv1.NodePoolMove) (ctrl.Result, error) {
+	source, err := GetNodePool(ctx, r.Client, move.Spec.Source)
+	if err != nil {
+		return r.failOnNotFound(ctx, move, err, "source nodepool")
+	}
+	target, err := GetNodePool(ctx, r.Client, move.Spec.Target)
+	if err != nil {
+		return r.failOnNotFound(ctx, move, err, "target nodepool")
+	}
+	if PoolSelectorValue(source) == PoolSelectorValue(target) {
+		return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed, "source and target select the same nodes")
+	}
+
+	nodes := make([]*corev1.Node, 0, len(move.Spec.Nodes))
+	for _, name := range move.Spec.Nodes {
+		node := &corev1.Node{}
+		if err = r.Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+			return r.failOnNotFound(ctx, move, err, fmt.Sprintf("node %s", name))
+		}
+		if value, _ := NodePoolValue(node); value != PoolSelectorValue(source) {
+			return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed,
+				fmt.Sprintf("node %s is not a member of nodepool %s/%s", name, source.Namespace, source.Name))
+		}
+		if other, ok := node.Annotations[AnnotationMove]; ok && other != move.Name {
+			return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed,
+				fmt.Sprintf("node %s is already being moved by %s", name, other))
+		}
+		nodes = append(nodes, node)
+	}
+
+	if source.Spec.MinNodes != nil && len(source.Status.Nodes)-len(nodes) < int(*source.Spec.MinNodes) {
+		return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed,
+			fmt.Sprintf("nodepool %s/%s would shrink below its minimum of %d nodes", source.Namespace, source.Name, *source.Spec.MinNodes))
+	}
+	if target.Spec.MaxNodes != nil && len(target.Status.Nodes)+len(nodes) > int(*target.Spec.MaxNodes) {
+		return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed,
+			fmt.Sprintf("nodepool %s/%s would grow above its maximum of %d nodes", target.Namespace, target.Name, *target.Spec.MaxNodes))
+	}
+
+	for _, node := range nodes {
+		patch := client.MergeFrom(node.DeepCopy())
+		if node.Annotations == nil {
+			node.Annotations = make(map[string]string)
+		}
+		node.Annotations[AnnotationMove] = move.Name
+		if !node.Spec.Unschedulable {
+			node.Spec.Unschedulable = true
+			node.Annotations[AnnotationCordoned] = "true"
+		}
+		if err = r.Patch(ctx, node, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{Requeue: true}, r.setPhase(ctx, move, poolv1.MovePhaseDraining,
+		fmt.Sprintf("%d node(s) cordoned", len(nodes)))
+}
+
+// drain evicts the pods of the namespaces pinned to the source nodepool from the moved nodes
+func (r *NodePoolMoveReconciler) drain(ctx context.Context, move *poolv1.NodePoolMove) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	source, err := GetNodePool(ctx, r.Client, move.Spec.Source)
+	if err != nil {
+		return r.failOnNotFound(ctx, move, err, "source nodepool")
+	}
+
+	remaining := 0
+	blocked := 0
+	for _, name := range move.Spec.Nodes {
+		// 包括继承该nodepool的子namespace的pod
+		pods, err := ListPoolPodsOnNode(ctx, r.Client, source, name)
+		if err != nil {
+			l.Error(err, fmt.Sprintf("error on getting pods of node:%s", name))
+			return ctrl.Result{}, err
+		}
+		for i := 0; i < len(pods); i++ {
+			pod := &pods[i]
+			if IsPodTerminated(pod) {
+				continue
+			}
+			nodePod, err := IsNodePod(ctx, r.Client, pod)
+			if err != nil {
+				l.Error(err, fmt.Sprintf("error on getting owner of pod:%s/%s", pod.Namespace, pod.Name))
+				return ctrl.Result{}, err
+			}
+			if nodePod {
+				continue
+			}
+			remaining++
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+			evicted, err := EvictPod(ctx, r.KubeClient, pod)
+			if err != nil {
+				l.Error(err, fmt.Sprintf("failed to evict pod:%s/%s from node:%s", pod.Namespace, pod.Name, name))
+				return ctrl.Result{}, err
+			}
+			if !evicted {
+				blocked++
+			}
+		}
+	}
+
+	if remaining == 0 {
+		return ctrl.Result{Requeue: true}, r.setPhase(ctx, move, poolv1.MovePhaseRelabelling, "all pods evicted")
+	}
+
+	timeout := ReleaseTimeout
+	if move.Spec.DrainTimeout != nil {
+		timeout = move.Spec.DrainTimeout.Duration
+	}
+	if started := phaseStartTime(move, poolv1.MovePhaseDraining); started != nil && time.Since(started.Time) > timeout {
+		if err = r.restoreNodes(ctx, move); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed,
+			fmt.Sprintf("%d pod(s) still running after %v", remaining, timeout))
+	}
+
+	msg := fmt.Sprintf("waiting for %d pod(s) to terminate", remaining)
+	if blocked > 0 {
+		msg = fmt.Sprintf("%s, %d eviction(s) refused by PodDisruptionBudget", msg, blocked)
+	}
+	if move.Status.Message != msg {
+		move.Status.Message = msg
+		if err = r.Status().Update(ctx, move); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: moveRetryInterval}, nil
+}
+
+// relabel points the nodes at the target nodepool and waits for it to pick them up
+func (r *NodePoolMoveReconciler) relabel(ctx context.Context, move *poolv1.NodePoolMove) (ctrl.Result, error) {
+	target, err := GetNodePool(ctx, r.Client, move.Spec.Target)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			if err = r.restoreNodes(ctx, move); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return r.failOnNotFound(ctx, move, err, "target nodepool")
+	}
+
+	for _, name := range move.Spec.Nodes {
+		node := &corev1.Node{}
+		if err = r.Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+			return r.failOnNotFound(ctx, move, err, fmt.Sprintf("node %s", name))
+		}
+		if node.Labels[LableNodePoolKey] == PoolSelectorValue(target) && node.Annotations[AnnotationMovedBy] == move.Name {
+			continue
+		}
+		patch := client.MergeFrom(node.DeepCopy())
+		if node.Labels == nil {
+			node.Labels = make(map[string]string)
+		}
+		if node.Annotations == nil {
+			node.Annotations = make(map[string]string)
+		}
+		node.Labels[LableNodePoolKey] = PoolSelectorValue(target)
+		node.Annotations[AnnotationMovedBy] = move.Name
+		if err = r.Patch(ctx, node, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 等待目标nodepool的status中包含所有node
+	for _, name := range move.Spec.Nodes {
+		if !NodeInPool(name, target) {
+			return ctrl.Result{RequeueAfter: moveRetryInterval}, nil
+		}
+	}
+
+	if err = r.restoreNodes(ctx, move); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseCompleted,
+		fmt.Sprintf("%d node(s) moved to nodepool %s/%s", len(move.Spec.Nodes), target.Namespace, target.Name))
+}
+
+// restoreNodes uncordons the nodes cordoned by the move and removes the move annotation
+func (r *NodePoolMoveReconciler) restoreNodes(ctx context.Context, move *poolv1.NodePoolMove) error {
+	for _, name := range move.Spec.Nodes {
+		node := &corev1.Node{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if node.Annotations[AnnotationMove] != move.Name {
+			continue
+		}
+		patch := client.MergeFrom(node.DeepCopy())
+		delete(node.Annotations, AnnotationMove)
+		if _, ok := node.Annotations[AnnotationCordoned]; ok {
+			node.Spec.Unschedulable = false
+			delete(node.Annotations, AnnotationCordoned)
+		}
+		if err := r.Patch(ctx, node, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalize restores the nodes of a move deleted before it finished and removes the finalizer
+func (r *NodePoolMoveReconciler) finalize(ctx context.Context, move *poolv1.NodePoolMove) error {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(move, NodePoolMoveFinalizer) {
+		return nil
+	}
+	if err := r.restoreNodes(ctx, move); err != nil {
+		l.Error(err, fmt.Sprintf("failed to restore nodes of nodepoolmove:%s", move.Name))
+		return err
+	}
+
+	controllerutil.RemoveFinalizer(move, NodePoolMoveFinalizer)
+	err := r.Update(ctx, move)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to remove finalizer of nodepoolmove:%s", move.Name))
+		return err
+	}
+	return nil
+}
+
+// failOnNotFound fails the move when a referenced object is missing and retries on other errors
+func (r *NodePoolMoveReconciler) failOnNotFound(ctx context.Context, move *poolv1.NodePoolMove, err error, what string) (ctrl.Result, error) {
+	if !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if move.Status.Phase == poolv1.MovePhaseDraining {
+		if err = r.restoreNodes(ctx, move); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, r.setPhase(ctx, move, poolv1.MovePhaseFailed, fmt.Sprintf("%s not found", what))
+}
+
+// setPhase records the phase transition in the status of the move
+func (r *NodePoolMoveReconciler) setPhase(ctx context.Context, move *poolv1.NodePoolMove, phase, msg string) error {
+	l := log.FromContext(ctx)
+
+	move.Status.Phase = phase
+	move.Status.Message = msg
+	move.Status.Transitions = append(move.Status.Transitions, poolv1.NodePoolMoveTransition{
+		Phase:   phase,
+		Time:    metav1.Now(),
+		Message: msg,
+	})
+	err := r.Status().Update(ctx, move)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to update phase of nodepoolmove:%s", move.Name))
+		return err
+	}
+
+	eventType := corev1.EventTypeNormal
+	if phase == poolv1.MovePhaseFailed {
+		eventType = corev1.EventTypeWarning
+	}
+	r.Recorder.Event(move, eventType, phase, msg)
+	l.Info(fmt.Sprintf("nodepoolmove:%s %s: %s", move.Name, phase, msg))
+	return nil
+}
+
+// phaseStartTime returns when the move last entered the phase
+func phaseStartTime(move *poolv1.NodePoolMove, phase string) *metav1.Time {
+	for i := len(move.Status.Transitions) - 1; i >= 0; i-- {
+		if move.Status.Transitions[i].Phase == phase {
+			return &move.Status.Transitions[i].Time
+		}
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NodePoolMoveReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&poolv1.NodePoolMove{}).
+		Complete(r)
+}
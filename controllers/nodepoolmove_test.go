@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const moveTarget = "other"
+
+// newEvictionClient returns a clientset whose evictions call evict with the evicted pod,
+// evict returns the error of the eviction
+func newEvictionClient(evict func(namespace, name string) error) *kubefake.Clientset {
+	kc := kubefake.NewSimpleClientset()
+	kc.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateAction)
+		if create.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		return true, nil, evict(create.GetNamespace(), create.GetObject().(metav1.Object).GetName())
+	})
+	return kc
+}
+
+// evictFrom deletes evicted pods from c, like the eviction API does when no PodDisruptionBudget refuses it
+func evictFrom(c client.Client) func(namespace, name string) error {
+	return func(namespace, name string) error {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		return c.Delete(context.Background(), pod)
+	}
+}
+
+func newMoveReconciler(t *testing.T, objs ...client.Object) *NodePoolMoveReconciler {
+	objs = append(objs,
+		GenerateNodePoolObj(DefaultNodePoolName, moveTarget),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: moveTarget}},
+	)
+	c := newTestClient(t, objs...)
+	return &NodePoolMoveReconciler{
+		Client:     c,
+		Scheme:     c.Scheme(),
+		Recorder:   record.NewFakeRecorder(100),
+		KubeClient: newEvictionClient(evictFrom(c)),
+	}
+}
+
+func testMove(nodes ...string) *poolv1.NodePoolMove {
+	return &poolv1.NodePoolMove{
+		ObjectMeta: metav1.ObjectMeta{Name: "move"},
+		Spec: poolv1.NodePoolMoveSpec{
+			Nodes:  nodes,
+			Source: poolv1.NodePoolReference{Namespace: testNamespace, Name: DefaultNodePoolName},
+			Target: poolv1.NodePoolReference{Namespace: moveTarget, Name: DefaultNodePoolName},
+		},
+	}
+}
+
+// reconcileMove reconciles the move once and returns it afterwards, nil when it is gone
+func reconcileMove(t *testing.T, r *NodePoolMoveReconciler) *poolv1.NodePoolMove {
+	ctx := context.Background()
+	key := types.NamespacedName{Name: "move"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	move := &poolv1.NodePoolMove{}
+	if err := r.Get(ctx, key, move); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	return move
+}
+
+func getTestNode(t *testing.T, c client.Client, name string) *corev1.Node {
+	node := &corev1.Node{}
+	if err := c.Get(context.Background(), types.NamespacedName{Name: name}, node); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// assertRestored fails unless the node is schedulable and no longer marked as moving
+func assertRestored(t *testing.T, c client.Client, name string) {
+	t.Helper()
+	node := getTestNode(t, c, name)
+	if _, ok := node.Annotations[AnnotationMove]; ok || node.Spec.Unschedulable {
+		t.Fatalf("node %s not restored: unschedulable %t, annotations %v", name, node.Spec.Unschedulable, node.Annotations)
+	}
+}
+
+func TestMovePhases(t *testing.T) {
+	r := newMoveReconciler(t, testMove("node-a"),
+		testNode("node-a", testNamespace), testNode("node-b", testNamespace), testPod("web", "node-a"))
+	setPoolNodes(t, r.Client, "node-a", "node-b")
+
+	phases := []string{poolv1.MovePhasePending, poolv1.MovePhaseDraining, poolv1.MovePhaseDraining, poolv1.MovePhaseRelabelling}
+	for _, want := range phases {
+		move := reconcileMove(t, r)
+		if move.Status.Phase != want {
+			t.Fatalf("move in phase %s (%s), want %s", move.Status.Phase, move.Status.Message, want)
+		}
+		if !strings.Contains(strings.Join(move.Finalizers, ","), NodePoolMoveFinalizer) {
+			t.Fatalf("move has no finalizer: %v", move.Finalizers)
+		}
+		if want == poolv1.MovePhaseDraining {
+			if node := getTestNode(t, r.Client, "node-a"); !node.Spec.Unschedulable || node.Annotations[AnnotationMove] != "move" {
+				t.Fatalf("draining node not cordoned: %+v", node)
+			}
+		}
+	}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "web"}, &corev1.Pod{}); !errors.IsNotFound(err) {
+		t.Fatalf("pod of the source nodepool not evicted: %v", err)
+	}
+
+	// 等待目标nodepool接收node
+	if move := reconcileMove(t, r); move.Status.Phase != poolv1.MovePhaseRelabelling {
+		t.Fatalf("move in phase %s before the target picked up the node", move.Status.Phase)
+	}
+	if value, _ := NodePoolValue(getTestNode(t, r.Client, "node-a")); value != moveTarget {
+		t.Fatalf("node relabelled to %q, want %q", value, moveTarget)
+	}
+	target := &poolv1.NodePool{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: moveTarget, Name: DefaultNodePoolName}, target); err != nil {
+		t.Fatal(err)
+	}
+	target.Status.Nodes = []string{"node-a"}
+	if err := r.Status().Update(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+
+	move := reconcileMove(t, r)
+	if move.Status.Phase != poolv1.MovePhaseCompleted {
+		t.Fatalf("move in phase %s (%s), want Completed", move.Status.Phase, move.Status.Message)
+	}
+	assertRestored(t, r.Client, "node-a")
+	var got []string
+	for _, transition := range move.Status.Transitions {
+		got = append(got, transition.Phase)
+	}
+	want := []string{poolv1.MovePhasePending, poolv1.MovePhaseDraining, poolv1.MovePhaseRelabelling, poolv1.MovePhaseCompleted}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("transitions %v, want %v", got, want)
+	}
+}
+
+func TestMoveSizeLimits(t *testing.T) {
+	two, zero := int32(2), int32(0)
+	tests := []struct {
+		name   string
+		source *int32
+		target *int32
+		msg    string
+	}{
+		{name: "source below its minimum", source: &two, msg: "below its minimum"},
+		{name: "target above its maximum", target: &zero, msg: "above its maximum"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newMoveReconciler(t, testMove("node-a"), testNode("node-a", testNamespace), testNode("node-b", testNamespace))
+			ctx := context.Background()
+			setPoolNodes(t, r.Client, "node-a", "node-b")
+			for _, key := range []types.NamespacedName{testPoolKey, {Namespace: moveTarget, Name: DefaultNodePoolName}} {
+				pool := &poolv1.NodePool{}
+				if err := r.Get(ctx, key, pool); err != nil {
+					t.Fatal(err)
+				}
+				pool.Spec.MinNodes, pool.Spec.MaxNodes = tt.source, tt.target
+				if err := r.Update(ctx, pool); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reconcileMove(t, r)
+			move := reconcileMove(t, r)
+			if move.Status.Phase != poolv1.MovePhaseFailed || !strings.Contains(move.Status.Message, tt.msg) {
+				t.Fatalf("move in phase %s (%s), want Failed with %q", move.Status.Phase, move.Status.Message, tt.msg)
+			}
+			assertRestored(t, r.Client, "node-a")
+		})
+	}
+}
+
+func TestMoveDrainTimeout(t *testing.T) {
+	move := testMove("node-a")
+	move.Spec.DrainTimeout = &metav1.Duration{Duration: time.Nanosecond}
+	r := newMoveReconciler(t, move, testNode("node-a", testNamespace), testPod("web", "node-a"))
+	// PodDisruptionBudget拒绝驱逐
+	r.KubeClient = newEvictionClient(func(namespace, name string) error {
+		return errors.NewTooManyRequests("disruption budget", 0)
+	})
+	setPoolNodes(t, r.Client, "node-a")
+
+	reconcileMove(t, r)
+	if move = reconcileMove(t, r); move.Status.Phase != poolv1.MovePhaseDraining {
+		t.Fatalf("move in phase %s (%s), want Draining", move.Status.Phase, move.Status.Message)
+	}
+	time.Sleep(time.Millisecond)
+	move = reconcileMove(t, r)
+	if move.Status.Phase != poolv1.MovePhaseFailed || !strings.Contains(move.Status.Message, "still running") {
+		t.Fatalf("move in phase %s (%s), want Failed after the drain timeout", move.Status.Phase, move.Status.Message)
+	}
+	assertRestored(t, r.Client, "node-a")
+	if value, _ := NodePoolValue(getTestNode(t, r.Client, "node-a")); value != testNamespace {
+		t.Fatalf("node of a failed move relabelled to %q", value)
+	}
+}
+
+func TestMoveDeletedRestoresNodes(t *testing.T) {
+	r := newMoveReconciler(t, testMove("node-a"), testNode("node-a", testNamespace))
+	setPoolNodes(t, r.Client, "node-a")
+
+	reconcileMove(t, r)
+	move := reconcileMove(t, r)
+	if move.Status.Phase != poolv1.MovePhaseDraining {
+		t.Fatalf("move in phase %s (%s), want Draining", move.Status.Phase, move.Status.Message)
+	}
+	if err := r.Delete(context.Background(), move); err != nil {
+		t.Fatal(err)
+	}
+	if move = reconcileMove(t, r); move != nil {
+		t.Fatalf("deleted move kept its finalizers %v", move.Finalizers)
+	}
+	assertRestored(t, r.Client, "node-a")
+}
@@ -21,22 +21,30 @@ import (
 	"fmt"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	poolv1 "nodepool/api/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // NodePoolReconciler reconciles a NodePool object
 type NamespaceReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=nodes.sunkai.xyz,resources=nodepools/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 // Reconcile, ns发生变动，只需在创建ns时创建对应的nodepool
 func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
@@ -45,6 +53,7 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	err := r.Get(ctx, req.NamespacedName, &ns)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			// nodepool的finalizer负责释放其中的node
 			l.Info(fmt.Sprintf("namespace:%v has been delete", req))
 			return ctrl.Result{}, nil
 		}
@@ -57,6 +66,20 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
+	// 继承祖先nodepool的子namespace不创建自己的nodepool
+	owner, err := PoolNamespace(ctx, r.Client, ns.Name)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on resolving the nodepool of namespace:%s", ns.Name))
+		return ctrl.Result{}, err
+	}
+	if owner != ns.Name {
+		l.Info(fmt.Sprintf("namespace:%s inherits the nodepool of namespace:%s", ns.Name, owner))
+		return ctrl.Result{}, r.reportRedundantPool(ctx, ns.Name, owner)
+	}
+	if err := r.reportRedundantPool(ctx, ns.Name, ""); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	genPool := GenerateNodePoolObj(DefaultNodePoolName, ns.Name)
 	pool := poolv1.NodePool{}
 	exist := true
@@ -79,12 +102,7 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			return ctrl.Result{}, err
 		}
 		l.Info(fmt.Sprintf("nodepool: %v/%s created", genPool.Namespace, genPool.Name))
-
-		err = r.Status().Update(ctx, genPool)
-		if err != nil {
-			l.Error(err, fmt.Sprintf("failed to update nodepool status"))
-			return ctrl.Result{}, err
-		}
+		// status由NodePoolReconciler维护
 	}
 	/*else {
 		// nodepool存在时更新nodepool，使其恢复到默认状态
@@ -104,9 +122,62 @@ func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	return ctrl.Result{}, nil
 }
 
+// reportRedundantPool sets the Redundant condition of the own default nodepool of a namespace which inherits the
+// nodepool of owner, its pods are pinned to that one now. The nodepool is kept with its nodes, deleting it is left
+// to the user. An empty owner clears the condition of a namespace which no longer inherits.
+func (r *NamespaceReconciler) reportRedundantPool(ctx context.Context, namespace, owner string) error {
+	l := log.FromContext(ctx)
+
+	pool := &poolv1.NodePool{}
+	err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: DefaultNodePoolName}, pool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		l.Error(err, fmt.Sprintf("error on getting nodepool:%s/%s", namespace, DefaultNodePoolName))
+		return err
+	}
+	if pool.DeletionTimestamp != nil {
+		return nil
+	}
+
+	cond := metav1.Condition{
+		Type:               poolv1.ConditionRedundant,
+		Status:             metav1.ConditionFalse,
+		Reason:             "OwnNodePool",
+		Message:            "pods of the namespace are pinned to this nodepool",
+		ObservedGeneration: pool.Generation,
+	}
+	if owner != "" {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = "InheritsNodePool"
+		cond.Message = fmt.Sprintf("namespace %s inherits the nodepool of namespace %s, no pod is pinned to this nodepool, delete it to release its %d node(s)",
+			namespace, owner, len(pool.Status.Nodes))
+	} else if meta.FindStatusCondition(pool.Status.Conditions, poolv1.ConditionRedundant) == nil {
+		return nil
+	}
+
+	redundant := meta.IsStatusConditionTrue(pool.Status.Conditions, poolv1.ConditionRedundant)
+	err = PatchPoolStatus(ctx, r.Client, pool, FieldOwnerNamespace, func(pool *poolv1.NodePool) {
+		meta.SetStatusCondition(&pool.Status.Conditions, cond)
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on updating the redundant condition of nodepool:%s/%s", namespace, DefaultNodePoolName))
+		return err
+	}
+	if owner != "" && !redundant {
+		r.Recorder.Event(pool, corev1.EventTypeWarning, "RedundantNodePool", cond.Message)
+		l.Info(fmt.Sprintf("nodepool:%s/%s is redundant, namespace inherits the nodepool of namespace:%s", namespace, DefaultNodePoolName, owner))
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
+// Children are reconciled again when their parent changes, they need their own nodepool once it is gone.
 func (r *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Namespace{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(NamespaceToChildren(mgr.GetClient()))).
 		Complete(r)
 }
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+//+kubebuilder:rbac:groups="",resources=resourcequotas;limitranges,verbs=get;list;watch;create;update;patch;delete
+
+const (
+	// QuotaObjectName name of the ResourceQuota and LimitRange kept for the default nodepool
+	QuotaObjectName = "nodepool"
+
+	// LabelQuotaPool namespace of the default nodepool a ResourceQuota or LimitRange is kept for.
+	// Owner references can not cross namespaces, the objects of inheriting namespaces are found by it.
+	LabelQuotaPool = "nodepool.sunkai.xyz/quota-pool"
+)
+
+var (
+	// ManageQuota, keep a ResourceQuota and LimitRange in each namespace sized to its default nodepool
+	ManageQuota = false
+	// QuotaReserve, fraction of the nodepool's allocatable kept out of the ResourceQuota
+	QuotaReserve = 0.1
+	// QuotaDefaultRequests, requests the LimitRange gives containers setting neither a request nor a limit.
+	// The ResourceQuota rejects pods which do not request every resource it limits.
+	QuotaDefaultRequests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("100m"),
+		corev1.ResourceMemory: resource.MustParse("128Mi"),
+	}
+)
+
+// reconcileQuota sizes a ResourceQuota to the allocatable of the default nodepool minus QuotaReserve, split evenly
+// between the namespaces pinned to it, and keeps a LimitRange defaulting the requests the quota limits in each of them.
+// Objects left in namespaces which stopped inheriting the nodepool are deleted.
+func (r *NodePoolReconciler) reconcileQuota(ctx context.Context, pool *poolv1.NodePool) error {
+	if !ManageQuota || pool.Name != DefaultNodePoolName {
+		return nil
+	}
+
+	namespaces, err := PoolNamespaces(ctx, r.Client, pool)
+	if err != nil {
+		return err
+	}
+	hard := SplitQuota(QuotaHard(pool.Status.Allocatable, QuotaReserve), len(namespaces))
+	for _, namespace := range namespaces {
+		if err := r.reconcileResourceQuota(ctx, pool, namespace, hard); err != nil {
+			return err
+		}
+		if err := r.reconcileLimitRange(ctx, pool, namespace); err != nil {
+			return err
+		}
+	}
+	return r.deleteQuotas(ctx, pool, namespaces)
+}
+
+// ownsQuotaObject whether the ResourceQuota or LimitRange is new or kept for a default nodepool, the one of
+// a namespace which stopped inheriting is taken over from the parent. A same named object of somebody else is left alone.
+func ownsQuotaObject(pool *poolv1.NodePool, obj client.Object) bool {
+	if _, ok := obj.GetLabels()[LabelQuotaPool]; ok {
+		return true
+	}
+	return obj.GetResourceVersion() == "" || metav1.IsControlledBy(obj, pool)
+}
+
+// claimQuotaObject labels the object for the nodepool, in the namespace of the nodepool it is also owned by it
+func (r *NodePoolReconciler) claimQuotaObject(pool *poolv1.NodePool, obj client.Object) error {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[LabelQuotaPool] = pool.Namespace
+	obj.SetLabels(labels)
+	if obj.GetNamespace() != pool.Namespace {
+		return nil
+	}
+	return controllerutil.SetControllerReference(pool, obj, r.Scheme)
+}
+
+func (r *NodePoolReconciler) reconcileResourceQuota(ctx context.Context, pool *poolv1.NodePool, namespace string, hard corev1.ResourceList) error {
+	l := log.FromContext(ctx)
+
+	quota := &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: QuotaObjectName}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, quota, func() error {
+		if !ownsQuotaObject(pool, quota) {
+			return nil
+		}
+		quota.Spec.Hard = hard
+		return r.claimQuotaObject(pool, quota)
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to reconcile resourcequota:%s/%s of nodepool:%s/%s", namespace, QuotaObjectName, pool.Namespace, pool.Name))
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		l.Info(fmt.Sprintf("resourcequota:%s/%s %s", quota.Namespace, quota.Name, op))
+	}
+	return nil
+}
+
+func (r *NodePoolReconciler) reconcileLimitRange(ctx context.Context, pool *poolv1.NodePool, namespace string) error {
+	l := log.FromContext(ctx)
+
+	limitRange := &corev1.LimitRange{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: QuotaObjectName}}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, limitRange, func() error {
+		if !ownsQuotaObject(pool, limitRange) {
+			return nil
+		}
+		limitRange.Spec.Limits = []corev1.LimitRangeItem{QuotaLimitRangeItem(pool.Spec.Resources)}
+		return r.claimQuotaObject(pool, limitRange)
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to reconcile limitrange:%s/%s of nodepool:%s/%s", namespace, QuotaObjectName, pool.Namespace, pool.Name))
+		return err
+	}
+	if op != controllerutil.OperationResultNone {
+		l.Info(fmt.Sprintf("limitrange:%s/%s %s", limitRange.Namespace, limitRange.Name, op))
+	}
+	return nil
+}
+
+// deleteQuotas deletes the ResourceQuotas and LimitRanges kept for the nodepool outside the given namespaces
+func (r *NodePoolReconciler) deleteQuotas(ctx context.Context, pool *poolv1.NodePool, namespaces []string) error {
+	l := log.FromContext(ctx)
+
+	keep := make(map[string]bool, len(namespaces))
+	for _, namespace := range namespaces {
+		keep[namespace] = true
+	}
+	quotas := corev1.ResourceQuotaList{}
+	if err := r.List(ctx, &quotas, client.MatchingLabels{LabelQuotaPool: pool.Namespace}); err != nil {
+		return err
+	}
+	limitRanges := corev1.LimitRangeList{}
+	if err := r.List(ctx, &limitRanges, client.MatchingLabels{LabelQuotaPool: pool.Namespace}); err != nil {
+		return err
+	}
+	objs := make([]client.Object, 0, len(quotas.Items)+len(limitRanges.Items))
+	for i := range quotas.Items {
+		objs = append(objs, &quotas.Items[i])
+	}
+	for i := range limitRanges.Items {
+		objs = append(objs, &limitRanges.Items[i])
+	}
+	for _, obj := range objs {
+		if keep[obj.GetNamespace()] || obj.GetName() != QuotaObjectName {
+			continue
+		}
+		err := r.Delete(ctx, obj)
+		if err != nil && !errors.IsNotFound(err) {
+			l.Error(err, fmt.Sprintf("failed to delete %T:%s/%s of nodepool:%s/%s", obj, obj.GetNamespace(), obj.GetName(), pool.Namespace, pool.Name))
+			return err
+		}
+		l.Info(fmt.Sprintf("%T:%s/%s deleted", obj, obj.GetNamespace(), obj.GetName()))
+	}
+	return nil
+}
+
+// QuotaLimitRangeItem The container defaults of the LimitRange: the defaults of the nodepool, plus QuotaDefaultRequests
+// for the resources it gives neither a default request nor a default limit, the request defaults to the limit
+func QuotaLimitRangeItem(resources *poolv1.NodePoolResources) corev1.LimitRangeItem {
+	item := corev1.LimitRangeItem{Type: corev1.LimitTypeContainer, DefaultRequest: corev1.ResourceList{}}
+	if resources != nil {
+		item.Default = resources.DefaultLimits
+		item.MaxLimitRequestRatio = resources.MaxLimitRequestRatio
+		for name, q := range resources.DefaultRequests {
+			item.DefaultRequest[name] = q
+		}
+	}
+	for name, q := range QuotaDefaultRequests {
+		if _, ok := item.DefaultRequest[name]; ok {
+			continue
+		}
+		if _, ok := item.Default[name]; ok {
+			continue
+		}
+		item.DefaultRequest[name] = q
+	}
+	return item
+}
+
+// QuotaHard Hard limits of a ResourceQuota covering allocatable minus the reserved fraction.
+// Only the pod count and the cpu and memory requests are limited, QuotaDefaultRequests makes sure every pod sets them.
+// No limit is set while the nodepool has no nodes.
+func QuotaHard(allocatable corev1.ResourceList, reserve float64) corev1.ResourceList {
+	hard := corev1.ResourceList{}
+	for name, q := range allocatable {
+		switch name {
+		case corev1.ResourcePods:
+			hard[name] = *resource.NewQuantity(int64(float64(q.Value())*(1-reserve)), q.Format)
+		case corev1.ResourceCPU:
+			hard[corev1.ResourceRequestsCPU] = *resource.NewMilliQuantity(int64(float64(q.MilliValue())*(1-reserve)), q.Format)
+		case corev1.ResourceMemory:
+			hard[corev1.ResourceRequestsMemory] = *resource.NewQuantity(int64(float64(q.Value())*(1-reserve)), q.Format)
+		}
+	}
+	return hard
+}
+
+// SplitQuota Splits the hard limits evenly between n namespaces, rounding down
+func SplitQuota(hard corev1.ResourceList, n int) corev1.ResourceList {
+	if n <= 1 {
+		return hard
+	}
+	split := make(corev1.ResourceList, len(hard))
+	for name, q := range hard {
+		if name == corev1.ResourceRequestsCPU {
+			split[name] = *resource.NewMilliQuantity(q.MilliValue()/int64(n), q.Format)
+			continue
+		}
+		split[name] = *resource.NewQuantity(q.Value()/int64(n), q.Format)
+	}
+	return split
+}
+
+// QuotaToPool Map a ResourceQuota or LimitRange to the default nodepool it is kept for
+func QuotaToPool(obj client.Object) []reconcile.Request {
+	namespace, ok := obj.GetLabels()[LabelQuotaPool]
+	if !ok || obj.GetName() != QuotaObjectName {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: namespace, Name: DefaultNodePoolName}}}
+}
+
+// NamespaceToPools Map a namespace to its own default nodepool and the one of the ancestor it inherits from.
+// Called with the old and the new namespace on updates, a namespace leaving a parent requeues both nodepools.
+func NamespaceToPools(c client.Reader) func(obj client.Object) []reconcile.Request {
+	return func(obj client.Object) []reconcile.Request {
+		requests := []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetName(), Name: DefaultNodePoolName}}}
+		ns, ok := obj.(*corev1.Namespace)
+		if !ok {
+			return requests
+		}
+		parent := NamespaceParent(ns)
+		if parent == "" {
+			return requests
+		}
+		owner, err := PoolNamespace(context.Background(), c, parent)
+		if err != nil {
+			owner = parent
+		}
+		return append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: owner, Name: DefaultNodePoolName}})
+	}
+}
@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestQuotaHard(t *testing.T) {
+	allocatable := corev1.ResourceList{
+		corev1.ResourcePods:               resource.MustParse("110"),
+		corev1.ResourceCPU:                resource.MustParse("3500m"),
+		corev1.ResourceMemory:             resource.MustParse("10Gi"),
+		corev1.ResourceName("vendor/gpu"): resource.MustParse("4"),
+	}
+	tests := []struct {
+		name        string
+		allocatable corev1.ResourceList
+		reserve     float64
+		want        map[corev1.ResourceName]string
+	}{
+		{
+			name:        "reserve",
+			allocatable: allocatable,
+			reserve:     0.1,
+			want: map[corev1.ResourceName]string{
+				corev1.ResourcePods:           "99",
+				corev1.ResourceRequestsCPU:    "3150m",
+				corev1.ResourceRequestsMemory: "9663676416",
+			},
+		},
+		{
+			name:        "no reserve",
+			allocatable: allocatable,
+			want: map[corev1.ResourceName]string{
+				corev1.ResourcePods:           "110",
+				corev1.ResourceRequestsCPU:    "3500m",
+				corev1.ResourceRequestsMemory: "10Gi",
+			},
+		},
+		{name: "empty nodepool", reserve: 0.1, want: map[corev1.ResourceName]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hard := QuotaHard(tt.allocatable, tt.reserve)
+			if len(hard) != len(tt.want) {
+				t.Fatalf("hard %v, want %v", hard, tt.want)
+			}
+			for name, value := range tt.want {
+				got, ok := hard[name]
+				if want := resource.MustParse(value); !ok || got.Cmp(want) != 0 {
+					t.Errorf("%s: got %s, want %s", name, got.String(), value)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileQuota(t *testing.T) {
+	defer func(manage bool, reserve float64) { ManageQuota, QuotaReserve = manage, reserve }(ManageQuota, QuotaReserve)
+	ManageQuota, QuotaReserve = true, 0.5
+
+	node := testNode("node-a", testNamespace)
+	node.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourcePods: resource.MustParse("10"),
+		corev1.ResourceCPU:  resource.MustParse("2"),
+	}
+	c := newTestClient(t, node)
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: testNamespace, Name: QuotaObjectName}
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := getTestPool(t, c)
+	pool.Spec.Resources = &poolv1.NodePoolResources{
+		DefaultRequests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m")},
+		DefaultLimits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+	}
+	if err := c.Update(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+
+	quota := &corev1.ResourceQuota{}
+	if err := c.Get(ctx, key, quota); err != nil {
+		t.Fatal(err)
+	}
+	if pods, cpu := quota.Spec.Hard[corev1.ResourcePods], quota.Spec.Hard[corev1.ResourceRequestsCPU]; pods.Value() != 5 || cpu.MilliValue() != 1000 {
+		t.Fatalf("resourcequota hard %v, want half of the allocatable", quota.Spec.Hard)
+	}
+	if !metav1.IsControlledBy(quota, getTestPool(t, c)) {
+		t.Fatalf("resourcequota not owned by the nodepool: %v", quota.OwnerReferences)
+	}
+	limitRange := &corev1.LimitRange{}
+	if err := c.Get(ctx, key, limitRange); err != nil {
+		t.Fatal(err)
+	}
+	// 设置了默认limit的资源由apiserver用limit作为request
+	item := limitRange.Spec.Limits[0]
+	if cpu := item.DefaultRequest[corev1.ResourceCPU]; cpu.MilliValue() != 250 {
+		t.Fatalf("limitrange %+v, want the default requests of the nodepool", limitRange.Spec.Limits)
+	}
+	if _, ok := item.DefaultRequest[corev1.ResourceMemory]; ok {
+		t.Fatalf("limitrange %+v defaults the memory request below the default limit", limitRange.Spec.Limits)
+	}
+
+	// 删除spec.resources后LimitRange使用内置的默认request
+	pool = getTestPool(t, c)
+	pool.Spec.Resources = nil
+	if err := c.Update(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if err := c.Get(ctx, key, limitRange); err != nil {
+		t.Fatalf("limitrange of the nodepool deleted: %v", err)
+	}
+	if !equality.Semantic.DeepEqual(limitRange.Spec.Limits[0].DefaultRequest, QuotaDefaultRequests) {
+		t.Fatalf("limitrange %+v, want the built-in default requests", limitRange.Spec.Limits)
+	}
+
+	// nodepool没有node时不设置限制
+	if err := c.Delete(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if err := c.Get(ctx, key, quota); err != nil {
+		t.Fatal(err)
+	}
+	if len(quota.Spec.Hard) != 0 {
+		t.Fatalf("resourcequota of an empty nodepool limits %v", quota.Spec.Hard)
+	}
+}
+
+func TestReconcileQuotaKeepsForeignLimitRange(t *testing.T) {
+	defer func(manage bool) { ManageQuota = manage }(ManageQuota)
+	ManageQuota = true
+
+	// 不属于nodepool的同名LimitRange不删除
+	limitRange := &corev1.LimitRange{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: QuotaObjectName}}
+	c := newTestClient(t, limitRange)
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: QuotaObjectName}, &corev1.LimitRange{}); err != nil {
+		t.Fatalf("limitrange not owned by the nodepool deleted: %v", err)
+	}
+}
+
+// admitToQuota mimics the LimitRanger and ResourceQuota admission plugins: containers get the defaults of the
+// LimitRange for the resources they set no request for, then must request every resource the quota limits
+func admitToQuota(pod *corev1.Pod, limitRange *corev1.LimitRange, quota *corev1.ResourceQuota) error {
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		requests := container.Resources.Requests.DeepCopy()
+		if requests == nil {
+			requests = corev1.ResourceList{}
+		}
+		for _, item := range limitRange.Spec.Limits {
+			for name, q := range container.Resources.Limits {
+				if _, ok := requests[name]; !ok {
+					requests[name] = q
+				}
+			}
+			for name, q := range item.Default {
+				if _, ok := requests[name]; !ok {
+					requests[name] = q
+				}
+			}
+			for name, q := range item.DefaultRequest {
+				if _, ok := requests[name]; !ok {
+					requests[name] = q
+				}
+			}
+		}
+		for name := range quota.Spec.Hard {
+			if !strings.HasPrefix(string(name), "requests.") {
+				continue
+			}
+			if _, ok := requests[corev1.ResourceName(strings.TrimPrefix(string(name), "requests."))]; !ok {
+				return fmt.Errorf("container %s must specify %s", container.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+func TestQuotaAdmitsPodWithoutRequests(t *testing.T) {
+	defer func(manage bool) { ManageQuota = manage }(ManageQuota)
+	ManageQuota = true
+
+	node := testNode("node-a", testNamespace)
+	node.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourcePods:               resource.MustParse("10"),
+		corev1.ResourceCPU:                resource.MustParse("2"),
+		corev1.ResourceMemory:             resource.MustParse("4Gi"),
+		corev1.ResourceEphemeralStorage:   resource.MustParse("100Gi"),
+		corev1.ResourceName("vendor/gpu"): resource.MustParse("1"),
+	}
+	c := newTestClient(t, node)
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := types.NamespacedName{Namespace: testNamespace, Name: QuotaObjectName}
+	quota := &corev1.ResourceQuota{}
+	if err := c.Get(ctx, key, quota); err != nil {
+		t.Fatal(err)
+	}
+	limitRange := &corev1.LimitRange{}
+	if err := c.Get(ctx, key, limitRange); err != nil {
+		t.Fatal(err)
+	}
+	pods := []*corev1.Pod{
+		{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}},
+		{Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init"}},
+			Containers: []corev1.Container{{Name: "app", Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+			}}},
+		}},
+	}
+	for _, pod := range pods {
+		if err := admitToQuota(pod, limitRange, quota); err != nil {
+			t.Errorf("pod without requests rejected by resourcequota %v: %v", quota.Spec.Hard, err)
+		}
+	}
+}
+
+func TestReconcileQuotaInheritingNamespaces(t *testing.T) {
+	defer func(manage bool, reserve float64) { ManageQuota, QuotaReserve = manage, reserve }(ManageQuota, QuotaReserve)
+	ManageQuota, QuotaReserve = true, 0
+
+	node := testNode("node-a", testNamespace)
+	node.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourcePods: resource.MustParse("10"),
+		corev1.ResourceCPU:  resource.MustParse("2"),
+	}
+	child := testChildNamespace("tenant-ci", testNamespace)
+	c := newTestClient(t, node, child)
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme()}
+	ctx := context.Background()
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconcile()
+
+	// 继承的namespace平分nodepool的容量
+	for _, namespace := range []string{testNamespace, child.Name} {
+		quota := &corev1.ResourceQuota{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: QuotaObjectName}, quota); err != nil {
+			t.Fatal(err)
+		}
+		if pods, cpu := quota.Spec.Hard[corev1.ResourcePods], quota.Spec.Hard[corev1.ResourceRequestsCPU]; pods.Value() != 5 || cpu.MilliValue() != 1000 {
+			t.Fatalf("resourcequota of %s hard %v, want half of the allocatable", namespace, quota.Spec.Hard)
+		}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: QuotaObjectName}, &corev1.LimitRange{}); err != nil {
+			t.Fatalf("limitrange of %s: %v", namespace, err)
+		}
+	}
+	if got := getNamespaceRequests(NamespaceToPools(c)(child)); len(got) != 2 || got[1] != testNamespace {
+		t.Fatalf("namespace change requeues %v, want its own and the inherited nodepool", got)
+	}
+
+	// 不再继承后删除其中的ResourceQuota和LimitRange
+	child.Annotations = map[string]string{AnnotationInherit: "false"}
+	if err := c.Update(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	key := types.NamespacedName{Namespace: child.Name, Name: QuotaObjectName}
+	if err := c.Get(ctx, key, &corev1.ResourceQuota{}); !errors.IsNotFound(err) {
+		t.Fatalf("resourcequota of a namespace no longer inheriting not deleted: %v", err)
+	}
+	if err := c.Get(ctx, key, &corev1.LimitRange{}); !errors.IsNotFound(err) {
+		t.Fatalf("limitrange of a namespace no longer inheriting not deleted: %v", err)
+	}
+	quota := &corev1.ResourceQuota{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: testNamespace, Name: QuotaObjectName}, quota); err != nil {
+		t.Fatal(err)
+	}
+	if pods := quota.Spec.Hard[corev1.ResourcePods]; pods.Value() != 10 {
+		t.Fatalf("resourcequota hard %v, want the whole allocatable", quota.Spec.Hard)
+	}
+}
+
+// getNamespaceRequests namespaces of the nodepools requeued
+func getNamespaceRequests(requests []reconcile.Request) []string {
+	namespaces := make([]string, 0, len(requests))
+	for _, request := range requests {
+		namespaces = append(namespaces, request.Namespace)
+	}
+	return namespaces
+}
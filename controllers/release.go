@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	// DrainOnRelease, drain pods of the previous nodepool before a relabelled node is handed to its new nodepool
+	DrainOnRelease = false
+	// ReleaseTimeout, max time to wait for pods to be evicted before the node is handed over anyway
+	ReleaseTimeout = 10 * time.Minute
+)
+
+// releaseRetryInterval is how often the drain progress of a releasing node is checked
+const releaseRetryInterval = 10 * time.Second
+
+// reconcileRelease drives the release of a node that left its nodepool: evict the pods of the
+// namespaces pinned to the previous nodepool, then hand the node to the nodepool its label points to.
+// The release is started by the previous nodepool, see startRelease.
+// done is false while the release is in progress and the caller must return the result.
+func (r *NodeReconciler) reconcileRelease(ctx context.Context, node *corev1.Node, pools *poolv1.NodePoolList) (result ctrl.Result, done bool, err error) {
+	l := log.FromContext(ctx)
+
+	// NodePoolMove自己负责驱逐和移交node
+	if _, ok := node.Annotations[AnnotationMove]; ok {
+		return ctrl.Result{}, true, nil
+	}
+
+	current := node.Labels[LableNodePoolKey]
+	from, releasing := node.Annotations[AnnotationReleasingFrom]
+	if !releasing {
+		return ctrl.Result{}, true, nil
+	}
+
+	old := FindNodepoolBySelectorValue(from, pools)
+	if old == nil {
+		l.Info(fmt.Sprintf("nodepool of %s released from node:%s no longer exists", from, node.Name))
+		return ctrl.Result{Requeue: true}, false, r.finishRelease(ctx, node, nil, "previous nodepool deleted")
+	}
+	if from == current {
+		return ctrl.Result{Requeue: true}, false, r.finishRelease(ctx, node, old, "node label restored, release cancelled")
+	}
+
+	// 包括继承该nodepool的子namespace的pod
+	pods, err := ListPoolPodsOnNode(ctx, r.Client, old, node.Name)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on getting pods of node:%s", node.Name))
+		return ctrl.Result{}, false, err
+	}
+
+	remaining := int32(0)
+	blocked := 0
+	for i := 0; i < len(pods); i++ {
+		pod := &pods[i]
+		if IsPodTerminated(pod) {
+			continue
+		}
+		nodePod, err := IsNodePod(ctx, r.Client, pod)
+		if err != nil {
+			l.Error(err, fmt.Sprintf("error on getting owner of pod:%s/%s", pod.Namespace, pod.Name))
+			return ctrl.Result{}, false, err
+		}
+		if nodePod {
+			continue
+		}
+		remaining++
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		evicted, err := EvictPod(ctx, r.KubeClient, pod)
+		if err != nil {
+			l.Error(err, fmt.Sprintf("failed to evict pod:%s/%s from node:%s", pod.Namespace, pod.Name, node.Name))
+			return ctrl.Result{}, false, err
+		}
+		if !evicted {
+			blocked++
+		}
+	}
+
+	startTime := metav1.Now()
+	if entry := findNodeRelease(old, node.Name); entry != nil {
+		startTime = entry.StartTime
+	}
+
+	if remaining == 0 {
+		return ctrl.Result{Requeue: true}, false, r.finishRelease(ctx, node, old, "all pods evicted")
+	}
+	if time.Since(startTime.Time) > ReleaseTimeout {
+		msg := fmt.Sprintf("%d pod(s) still running after %v", remaining, ReleaseTimeout)
+		r.Recorder.Eventf(old, corev1.EventTypeWarning, "ReleaseTimeout", "node %s: %s", node.Name, msg)
+		return ctrl.Result{Requeue: true}, false, r.finishRelease(ctx, node, old, msg)
+	}
+
+	msg := fmt.Sprintf("waiting for %d pod(s) to terminate", remaining)
+	if blocked > 0 {
+		msg = fmt.Sprintf("%s, %d eviction(s) refused by PodDisruptionBudget", msg, blocked)
+	}
+	err = PatchPoolStatus(ctx, r.Client, old, FieldOwnerNode, func(pool *poolv1.NodePool) {
+		entry := findNodeRelease(pool, node.Name)
+		if entry == nil {
+			pool.Status.Releasing = append(pool.Status.Releasing, poolv1.NodeRelease{
+				Node:      node.Name,
+				Phase:     poolv1.ReleasePhaseDraining,
+				StartTime: startTime,
+			})
+			entry = &pool.Status.Releasing[len(pool.Status.Releasing)-1]
+		}
+		entry.PodsRemaining = remaining
+		entry.Message = msg
+	})
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to update release of node:%s in nodepool:%s/%s", node.Name, old.Namespace, old.Name))
+		return ctrl.Result{}, false, err
+	}
+	return ctrl.Result{RequeueAfter: releaseRetryInterval}, false, nil
+}
+
+// startRelease cordons a node which left the nodepool, the node keeps belonging to the nodepool
+// until NodeReconciler drained it. The caller records the release in the status.
+func (r *NodePoolReconciler) startRelease(ctx context.Context, node *corev1.Node, pool *poolv1.NodePool) error {
+	l := log.FromContext(ctx)
+
+	patch := client.MergeFrom(node.DeepCopy())
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[AnnotationReleasingFrom] = PoolSelectorValue(pool)
+	if !node.Spec.Unschedulable {
+		node.Spec.Unschedulable = true
+		node.Annotations[AnnotationCordoned] = "true"
+	}
+	err := r.Patch(ctx, node, patch)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to cordon node:%s", node.Name))
+		return err
+	}
+
+	r.Recorder.Eventf(pool, corev1.EventTypeNormal, "NodeReleasing", "node %s left the nodepool, draining", node.Name)
+	l.Info(fmt.Sprintf("node:%s left nodepool:%s/%s, draining", node.Name, pool.Namespace, pool.Name))
+	return nil
+}
+
+// releaseDepartedNodes starts the release of the former members of the nodepool whose label changed.
+// It returns the nodes which keep belonging to the nodepool while they are drained.
+func (r *NodePoolReconciler) releaseDepartedNodes(ctx context.Context, pool *poolv1.NodePool, members []string) ([]string, error) {
+	if !DrainOnRelease || InclusionExceptionNs(pool.Namespace) {
+		return nil, nil
+	}
+
+	current := make(map[string]bool, len(members))
+	for _, name := range members {
+		current[name] = true
+	}
+	var releasing []string
+	for _, name := range pool.Status.Nodes {
+		if current[name] {
+			continue
+		}
+		node := &corev1.Node{}
+		err := r.Get(ctx, types.NamespacedName{Name: name}, node)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		// NodePoolMove自己负责驱逐和移交node
+		if _, ok := node.Annotations[AnnotationMove]; ok {
+			continue
+		}
+		if value, ok := NodePoolValue(node); ok && value == PoolSelectorValue(pool) {
+			continue
+		}
+		// 已经释放过的node不再重复释放
+		if findNodeRelease(pool, name) != nil {
+			continue
+		}
+		if err = r.startRelease(ctx, node, pool); err != nil {
+			return nil, err
+		}
+		releasing = append(releasing, name)
+	}
+	return releasing, nil
+}
+
+// pruneNodeReleases drops the releases of nodes which are no member anymore, eg: deleted or handed over nodes,
+// and the finished releases of members whose label was restored
+func pruneNodeReleases(releases []poolv1.NodeRelease, nodeList *corev1.NodeList, members []string) []poolv1.NodeRelease {
+	current := make(map[string]bool, len(members))
+	for _, name := range members {
+		current[name] = true
+	}
+	annotated := make(map[string]bool)
+	for i := range nodeList.Items {
+		if _, ok := nodeList.Items[i].Annotations[AnnotationReleasingFrom]; ok {
+			annotated[nodeList.Items[i].Name] = true
+		}
+	}
+	var pruned []poolv1.NodeRelease
+	for _, release := range releases {
+		if !current[release.Node] {
+			continue
+		}
+		if release.Phase == poolv1.ReleasePhaseReleased && !annotated[release.Node] {
+			continue
+		}
+		pruned = append(pruned, release)
+	}
+	return pruned
+}
+
+// finishRelease uncordons the node and hands it over to the nodepool its label points to
+func (r *NodeReconciler) finishRelease(ctx context.Context, node *corev1.Node, pool *poolv1.NodePool, reason string) error {
+	l := log.FromContext(ctx)
+
+	if pool != nil {
+		// 保留Released记录，nodepool据此区分移交完成的node和新离开的node
+		err := PatchPoolStatus(ctx, r.Client, pool, FieldOwnerNode, func(pool *poolv1.NodePool) {
+			entry := findNodeRelease(pool, node.Name)
+			if entry == nil {
+				pool.Status.Releasing = append(pool.Status.Releasing, poolv1.NodeRelease{
+					Node:      node.Name,
+					StartTime: metav1.Now(),
+				})
+				entry = &pool.Status.Releasing[len(pool.Status.Releasing)-1]
+			}
+			entry.Phase = poolv1.ReleasePhaseReleased
+			entry.Message = reason
+		})
+		if err != nil {
+			l.Error(err, fmt.Sprintf("failed to finish release of node:%s in nodepool:%s/%s", node.Name, pool.Namespace, pool.Name))
+			return err
+		}
+		r.Recorder.Eventf(pool, corev1.EventTypeNormal, "NodeReleased", "node %s released: %s", node.Name, reason)
+	}
+
+	patch := client.MergeFrom(node.DeepCopy())
+	delete(node.Annotations, AnnotationReleasingFrom)
+	if _, ok := node.Annotations[AnnotationCordoned]; ok {
+		node.Spec.Unschedulable = false
+		delete(node.Annotations, AnnotationCordoned)
+	}
+	err := r.Patch(ctx, node, patch)
+	if err != nil {
+		l.Error(err, fmt.Sprintf("failed to hand over node:%s", node.Name))
+		return err
+	}
+	l.Info(fmt.Sprintf("node:%s released: %s", node.Name, reason))
+	return nil
+}
+
+func findNodeRelease(pool *poolv1.NodePool, node string) *poolv1.NodeRelease {
+	for i := range pool.Status.Releasing {
+		if pool.Status.Releasing[i].Node == node {
+			return &pool.Status.Releasing[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// releaseTest holds the reconcilers of a node released from the nodepool of testNamespace to moveTarget
+type releaseTest struct {
+	client   client.Client
+	pools    *NodePoolReconciler
+	nodes    *NodeReconciler
+	recorder *record.FakeRecorder
+}
+
+func newReleaseTest(t *testing.T, objs ...client.Object) *releaseTest {
+	drain, timeout := DrainOnRelease, ReleaseTimeout
+	t.Cleanup(func() { DrainOnRelease, ReleaseTimeout = drain, timeout })
+	DrainOnRelease = true
+
+	objs = append(objs, testNode("node-a", moveTarget),
+		GenerateNodePoolObj(DefaultNodePoolName, moveTarget),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: moveTarget}},
+	)
+	c := newTestClient(t, objs...)
+	setPoolNodes(t, c, "node-a")
+	recorder := record.NewFakeRecorder(100)
+	return &releaseTest{
+		client:   c,
+		pools:    &NodePoolReconciler{Client: c, Scheme: c.Scheme(), Recorder: recorder},
+		nodes:    &NodeReconciler{Client: c, Scheme: c.Scheme(), Recorder: recorder, KubeClient: newEvictionClient(evictFrom(c))},
+		recorder: recorder,
+	}
+}
+
+func (rt *releaseTest) reconcilePool(t *testing.T) {
+	t.Helper()
+	if _, err := rt.pools.Reconcile(context.Background(), ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (rt *releaseTest) reconcileNode(t *testing.T) ctrl.Result {
+	t.Helper()
+	result, err := rt.nodes.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "node-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// release returns the release of node-a recorded by the nodepool of testNamespace
+func (rt *releaseTest) release(t *testing.T) *poolv1.NodeRelease {
+	t.Helper()
+	release := findNodeRelease(getTestPool(t, rt.client), "node-a")
+	if release == nil {
+		t.Fatal("release of node-a not recorded")
+	}
+	return release
+}
+
+func TestReleaseDrainsNode(t *testing.T) {
+	rt := newReleaseTest(t, testPod("web", "node-a"))
+
+	// node离开nodepool后先被cordon
+	rt.reconcilePool(t)
+	node := getTestNode(t, rt.client, "node-a")
+	if !node.Spec.Unschedulable || node.Annotations[AnnotationReleasingFrom] != testNamespace {
+		t.Fatalf("released node not cordoned: %+v", node)
+	}
+	if pool := getTestPool(t, rt.client); !NodeInPool("node-a", pool) || rt.release(t).Phase != poolv1.ReleasePhaseDraining {
+		t.Fatalf("releasing node not kept in the nodepool: %+v", pool.Status)
+	}
+
+	// 驱逐之前nodepool的pod
+	if result := rt.reconcileNode(t); result.RequeueAfter != releaseRetryInterval {
+		t.Fatalf("release not waiting for the evicted pod: %+v", result)
+	}
+	if release := rt.release(t); release.PodsRemaining != 1 || !strings.HasPrefix(release.Message, "waiting for 1 pod(s)") {
+		t.Fatalf("release %+v, want 1 pod remaining", release)
+	}
+	if err := rt.client.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "web"}, &corev1.Pod{}); !errors.IsNotFound(err) {
+		t.Fatalf("pod of the previous nodepool not evicted: %v", err)
+	}
+
+	// pod都被驱逐后移交node
+	rt.reconcileNode(t)
+	assertReleased(t, rt, "all pods evicted")
+}
+
+func TestReleaseTimeout(t *testing.T) {
+	rt := newReleaseTest(t, testPod("web", "node-a"))
+	// PodDisruptionBudget拒绝驱逐
+	rt.nodes.KubeClient = newEvictionClient(func(namespace, name string) error {
+		return errors.NewTooManyRequests("disruption budget", 0)
+	})
+
+	rt.reconcilePool(t)
+	rt.reconcileNode(t)
+	if release := rt.release(t); !strings.Contains(release.Message, "refused by PodDisruptionBudget") {
+		t.Fatalf("refused eviction not reported: %+v", release)
+	}
+
+	ReleaseTimeout = time.Nanosecond
+	rt.reconcileNode(t)
+	assertReleased(t, rt, "still running after")
+	if err := rt.client.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "web"}, &corev1.Pod{}); err != nil {
+		t.Fatalf("pod protected by its PodDisruptionBudget: %v", err)
+	}
+	if !strings.Contains(strings.Join(drainEvents(rt.recorder), "\n"), "ReleaseTimeout") {
+		t.Fatal("release timeout not reported")
+	}
+}
+
+func TestReleaseCancelled(t *testing.T) {
+	rt := newReleaseTest(t, testPod("web", "node-a"))
+	rt.nodes.KubeClient = newEvictionClient(func(namespace, name string) error {
+		return errors.NewTooManyRequests("disruption budget", 0)
+	})
+
+	rt.reconcilePool(t)
+	rt.reconcileNode(t)
+
+	// 恢复node的标签取消释放
+	node := getTestNode(t, rt.client, "node-a")
+	node.Labels[LableNodePoolKey] = testNamespace
+	if err := rt.client.Update(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	rt.reconcileNode(t)
+	assertReleased(t, rt, "release cancelled")
+
+	// 标签恢复后不再释放
+	rt.reconcilePool(t)
+	if node := getTestNode(t, rt.client, "node-a"); node.Spec.Unschedulable {
+		t.Fatal("node with a restored label cordoned again")
+	}
+	if pool := getTestPool(t, rt.client); !NodeInPool("node-a", pool) || findNodeRelease(pool, "node-a") != nil {
+		t.Fatalf("node with a restored label released: %+v", pool.Status)
+	}
+}
+
+// assertReleased fails unless node-a was uncordoned and its release finished with the reason
+func assertReleased(t *testing.T, rt *releaseTest, reason string) {
+	t.Helper()
+	node := getTestNode(t, rt.client, "node-a")
+	if _, ok := node.Annotations[AnnotationReleasingFrom]; ok || node.Spec.Unschedulable {
+		t.Fatalf("node not handed over: unschedulable %t, annotations %v", node.Spec.Unschedulable, node.Annotations)
+	}
+	if release := rt.release(t); release.Phase != poolv1.ReleasePhaseReleased || !strings.Contains(release.Message, reason) {
+		t.Fatalf("release %+v, want Released with %q", release, reason)
+	}
+}
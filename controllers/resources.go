@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// PodRequests Sum the resource requests of the pod, init containers run one at a time so only the largest counts
+func PodRequests(pod *corev1.Pod) corev1.ResourceList {
+	reqs := corev1.ResourceList{}
+	for _, c := range pod.Spec.Containers {
+		addResourceList(reqs, c.Resources.Requests)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		for name, q := range c.Resources.Requests {
+			if cur, ok := reqs[name]; !ok || q.Cmp(cur) > 0 {
+				reqs[name] = q.DeepCopy()
+			}
+		}
+	}
+	addResourceList(reqs, pod.Spec.Overhead)
+	return reqs
+}
+
+// NodeFreeResources Allocatable of the node minus the requests of the pods running on it
+func NodeFreeResources(node *corev1.Node, pods []corev1.Pod) corev1.ResourceList {
+	free := node.Status.Allocatable.DeepCopy()
+	if free == nil {
+		free = corev1.ResourceList{}
+	}
+	for i := 0; i < len(pods); i++ {
+		pod := &pods[i]
+		if pod.Spec.NodeName != node.Name || IsPodTerminated(pod) {
+			continue
+		}
+		for name, q := range PodRequests(pod) {
+			if cur, ok := free[name]; ok {
+				cur.Sub(q)
+				free[name] = cur
+			}
+		}
+	}
+	return free
+}
+
+// IsNodeReady Whether the node reports the Ready condition
+func IsNodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// IsNodeSchedulableFor Whether new pods like the given one may be placed on the node: ready, not cordoned and taints tolerated
+func IsNodeSchedulableFor(node *corev1.Node, pod *corev1.Pod) bool {
+	if node.Spec.Unschedulable || !IsNodeReady(node) {
+		return false
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect != corev1.TaintEffectNoSchedule && taint.Effect != corev1.TaintEffectNoExecute {
+			continue
+		}
+		tolerated := false
+		for j := range pod.Spec.Tolerations {
+			if pod.Spec.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// FitsResources Whether free covers every resource in reqs
+func FitsResources(reqs, free corev1.ResourceList) bool {
+	for name, q := range reqs {
+		if q.IsZero() {
+			continue
+		}
+		avail, ok := free[name]
+		if !ok || avail.Cmp(q) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func addResourceList(list, add corev1.ResourceList) {
+	for name, q := range add {
+		if cur, ok := list[name]; ok {
+			cur.Add(q)
+			list[name] = cur
+		} else {
+			list[name] = q.DeepCopy()
+		}
+	}
+}
+
+// formatQuantity renders a quantity the way users write it in pod specs
+func formatQuantity(name corev1.ResourceName, q resource.Quantity) string {
+	switch name {
+	case corev1.ResourceCPU:
+		return q.String() + " CPU"
+	case corev1.ResourceMemory:
+		return q.String() + " memory"
+	default:
+		return q.String() + " " + string(name)
+	}
+}
+
+// MaxAllocatable Largest allocatable per resource among the named nodes
+func MaxAllocatable(nodeList *corev1.NodeList, names []string) corev1.ResourceList {
+	members := make(map[string]bool, len(names))
+	for _, name := range names {
+		members[name] = true
+	}
+
+	var max corev1.ResourceList
+	for i := 0; i < len(nodeList.Items); i++ {
+		node := &nodeList.Items[i]
+		if !members[node.Name] {
+			continue
+		}
+		if max == nil {
+			max = corev1.ResourceList{}
+		}
+		for name, q := range node.Status.Allocatable {
+			if cur, ok := max[name]; !ok || q.Cmp(cur) > 0 {
+				max[name] = q.DeepCopy()
+			}
+		}
+	}
+	return max
+}
+
+// SumAllocatable Sum of the allocatable of the named nodes
+func SumAllocatable(nodeList *corev1.NodeList, names []string) corev1.ResourceList {
+	members := make(map[string]bool, len(names))
+	for _, name := range names {
+		members[name] = true
+	}
+
+	var sum corev1.ResourceList
+	for i := 0; i < len(nodeList.Items); i++ {
+		node := &nodeList.Items[i]
+		if !members[node.Name] {
+			continue
+		}
+		if sum == nil {
+			sum = corev1.ResourceList{}
+		}
+		addResourceList(sum, node.Status.Allocatable)
+	}
+	return sum
+}
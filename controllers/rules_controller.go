@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// RulesConfigMapKey, key of the rules in the data of the rules ConfigMap
+	RulesConfigMapKey = "rules.yaml"
+	// FieldOwnerRules, field manager of the nodepool labels set by the rules
+	FieldOwnerRules = "nodepool-rules-controller"
+	// AnnotationRulePool records the nodepool label value the rules gave the node.
+	// A node whose label was changed afterwards, by hand or by a NodePoolMove, is left to that change.
+	AnnotationRulePool = "nodepool.sunkai.xyz/rule-pool"
+
+	labelHostname               = "kubernetes.io/hostname"
+	labelInstanceType           = "node.kubernetes.io/instance-type"
+	labelInstanceTypeDeprecated = "beta.kubernetes.io/instance-type"
+)
+
+// RulesConfigMap, <namespace>/<name> of the ConfigMap holding the node rules, the rules controller is disabled when empty
+var RulesConfigMap = ""
+
+// nodeRules is the content of the rules ConfigMap, eg:
+//
+//	rules:
+//	- name: gpu
+//	  pool: team-a
+//	  hostname: ^gpu-
+//	  instanceTypes: [p3.2xlarge]
+type nodeRules struct {
+	Rules []nodeRule `json:"rules"`
+}
+
+// nodeRule assigns the nodes matching all of its criteria to a nodepool
+type nodeRule struct {
+	Name string `json:"name"`
+	// Pool, nodepool label value given to the matched nodes
+	Pool string `json:"pool"`
+	// Hostname, regular expression the kubernetes.io/hostname label, or the node name, must match
+	Hostname string `json:"hostname,omitempty"`
+	// InstanceTypes, values of the node.kubernetes.io/instance-type label
+	InstanceTypes []string `json:"instanceTypes,omitempty"`
+	// Labels, labels the node must carry
+	Labels map[string]string `json:"labels,omitempty"`
+
+	hostname *regexp.Regexp
+}
+
+// parseNodeRules parses and validates the rules
+func parseNodeRules(data string) ([]nodeRule, error) {
+	rules := nodeRules{}
+	if err := yaml.UnmarshalStrict([]byte(data), &rules); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(rules.Rules))
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Pool == "" {
+			return nil, fmt.Errorf("rule %s: pool is required", rule.Name)
+		}
+		if rule.Hostname == "" && len(rule.InstanceTypes) == 0 && len(rule.Labels) == 0 {
+			return nil, fmt.Errorf("rule %s: one of hostname, instanceTypes or labels is required", rule.Name)
+		}
+		if rule.Hostname != "" {
+			hostname, err := regexp.Compile(rule.Hostname)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: hostname: %v", rule.Name, err)
+			}
+			rule.hostname = hostname
+		}
+	}
+	return rules.Rules, nil
+}
+
+// matches Whether the node satisfies all criteria of the rule
+func (rule *nodeRule) matches(node *corev1.Node) bool {
+	if rule.hostname != nil {
+		hostname, ok := node.Labels[labelHostname]
+		if !ok {
+			hostname = node.Name
+		}
+		if !rule.hostname.MatchString(hostname) {
+			return false
+		}
+	}
+	if len(rule.InstanceTypes) > 0 {
+		instanceType, ok := node.Labels[labelInstanceType]
+		if !ok {
+			instanceType = node.Labels[labelInstanceTypeDeprecated]
+		}
+		found := false
+		for _, t := range rule.InstanceTypes {
+			if t == instanceType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range rule.Labels {
+		if v, ok := node.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// RulesReconciler labels nodes into nodepools from the rules of RulesConfigMap
+type RulesReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// configMaps, reader of the rules ConfigMap, a cache restricted to it when set up with a manager
+	configMaps client.Reader
+	// rules, parsed rules of the ConfigMap at resourceVersion
+	rules           []nodeRule
+	resourceVersion string
+	rulesErr        error
+	// conflicts, unmatched, nodes already reported
+	conflicts map[string]string
+	unmatched map[string]bool
+	mu        sync.Mutex
+}
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile, 根据规则设置node的nodepool标签
+func (r *RulesReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	node := corev1.Node{}
+	err := r.Get(ctx, req.NamespacedName, &node)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			r.forget(req.Name)
+			return ctrl.Result{}, nil
+		}
+		l.Error(err, fmt.Sprintf("error on getting node:%v", req))
+		return ctrl.Result{}, err
+	}
+
+	rules, err := r.loadRules(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if rules == nil {
+		// 没有规则或规则无效时不修改node
+		return ctrl.Result{}, nil
+	}
+	// NodePoolMove负责移动中的node
+	if _, ok := node.Annotations[AnnotationMove]; ok {
+		return ctrl.Result{}, nil
+	}
+	if reason := ruleOverridden(&node); reason != "" {
+		l.Info(fmt.Sprintf("node:%s %s, label left unchanged", node.Name, reason))
+		return ctrl.Result{}, nil
+	}
+
+	var matched []*nodeRule
+	for i := range rules {
+		if rules[i].matches(&node) {
+			matched = append(matched, &rules[i])
+		}
+	}
+	pools := make(map[string]bool)
+	for _, rule := range matched {
+		pools[rule.Pool] = true
+	}
+	r.report(ctx, &node, matched)
+	if len(pools) != 1 {
+		return ctrl.Result{}, nil
+	}
+
+	rule := matched[0]
+	if node.Labels[LableNodePoolKey] == rule.Pool && node.Annotations[AnnotationRulePool] == rule.Pool {
+		return ctrl.Result{}, nil
+	}
+	patch := client.MergeFrom(node.DeepCopy())
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Labels[LableNodePoolKey] = rule.Pool
+	node.Annotations[AnnotationRulePool] = rule.Pool
+	if err := r.Patch(ctx, &node, patch, client.FieldOwner(FieldOwnerRules)); err != nil {
+		l.Error(err, fmt.Sprintf("failed to label node:%s by rule %s", node.Name, rule.Name))
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Eventf(&node, corev1.EventTypeNormal, "NodeRuleApplied", "labelled %s=%s by rule %s", LableNodePoolKey, rule.Pool, rule.Name)
+	l.Info(fmt.Sprintf("node:%s labelled %s=%s by rule %s", node.Name, LableNodePoolKey, rule.Pool, rule.Name))
+	return ctrl.Result{}, nil
+}
+
+// ruleOverridden returns why the rules must leave the nodepool label of the node alone, empty when they manage it:
+// the node was moved by a NodePoolMove, or relabelled after the rules labelled it
+func ruleOverridden(node *corev1.Node) string {
+	if move, ok := node.Annotations[AnnotationMovedBy]; ok {
+		return fmt.Sprintf("was moved by nodepoolmove %s", move)
+	}
+	applied, ok := node.Annotations[AnnotationRulePool]
+	if ok && node.Labels[LableNodePoolKey] != applied {
+		return fmt.Sprintf("was relabelled from %s=%s set by the rules", LableNodePoolKey, applied)
+	}
+	return ""
+}
+
+// loadRules returns the rules of the ConfigMap, parsed again when it changed.
+// It returns nil rules when the ConfigMap is missing or invalid, the error is reported on the ConfigMap.
+func (r *RulesReconciler) loadRules(ctx context.Context) ([]nodeRule, error) {
+	l := log.FromContext(ctx)
+
+	reader := r.configMaps
+	if reader == nil {
+		reader = r.Client
+	}
+	cm := corev1.ConfigMap{}
+	err := reader.Get(ctx, rulesConfigMapKey(), &cm)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		l.Error(err, fmt.Sprintf("error on getting configmap:%s", RulesConfigMap))
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cm.ResourceVersion != r.resourceVersion {
+		r.resourceVersion = cm.ResourceVersion
+		r.rules, r.rulesErr = parseNodeRules(cm.Data[RulesConfigMapKey])
+		if r.rulesErr != nil {
+			r.Recorder.Eventf(&cm, corev1.EventTypeWarning, "InvalidNodeRules", "%s: %v", RulesConfigMapKey, r.rulesErr)
+			l.Error(r.rulesErr, fmt.Sprintf("invalid node rules in configmap:%s, nodes are left unchanged", RulesConfigMap))
+		}
+	}
+	if r.rulesErr != nil {
+		return nil, nil
+	}
+	return r.rules, nil
+}
+
+// report records the rules matching the node and reports the node once when it becomes conflicting or unmatched
+func (r *RulesReconciler) report(ctx context.Context, node *corev1.Node, matched []*nodeRule) {
+	l := log.FromContext(ctx)
+
+	pools := make(map[string]bool)
+	var names []string
+	for _, rule := range matched {
+		pools[rule.Pool] = true
+		names = append(names, fmt.Sprintf("%s (%s)", rule.Name, rule.Pool))
+	}
+	sort.Strings(names)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conflicts == nil {
+		r.conflicts = make(map[string]string)
+		r.unmatched = make(map[string]bool)
+	}
+	switch len(pools) {
+	case 0:
+		delete(r.conflicts, node.Name)
+		if !r.unmatched[node.Name] {
+			r.unmatched[node.Name] = true
+			r.Recorder.Eventf(node, corev1.EventTypeNormal, "NoNodeRuleMatched", "no rule of configmap %s matches the node", RulesConfigMap)
+			l.Info(fmt.Sprintf("node:%s matches no rule, label left unchanged", node.Name))
+		}
+	case 1:
+		delete(r.conflicts, node.Name)
+		delete(r.unmatched, node.Name)
+	default:
+		delete(r.unmatched, node.Name)
+		conflict := strings.Join(names, ", ")
+		if r.conflicts[node.Name] != conflict {
+			r.conflicts[node.Name] = conflict
+			r.Recorder.Eventf(node, corev1.EventTypeWarning, "NodeRuleConflict", "rules assign the node to different nodepools: %s", conflict)
+			l.Info(fmt.Sprintf("node:%s matches conflicting rules: %s, label left unchanged", node.Name, conflict))
+		}
+	}
+	ruleConflicts.Set(float64(len(r.conflicts)))
+	ruleUnmatchedNodes.Set(float64(len(r.unmatched)))
+}
+
+// forget drops a deleted node from the reports
+func (r *RulesReconciler) forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conflicts, name)
+	delete(r.unmatched, name)
+	ruleConflicts.Set(float64(len(r.conflicts)))
+	ruleUnmatchedNodes.Set(float64(len(r.unmatched)))
+}
+
+func rulesConfigMapKey() types.NamespacedName {
+	parts := strings.SplitN(RulesConfigMap, "/", 2)
+	if len(parts) != 2 {
+		return types.NamespacedName{Name: RulesConfigMap}
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// A change of the rules reconciles every node.
+// The rules ConfigMap is watched through its own cache, the manager's cache would hold every ConfigMap of the cluster.
+func (r *RulesReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	key := rulesConfigMapKey()
+	configMaps, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:    mgr.GetScheme(),
+		Mapper:    mgr.GetRESTMapper(),
+		Namespace: key.Namespace,
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.ConfigMap{}: {Field: fields.OneTermEqualSelector("metadata.name", key.Name)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err = mgr.Add(configMaps); err != nil {
+		return err
+	}
+	r.configMaps = configMaps
+
+	isRules := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == key.Namespace && obj.GetName() == key.Name
+	})
+	allNodes := func(obj client.Object) []reconcile.Request {
+		nodes := corev1.NodeList{}
+		if err := mgr.GetClient().List(context.Background(), &nodes); err != nil {
+			ctrl.Log.Error(err, "failed to list nodes for the node rules")
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(nodes.Items))
+		for _, node := range nodes.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: node.Name}})
+		}
+		return requests
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("noderules").
+		For(&corev1.Node{}, builder.WithPredicates(nodeMembershipChanged)).
+		Watches(source.NewKindWithCache(&corev1.ConfigMap{}, configMaps),
+			handler.EnqueueRequestsFromMapFunc(allNodes),
+			builder.WithPredicates(isRules)).
+		Complete(r)
+}
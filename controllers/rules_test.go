@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const testRules = `rules:
+- name: gpu
+  pool: team-a
+  hostname: ^gpu-
+- name: large
+  pool: team-b
+  instanceTypes: [m5.4xlarge]
+`
+
+func TestParseNodeRulesInvalid(t *testing.T) {
+	for _, data := range []string{
+		"rules:\n- name: all\n  pool: team-a\n",
+		"rules:\n- name: gpu\n  hostname: ^gpu-\n",
+		"rules:\n- name: gpu\n  pool: team-a\n  hostname: '('\n",
+		"rules:\n- name: gpu\n  pool: team-a\n  zone: a\n",
+	} {
+		if _, err := parseNodeRules(data); err == nil {
+			t.Errorf("rules accepted:\n%s", data)
+		}
+	}
+}
+
+func TestRulesReconcile(t *testing.T) {
+	RulesConfigMap = "nodepool-system/node-rules"
+	defer func() { RulesConfigMap = "" }()
+
+	node := func(name, instanceType, pool string) *corev1.Node {
+		n := testNode(name, pool)
+		if n.Labels == nil {
+			n.Labels = make(map[string]string)
+		}
+		n.Labels[labelInstanceType] = instanceType
+		return n
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nodepool-system", Name: "node-rules"},
+		Data:       map[string]string{RulesConfigMapKey: testRules},
+	}
+	c := newTestClient(t, cm,
+		node("gpu-1", "p3.2xlarge", ""),
+		node("gpu-2", "m5.4xlarge", "team-c"),
+		node("web-1", "m5.4xlarge", "team-c"),
+		node("web-2", "m5.large", "team-c"),
+	)
+	r := &RulesReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+
+	want := map[string]string{
+		"gpu-1": "team-a", // hostname
+		"gpu-2": "team-c", // 规则冲突，标签不变
+		"web-1": "team-b", // instance type
+		"web-2": "team-c", // 没有匹配的规则
+	}
+	for name, value := range want {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+		got := &corev1.Node{}
+		if err := c.Get(ctx, types.NamespacedName{Name: name}, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Labels[LableNodePoolKey] != value {
+			t.Errorf("node %s labelled %s=%s, want %s", name, LableNodePoolKey, got.Labels[LableNodePoolKey], value)
+		}
+	}
+	if len(r.conflicts) != 1 || r.conflicts["gpu-2"] == "" || len(r.unmatched) != 1 || !r.unmatched["web-2"] {
+		t.Fatalf("conflicts %v, unmatched %v", r.conflicts, r.unmatched)
+	}
+
+	// 删除的node不再报告
+	if err := c.Delete(ctx, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "web-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "web-2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.unmatched) != 0 {
+		t.Fatalf("deleted node still reported unmatched: %v", r.unmatched)
+	}
+}
+
+func TestRulesKeepExplicitRelabels(t *testing.T) {
+	RulesConfigMap = "nodepool-system/node-rules"
+	defer func() { RulesConfigMap = "" }()
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "nodepool-system", Name: "node-rules"},
+		Data:       map[string]string{RulesConfigMapKey: testRules},
+	}
+	moved := testNode("gpu-moved", "team-c")
+	moved.Annotations = map[string]string{AnnotationMovedBy: "move"}
+	c := newTestClient(t, cm, testNode("gpu-1", ""), moved)
+	r := &RulesReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+
+	reconcileLabel := func(name string) string {
+		t.Helper()
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+		node := &corev1.Node{}
+		if err := c.Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+			t.Fatal(err)
+		}
+		return node.Labels[LableNodePoolKey]
+	}
+
+	// NodePoolMove移动过的node不再被规则修改
+	if value := reconcileLabel("gpu-moved"); value != "team-c" {
+		t.Fatalf("moved node relabelled to %s", value)
+	}
+
+	if value := reconcileLabel("gpu-1"); value != "team-a" {
+		t.Fatalf("node labelled %s, want team-a", value)
+	}
+	// 手动修改规则设置的标签后规则不再覆盖
+	node := &corev1.Node{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "gpu-1"}, node); err != nil {
+		t.Fatal(err)
+	}
+	node.Labels[LableNodePoolKey] = "team-c"
+	if err := c.Update(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	if value := reconcileLabel("gpu-1"); value != "team-c" {
+		t.Fatalf("manually relabelled node reverted to %s", value)
+	}
+}
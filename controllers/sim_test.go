@@ -0,0 +1,396 @@
+package controllers
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// 模拟耗时较长，需要显式开启，eg: go test ./controllers -run TestSimulation -v -sim -sim.nodes=5000 -sim.namespaces=500
+var (
+	simRun        = flag.Bool("sim", false, "run the scale simulation, it takes minutes")
+	simNodes      = flag.Int("sim.nodes", 2000, "number of nodes created by the simulation")
+	simNamespaces = flag.Int("sim.namespaces", 200, "number of namespaces, each with a default nodepool, created by the simulation")
+	simChurn      = flag.Int("sim.churn", 100, "number of nodes relabelled at once by a churn burst of the simulation")
+)
+
+// simClient counts the API calls of the reconcilers and serves field selectors like indexedClient.
+type simClient struct {
+	client.Client
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *simClient) count(verb string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[verb]++
+}
+
+func (c *simClient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = make(map[string]int)
+}
+
+func (c *simClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	c.count("get")
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *simClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.count("list")
+	return indexedClient{c.Client}.List(ctx, list, opts...)
+}
+
+func (c *simClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.count("create")
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *simClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.count("update")
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *simClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.count("patch")
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *simClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.count("delete")
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *simClient) Status() client.StatusWriter {
+	return &simStatusWriter{StatusWriter: c.Client.Status(), c: c}
+}
+
+type simStatusWriter struct {
+	client.StatusWriter
+	c *simClient
+}
+
+func (w *simStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	w.c.count("status.update")
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (w *simStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	w.c.count("status.patch")
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+// simulation drives the NodePool and Node reconcilers over a fake cluster the way their watches would:
+// node events are mapped to nodepools with NodeToPools and a status change requeues its nodepool.
+// The queues are drained one request at a time, so reconciles never race like in TestNodePoolReconcileNodeChurn.
+type simulation struct {
+	c      *simClient
+	pools  *NodePoolReconciler
+	nodes  *NodeReconciler
+	toPool func(client.Object) []reconcile.Request
+
+	namespaces []string
+	labels     map[string]string
+	poolQueue  map[types.NamespacedName]bool
+	nodeQueue  map[types.NamespacedName]bool
+}
+
+// simStats of a run until convergence
+type simStats struct {
+	poolReconciles int
+	nodeReconciles int
+	errors         int
+	calls          map[string]int
+	elapsed        time.Duration
+}
+
+func (s simStats) apiCalls() int {
+	total := 0
+	for _, n := range s.calls {
+		total += n
+	}
+	return total
+}
+
+func newSimulation(tb testing.TB, namespaces, nodes int) *simulation {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		tb.Fatal(err)
+	}
+	if err := poolv1.AddToScheme(scheme); err != nil {
+		tb.Fatal(err)
+	}
+
+	s := &simulation{
+		labels:    make(map[string]string, nodes),
+		poolQueue: make(map[types.NamespacedName]bool),
+		nodeQueue: make(map[types.NamespacedName]bool),
+	}
+	objs := make([]client.Object, 0, 2*namespaces+nodes)
+	for i := 0; i < namespaces; i++ {
+		ns := fmt.Sprintf("ns-%d", i)
+		s.namespaces = append(s.namespaces, ns)
+		objs = append(objs, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}, GenerateNodePoolObj(DefaultNodePoolName, ns))
+		s.poolQueue[types.NamespacedName{Namespace: ns, Name: DefaultNodePoolName}] = true
+	}
+	for i := 0; i < nodes; i++ {
+		name := fmt.Sprintf("node-%d", i)
+		ns := s.namespaces[i%namespaces]
+		s.labels[name] = ns
+		objs = append(objs, testNode(name, ns))
+	}
+
+	s.c = &simClient{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		calls:  make(map[string]int),
+	}
+	// 事件直接丢弃，避免FakeRecorder的channel写满后阻塞
+	recorder := &record.FakeRecorder{}
+	s.pools = &NodePoolReconciler{Client: s.c, Scheme: scheme, Recorder: recorder}
+	s.nodes = &NodeReconciler{Client: s.c, Scheme: scheme, Recorder: recorder}
+	s.toPool = NodeToPools(s.c)
+	return s
+}
+
+// churn relabels n random nodes into a random nodepool and queues the resulting events
+func (s *simulation) churn(tb testing.TB, rng *rand.Rand, n int) {
+	ctx := context.Background()
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rng.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	if n > len(names) {
+		n = len(names)
+	}
+
+	for _, name := range names[:n] {
+		node := &corev1.Node{}
+		if err := s.c.Client.Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+			tb.Fatal(err)
+		}
+		old := node.DeepCopy()
+		value := s.namespaces[rng.Intn(len(s.namespaces))]
+		node.Labels[LableNodePoolKey] = value
+		if err := s.c.Client.Update(ctx, node); err != nil {
+			tb.Fatal(err)
+		}
+		s.labels[name] = value
+		s.enqueueNode(old, node)
+	}
+}
+
+// enqueueNode queues the requests a node update event produces
+func (s *simulation) enqueueNode(old, node *corev1.Node) {
+	s.nodeQueue[types.NamespacedName{Name: node.Name}] = true
+	for _, obj := range []client.Object{old, node} {
+		for _, req := range s.toPool(obj) {
+			s.poolQueue[req.NamespacedName] = true
+		}
+	}
+}
+
+// run reconciles until both queues are empty and returns what it took
+func (s *simulation) run(tb testing.TB) simStats {
+	ctx := context.Background()
+	s.c.reset()
+	stats := simStats{}
+	start := time.Now()
+
+	// 每个对象最多调谐的轮数，超过则认为没有收敛
+	limit := 20 * (len(s.labels) + len(s.namespaces))
+	for len(s.poolQueue)+len(s.nodeQueue) > 0 {
+		if stats.poolReconciles+stats.nodeReconciles > limit {
+			tb.Fatalf("no convergence after %d reconciles", limit)
+		}
+
+		for req := range s.nodeQueue {
+			delete(s.nodeQueue, req)
+			stats.nodeReconciles++
+			if _, err := s.nodes.Reconcile(ctx, ctrl.Request{NamespacedName: req}); err != nil {
+				stats.errors++
+				s.nodeQueue[req] = true
+			}
+		}
+
+		for req := range s.poolQueue {
+			delete(s.poolQueue, req)
+			before := s.poolVersion(tb, req)
+			stats.poolReconciles++
+			if _, err := s.pools.Reconcile(ctx, ctrl.Request{NamespacedName: req}); err != nil {
+				stats.errors++
+				s.poolQueue[req] = true
+				continue
+			}
+			// nodepool的变化会再次触发自身的调谐
+			if s.poolVersion(tb, req) != before {
+				s.poolQueue[req] = true
+			}
+		}
+	}
+
+	stats.elapsed = time.Since(start)
+	s.c.mu.Lock()
+	stats.calls = s.c.calls
+	s.c.mu.Unlock()
+	return stats
+}
+
+func (s *simulation) poolVersion(tb testing.TB, req types.NamespacedName) string {
+	pool := &poolv1.NodePool{}
+	if err := s.c.Client.Get(context.Background(), req, pool); err != nil {
+		tb.Fatal(err)
+	}
+	return pool.ResourceVersion
+}
+
+// verify checks that Status.Nodes of every nodepool converged to the node labels
+func (s *simulation) verify(tb testing.TB) {
+	want := make(map[string][]string, len(s.namespaces))
+	for name, ns := range s.labels {
+		want[ns] = append(want[ns], name)
+	}
+
+	pools := poolv1.NodePoolList{}
+	if err := s.c.Client.List(context.Background(), &pools); err != nil {
+		tb.Fatal(err)
+	}
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		nodes := want[pool.Namespace]
+		sort.Strings(nodes)
+		if len(nodes) == 0 && len(pool.Status.Nodes) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(nodes, pool.Status.Nodes) {
+			tb.Fatalf("nodepool %s/%s has nodes %v, want %v", pool.Namespace, pool.Name, pool.Status.Nodes, nodes)
+		}
+	}
+}
+
+func (s simStats) String() string {
+	verbs := make([]string, 0, len(s.calls))
+	for verb := range s.calls {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	calls := ""
+	for _, verb := range verbs {
+		calls += fmt.Sprintf(" %s=%d", verb, s.calls[verb])
+	}
+	return fmt.Sprintf("converged in %v: %d nodepool reconciles, %d node reconciles, %d errors, %d api calls:%s",
+		s.elapsed, s.poolReconciles, s.nodeReconciles, s.errors, s.apiCalls(), calls)
+}
+
+func TestSimulationNodeChurn(t *testing.T) {
+	if !*simRun {
+		t.Skip("scale simulation not enabled, run with -sim")
+	}
+	s := newSimulation(t, *simNamespaces, *simNodes)
+	rng := rand.New(rand.NewSource(1))
+
+	stats := s.run(t)
+	s.verify(t)
+	t.Logf("initial sync of %d nodes into %d nodepools %v", *simNodes, *simNamespaces, stats)
+	if stats.poolReconciles > 2*(*simNamespaces) {
+		t.Errorf("initial sync took %d nodepool reconciles, want at most 2 per nodepool", stats.poolReconciles)
+	}
+
+	for burst := 0; burst < 3; burst++ {
+		s.churn(t, rng, *simChurn)
+		stats = s.run(t)
+		s.verify(t)
+		t.Logf("burst %d relabelling %d nodes %v", burst, *simChurn, stats)
+		// 每个node事件最多影响新旧两个nodepool，每个nodepool调谐后最多再触发一次
+		if stats.poolReconciles > 4*(*simChurn) {
+			t.Errorf("burst %d took %d nodepool reconciles for %d relabelled nodes", burst, stats.poolReconciles, *simChurn)
+		}
+		if stats.errors > 0 {
+			t.Errorf("burst %d had %d failed reconciles", burst, stats.errors)
+		}
+	}
+}
+
+func BenchmarkSimulationNodeChurn(b *testing.B) {
+	s := newSimulation(b, *simNamespaces, *simNodes)
+	s.run(b)
+	rng := rand.New(rand.NewSource(1))
+
+	var reconciles, calls int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		s.churn(b, rng, *simChurn)
+		b.StartTimer()
+		stats := s.run(b)
+		reconciles += stats.poolReconciles + stats.nodeReconciles
+		calls += stats.apiCalls()
+	}
+	b.StopTimer()
+	s.verify(b)
+	b.ReportMetric(float64(reconciles)/float64(b.N), "reconciles/op")
+	b.ReportMetric(float64(calls)/float64(b.N), "apicalls/op")
+}
+
+func benchmarkNodes(pools, nodes int) *corev1.NodeList {
+	list := &corev1.NodeList{Items: make([]corev1.Node, 0, nodes)}
+	for i := 0; i < nodes; i++ {
+		list.Items = append(list.Items, *testNode(fmt.Sprintf("node-%d", i), fmt.Sprintf("ns-%d", i%pools)))
+	}
+	return list
+}
+
+func BenchmarkFindMatchNodesByNodepool(b *testing.B) {
+	for _, nodes := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			list := benchmarkNodes(10, nodes)
+			pool := GenerateNodePoolObj(DefaultNodePoolName, "ns-0")
+			_, pool.Status.Nodes = FindMatchNodesByNodepool(list, pool)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				FindMatchNodesByNodepool(list, pool)
+			}
+		})
+	}
+}
+
+func BenchmarkAddNodeUnique(b *testing.B) {
+	for _, nodes := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			members := make([]string, 0, nodes)
+			for i := 0; i < nodes; i++ {
+				members = append(members, fmt.Sprintf("node-%d", i))
+			}
+			sort.Strings(members)
+			added := []string{"node-new", fmt.Sprintf("node-%d", nodes/2)}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// AddNodeUnique会追加到members的底层数组，每次使用副本
+				nodes := append(make([]string, 0, len(members)+len(added)), members...)
+				AddNodeUnique(nodes, added...)
+			}
+		})
+	}
+}
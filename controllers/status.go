@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	poolv1 "nodepool/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Field managers of the controllers writing NodePoolStatus, each one owns its part of the status
+const (
+	FieldOwnerNodePool    = "nodepool-controller"
+	FieldOwnerNode        = "nodepool-node-controller"
+	FieldOwnerDrift       = "nodepool-drift-controller"
+	FieldOwnerDiagnostics = "nodepool-diagnostics-controller"
+	FieldOwnerNamespace   = "nodepool-namespace-controller"
+)
+
+// statusBackoff spreads the retries of controllers racing for the same nodepool, eg: many nodes relabelled at once
+var statusBackoff = wait.Backoff{
+	Steps:    10,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   1.0,
+}
+
+// PatchPoolStatus applies mutate to the nodepool and sends the status difference as a merge patch.
+// Merge patches replace lists as a whole, so a patch changing the lists several controllers write, conditions
+// and releasing, or the history appended to, carries the resourceVersion; on conflict the nodepool is read again and mutate applied anew.
+// Nothing is sent when mutate leaves the status unchanged.
+func PatchPoolStatus(ctx context.Context, c client.Client, pool *poolv1.NodePool, owner string, mutate func(pool *poolv1.NodePool)) error {
+	first := true
+	return retry.RetryOnConflict(statusBackoff, func() error {
+		if !first {
+			if err := c.Get(ctx, client.ObjectKeyFromObject(pool), pool); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		orig := pool.DeepCopy()
+		mutate(pool)
+		if equality.Semantic.DeepEqual(orig.Status, pool.Status) {
+			return nil
+		}
+
+		var opts []client.MergeFromOption
+		if !equality.Semantic.DeepEqual(orig.Status.Conditions, pool.Status.Conditions) ||
+			!equality.Semantic.DeepEqual(orig.Status.Releasing, pool.Status.Releasing) ||
+			!equality.Semantic.DeepEqual(orig.Status.History, pool.Status.History) {
+			opts = append(opts, client.MergeFromWithOptimisticLock{})
+		}
+		return c.Status().Patch(ctx, pool, client.MergeFromWithOptions(orig, opts...), client.FieldOwner(owner))
+	})
+}
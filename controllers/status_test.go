@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	poolv1 "nodepool/api/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const testNamespace = "tenant"
+
+var testPoolKey = types.NamespacedName{Namespace: testNamespace, Name: DefaultNodePoolName}
+
+func newTestClient(t *testing.T, objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := poolv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	objs = append(objs,
+		GenerateNodePoolObj(DefaultNodePoolName, testNamespace),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}},
+	)
+	// fake client不生成UID
+	for _, obj := range objs {
+		if obj.GetUID() == "" {
+			obj.SetUID(types.UID(fmt.Sprintf("%T/%s/%s", obj, obj.GetNamespace(), obj.GetName())))
+		}
+	}
+	return indexedClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+// indexedClient serves field selectors from the indexes registered by SetupFieldIndexes, which the fake client ignores
+type indexedClient struct {
+	client.Client
+}
+
+func (c indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	o := &client.ListOptions{}
+	o.ApplyOptions(opts)
+	if o.FieldSelector == nil || o.FieldSelector.Empty() {
+		return c.Client.List(ctx, list, opts...)
+	}
+
+	err := c.Client.List(ctx, list, &client.ListOptions{Namespace: o.Namespace, LabelSelector: o.LabelSelector})
+	if err != nil {
+		return err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	kept := make([]runtime.Object, 0, len(items))
+	for _, item := range items {
+		ok, err := matchesIndexes(item.(client.Object), o.FieldSelector)
+		if err != nil {
+			return err
+		}
+		if ok {
+			kept = append(kept, item)
+		}
+	}
+	return meta.SetList(list, kept)
+}
+
+// matchesIndexes evaluates field=value requirements against fieldIndexes like the cache does
+func matchesIndexes(obj client.Object, selector fields.Selector) (bool, error) {
+	for _, req := range selector.Requirements() {
+		var index *fieldIndex
+		for i := range fieldIndexes {
+			if fieldIndexes[i].field == req.Field && reflect.TypeOf(fieldIndexes[i].obj) == reflect.TypeOf(obj) {
+				index = &fieldIndexes[i]
+				break
+			}
+		}
+		if index == nil {
+			return false, fmt.Errorf("index with name field:%s does not exist", req.Field)
+		}
+		found := false
+		for _, value := range index.extract(obj) {
+			if value == req.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func testNode(name, pool string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if pool != "" {
+		node.Labels = map[string]string{LableNodePoolKey: pool}
+	}
+	return node
+}
+
+func getTestPool(t *testing.T, c client.Client) *poolv1.NodePool {
+	pool := &poolv1.NodePool{}
+	if err := c.Get(context.Background(), testPoolKey, pool); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestPatchPoolStatusConcurrentWriters(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	// 每个writer都持有同一个过期的副本
+	const writers = 8
+	stale := make([]*poolv1.NodePool, writers)
+	for i := range stale {
+		stale[i] = getTestPool(t, c)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- PatchPoolStatus(ctx, c, stale[i], fmt.Sprintf("writer-%d", i), func(pool *poolv1.NodePool) {
+				meta.SetStatusCondition(&pool.Status.Conditions, metav1.Condition{
+					Type:   fmt.Sprintf("Writer%d", i),
+					Status: metav1.ConditionTrue,
+					Reason: "Written",
+				})
+				pool.Status.Releasing = append(pool.Status.Releasing, poolv1.NodeRelease{
+					Node:  fmt.Sprintf("node-%d", i),
+					Phase: poolv1.ReleasePhaseDraining,
+				})
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("patch failed: %v", err)
+		}
+	}
+
+	pool := getTestPool(t, c)
+	if len(pool.Status.Conditions) != writers || len(pool.Status.Releasing) != writers {
+		t.Fatalf("lost writes: %d conditions, %d releasing entries, want %d",
+			len(pool.Status.Conditions), len(pool.Status.Releasing), writers)
+	}
+	for i := 0; i < writers; i++ {
+		if meta.FindStatusCondition(pool.Status.Conditions, fmt.Sprintf("Writer%d", i)) == nil {
+			t.Errorf("condition of writer %d lost", i)
+		}
+		if findNodeRelease(pool, fmt.Sprintf("node-%d", i)) == nil {
+			t.Errorf("release of writer %d lost", i)
+		}
+	}
+}
+
+func TestPatchPoolStatusSkipsUnchanged(t *testing.T) {
+	c := newTestClient(t)
+	pool := getTestPool(t, c)
+	rv := pool.ResourceVersion
+
+	err := PatchPoolStatus(context.Background(), c, pool, FieldOwnerNodePool, func(pool *poolv1.NodePool) {
+		pool.Status.Nodes = nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getTestPool(t, c).ResourceVersion; got != rv {
+		t.Fatalf("unchanged status was written, resourceVersion %s -> %s", rv, got)
+	}
+}
+
+func TestNodePoolReconcileNodeChurn(t *testing.T) {
+	const nodes = 10
+	objs := make([]client.Object, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		objs = append(objs, testNode(fmt.Sprintf("node-%d", i), ""))
+	}
+	c := newTestClient(t, objs...)
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: testPoolKey}
+
+	var wg sync.WaitGroup
+	// 并发给node打上nodepool标签
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			node := &corev1.Node{}
+			if err := c.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("node-%d", i)}, node); err != nil {
+				t.Error(err)
+				return
+			}
+			node.Labels = map[string]string{LableNodePoolKey: testNamespace}
+			if err := c.Update(ctx, node); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// 其他controller同时写入自己的condition
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := PatchPoolStatus(ctx, c, getTestPool(t, c), FieldOwnerDrift, func(pool *poolv1.NodePool) {
+			meta.SetStatusCondition(&pool.Status.Conditions, metav1.Condition{
+				Type:   poolv1.ConditionPodsDrifted,
+				Status: metav1.ConditionFalse,
+				Reason: "AllPodsInPool",
+			})
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	// node变化触发的调谐
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Reconcile(ctx, req); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	pool := getTestPool(t, c)
+	if len(pool.Status.Nodes) != nodes {
+		t.Fatalf("nodepool has nodes %v, want %d nodes", pool.Status.Nodes, nodes)
+	}
+	if meta.FindStatusCondition(pool.Status.Conditions, poolv1.ConditionPodsDrifted) == nil {
+		t.Fatalf("condition of the drift controller lost: %v", pool.Status.Conditions)
+	}
+}
+
+func TestNodePoolReconcileHistory(t *testing.T) {
+	joining := testNode("node-b", testNamespace)
+	joining.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:    "kubectl-label",
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:nodepool":{}}}}`)},
+	}}
+	c := newTestClient(t, testNode("node-a", testNamespace), joining, testNode("node-c", ""))
+	r := &NodePoolReconciler{Client: c, Scheme: c.Scheme(), Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+	pool := getTestPool(t, c)
+	pool.Status.Nodes = []string{"node-a", "node-c", "node-d"}
+	if err := c.Status().Update(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	history := getTestPool(t, c).Status.History
+	got := make([]string, 0, len(history))
+	for _, event := range history {
+		got = append(got, fmt.Sprintf("%s %s %s %s", event.Node, event.Type, event.Reason, event.Actor))
+	}
+	want := []string{
+		"node-c Left LabelChanged ",
+		"node-d Left NodeDeleted ",
+		"node-b Joined LabelChanged kubectl-label",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("history %q, want %q", got, want)
+	}
+
+	// 没有变化时不再记录
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: testPoolKey}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(getTestPool(t, c).Status.History); n != len(want) {
+		t.Fatalf("history has %d events after a no-op reconcile, want %d", n, len(want))
+	}
+}
+
+func TestAppendHistoryBounded(t *testing.T) {
+	var history []poolv1.MembershipEvent
+	for i := 0; i < poolv1.MaxHistory+5; i++ {
+		history = appendHistory(history, poolv1.MembershipEvent{Node: fmt.Sprintf("node-%d", i)})
+	}
+	if len(history) != poolv1.MaxHistory || history[0].Node != "node-5" {
+		t.Fatalf("history has %d events starting at %s, want %d starting at node-5", len(history), history[0].Node, poolv1.MaxHistory)
+	}
+}
@@ -14,23 +14,31 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package controllers
+package controllers_test
 
 import (
+	"context"
+	"io/ioutil"
 	"path/filepath"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
 
 	nodesv1 "nodepool/api/v1"
+	"nodepool/apiserver/webhook"
+	"nodepool/controllers"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -40,6 +48,10 @@ import (
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var cancel context.CancelFunc
+
+// exceptionNs is excluded from nodepools like kube-system
+const exceptionNs = "exception-ns"
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -56,9 +68,13 @@ var _ = BeforeSuite(func() {
 	testEnv = &envtest.Environment{
 		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
 		ErrorIfCRDPathMissing: true,
+		WebhookInstallOptions: envtest.WebhookInstallOptions{
+			MutatingWebhooks: []*admissionregistrationv1.MutatingWebhookConfiguration{loadMutatingWebhook()},
+		},
 	}
 
-	cfg, err := testEnv.Start()
+	var err error
+	cfg, err = testEnv.Start()
 	Expect(err).NotTo(HaveOccurred())
 	Expect(cfg).NotTo(BeNil())
 
@@ -71,10 +87,74 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	Expect(k8sClient).NotTo(BeNil())
 
+	By("starting the reconcilers")
+	controllers.ExceptionNs = []string{"kube-system", exceptionNs}
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(controllers.SetupFieldIndexes(mgr)).To(Succeed())
+
+	err = (&controllers.NamespaceReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("nodepool-namespace"),
+	}).SetupWithManager(mgr)
+	Expect(err).NotTo(HaveOccurred())
+	err = (&controllers.NodePoolReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("nodepool"),
+	}).SetupWithManager(mgr)
+	Expect(err).NotTo(HaveOccurred())
+	err = (&controllers.NodeReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Recorder:   mgr.GetEventRecorderFor("nodepool-node"),
+		KubeClient: kubernetes.NewForConfigOrDie(cfg),
+	}).SetupWithManager(mgr)
+	Expect(err).NotTo(HaveOccurred())
+
+	By("starting the webhook server")
+	options := testEnv.WebhookInstallOptions
+	webhook.TLSCertFile = filepath.Join(options.LocalServingCertDir, "tls.crt")
+	webhook.TLSKeyFile = filepath.Join(options.LocalServingCertDir, "tls.key")
+	webhook.NewServer(options.LocalServingHost, options.LocalServingPort, mgr.GetClient(), mgr.GetEventRecorderFor("nodepool-webhook")).Start()
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		defer GinkgoRecover()
+		err := mgr.Start(ctx)
+		Expect(err).NotTo(HaveOccurred())
+	}()
+	Expect(mgr.GetCache().WaitForCacheSync(ctx)).To(BeTrue())
+
 }, 60)
 
+// loadMutatingWebhook reads the webhook configuration deployed with the manager and points it to
+// the local webhook server, envtest replaces a service path with the local serving address
+func loadMutatingWebhook() *admissionregistrationv1.MutatingWebhookConfiguration {
+	data, err := ioutil.ReadFile(filepath.Join("..", "mutatingwebhook.yaml"))
+	Expect(err).NotTo(HaveOccurred())
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	Expect(yaml.Unmarshal(data, config)).To(Succeed())
+
+	path := "mutating"
+	for i := range config.Webhooks {
+		config.Webhooks[i].ClientConfig = admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{Path: &path},
+		}
+	}
+	return config
+}
+
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	if cancel != nil {
+		cancel()
+	}
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	poolv1 "nodepool/api/v1"
+)
+
+// TopologyCounts Number of the named nodes per zone and per region, nodes without the label are not counted
+func TopologyCounts(nodeList *corev1.NodeList, names []string) (zones, regions map[string]int32) {
+	members := make(map[string]bool, len(names))
+	for _, name := range names {
+		members[name] = true
+	}
+
+	for i := 0; i < len(nodeList.Items); i++ {
+		node := &nodeList.Items[i]
+		if !members[node.Name] {
+			continue
+		}
+		if zone, ok := node.Labels[corev1.LabelTopologyZone]; ok {
+			if zones == nil {
+				zones = make(map[string]int32)
+			}
+			zones[zone]++
+		}
+		if region, ok := node.Labels[corev1.LabelTopologyRegion]; ok {
+			if regions == nil {
+				regions = make(map[string]int32)
+			}
+			regions[region]++
+		}
+	}
+	return zones, regions
+}
+
+// setTopologyCondition evaluates spec.topology against the zone counts of the status,
+// the condition is removed when the nodepool has no topology requirement
+func setTopologyCondition(pool *poolv1.NodePool) {
+	topology := pool.Spec.Topology
+	if topology == nil || (topology.MinZones == nil && topology.MaxSkew == nil) {
+		meta.RemoveStatusCondition(&pool.Status.Conditions, poolv1.ConditionTopologyDegraded)
+		return
+	}
+
+	cond := metav1.Condition{
+		Type:               poolv1.ConditionTopologyDegraded,
+		Status:             metav1.ConditionFalse,
+		Reason:             "TopologySatisfied",
+		Message:            fmt.Sprintf("nodes span %d zone(s)", len(pool.Status.Zones)),
+		ObservedGeneration: pool.Generation,
+	}
+
+	zones := len(pool.Status.Zones)
+	min, max := int32(0), int32(0)
+	for _, count := range pool.Status.Zones {
+		if min == 0 || count < min {
+			min = count
+		}
+		if count > max {
+			max = count
+		}
+	}
+
+	var problems []string
+	reason := ""
+	if topology.MinZones != nil && int32(zones) < *topology.MinZones {
+		reason = "TooFewZones"
+		problems = append(problems, fmt.Sprintf("nodes span %d zone(s), %d required", zones, *topology.MinZones))
+	}
+	if topology.MaxSkew != nil && max-min > *topology.MaxSkew {
+		if reason == "" {
+			reason = "ZoneSkew"
+		}
+		problems = append(problems, fmt.Sprintf("zone node counts %s differ by %d, max skew %d",
+			formatZoneCounts(pool.Status.Zones), max-min, *topology.MaxSkew))
+	}
+	if len(problems) > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = reason
+		cond.Message = strings.Join(problems, "; ")
+	}
+	meta.SetStatusCondition(&pool.Status.Conditions, cond)
+}
+
+// formatZoneCounts renders the zone counts sorted by zone, eg: a=2,b=1
+func formatZoneCounts(zones map[string]int32) string {
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, zones[name]))
+	}
+	return strings.Join(parts, ",")
+}
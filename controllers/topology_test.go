@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	poolv1 "nodepool/api/v1"
+)
+
+func TestTopologyCounts(t *testing.T) {
+	zoned := func(name, zone string) corev1.Node {
+		node := testNode(name, testNamespace)
+		node.Labels[corev1.LabelTopologyZone] = zone
+		node.Labels[corev1.LabelTopologyRegion] = "r1"
+		return *node
+	}
+	nodeList := &corev1.NodeList{Items: []corev1.Node{
+		zoned("node-a", "z1"), zoned("node-b", "z1"), zoned("node-c", "z2"), zoned("node-other", "z3"),
+		*testNode("node-unlabeled", testNamespace),
+	}}
+
+	zones, regions := TopologyCounts(nodeList, []string{"node-a", "node-b", "node-c", "node-unlabeled"})
+	if len(zones) != 2 || zones["z1"] != 2 || zones["z2"] != 1 {
+		t.Fatalf("zones %v, want z1=2,z2=1", zones)
+	}
+	if len(regions) != 1 || regions["r1"] != 3 {
+		t.Fatalf("regions %v, want r1=3", regions)
+	}
+}
+
+func TestSetTopologyCondition(t *testing.T) {
+	one, two := int32(1), int32(2)
+	tests := []struct {
+		name     string
+		topology *poolv1.NodePoolTopology
+		zones    map[string]int32
+		status   metav1.ConditionStatus
+		reason   string
+	}{
+		{name: "no requirement", zones: map[string]int32{"z1": 3}},
+		{name: "spread only", topology: &poolv1.NodePoolTopology{SpreadPods: true}, zones: map[string]int32{"z1": 3}},
+		{
+			name:     "satisfied",
+			topology: &poolv1.NodePoolTopology{MinZones: &two, MaxSkew: &one},
+			zones:    map[string]int32{"z1": 2, "z2": 1},
+			status:   metav1.ConditionFalse,
+			reason:   "TopologySatisfied",
+		},
+		{
+			name:     "too few zones",
+			topology: &poolv1.NodePoolTopology{MinZones: &two, MaxSkew: &one},
+			zones:    map[string]int32{"z1": 3},
+			status:   metav1.ConditionTrue,
+			reason:   "TooFewZones",
+		},
+		{
+			name:     "no nodes",
+			topology: &poolv1.NodePoolTopology{MinZones: &one},
+			status:   metav1.ConditionTrue,
+			reason:   "TooFewZones",
+		},
+		{
+			name:     "zone skew",
+			topology: &poolv1.NodePoolTopology{MaxSkew: &one},
+			zones:    map[string]int32{"z1": 3, "z2": 1},
+			status:   metav1.ConditionTrue,
+			reason:   "ZoneSkew",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := GenerateNodePoolObj(DefaultNodePoolName, testNamespace)
+			pool.Spec.Topology = tt.topology
+			pool.Status.Zones = tt.zones
+			// 之前的状态在没有要求后被清除
+			meta.SetStatusCondition(&pool.Status.Conditions, metav1.Condition{
+				Type: poolv1.ConditionTopologyDegraded, Status: metav1.ConditionTrue, Reason: "ZoneSkew",
+			})
+
+			setTopologyCondition(pool)
+			cond := meta.FindStatusCondition(pool.Status.Conditions, poolv1.ConditionTopologyDegraded)
+			if tt.status == "" {
+				if cond != nil {
+					t.Fatalf("condition %+v kept without a topology requirement", cond)
+				}
+				return
+			}
+			if cond == nil || cond.Status != tt.status || cond.Reason != tt.reason {
+				t.Fatalf("condition %+v, want %s %s", cond, tt.status, tt.reason)
+			}
+		})
+	}
+}
@@ -1,15 +1,26 @@
 package controllers
 
 import (
+	"context"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	poolv1 "nodepool/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sort"
 )
 
 const (
 	DefaultNodePoolName = "default"
 	LableNodePoolKey    = "nodepool"
+
+	// AnnotationReleasingFrom marks a node which is being drained of the pods of its previous nodepool
+	AnnotationReleasingFrom = "nodepool.sunkai.xyz/releasing-from"
+	// AnnotationCordoned marks a node cordoned by the controller, it is uncordoned once the node is handed over
+	AnnotationCordoned = "nodepool.sunkai.xyz/cordoned"
+	// AnnotationSkip exempts a pod from its nodepool, the creator needs the skip permission on nodepools
+	AnnotationSkip = "nodepool.sunkai.xyz/skip"
 )
 
 // GenerateNodePoolObj Generate NodePool object
@@ -20,8 +31,9 @@ func GenerateNodePoolObj(name, namespace string) *poolv1.NodePool {
 			APIVersion: "nodes.sunkai.xyz/v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
+			Name:       name,
+			Namespace:  namespace,
+			Finalizers: []string{NodePoolFinalizer},
 		},
 		Spec: poolv1.NodePoolSpec{
 			NodeSelector: map[string]string{LableNodePoolKey: namespace},
@@ -64,7 +76,7 @@ func FindMatchNodesByNodepool(allNodes *corev1.NodeList, pool *poolv1.NodePool)
 	// 找出符合nodepool的node
 	for i := 0; i < len(allNodes.Items); i++ {
 		node := &allNodes.Items[i]
-		if nodeLabVal, ok := node.Labels[LableNodePoolKey]; !ok {
+		if nodeLabVal, ok := NodePoolValue(node); !ok {
 			continue
 		} else if nodeLabVal == pool.Spec.NodeSelector[LableNodePoolKey] {
 			haveNodePoolLables = append(haveNodePoolLables, node.Name)
@@ -88,8 +100,8 @@ func FindMatchNodesByNodepool(allNodes *corev1.NodeList, pool *poolv1.NodePool)
 }
 
 func FindNodepoolByNodeName(node string, pools *poolv1.NodePoolList) *poolv1.NodePool {
-	for _, pool := range pools.Items {
-		for i, nodeName := range pool.Status.Nodes {
+	for i := 0; i < len(pools.Items); i++ {
+		for _, nodeName := range pools.Items[i].Status.Nodes {
 			if node == nodeName {
 				return &pools.Items[i]
 			}
@@ -101,7 +113,7 @@ func FindNodepoolByNodeName(node string, pools *poolv1.NodePoolList) *poolv1.Nod
 func FindNodepoolByNodeObj(node *corev1.Node, pools *poolv1.NodePoolList) *poolv1.NodePool {
 	for i := 0; i < len(pools.Items); i++ {
 		pool := &pools.Items[i]
-		if nodeValue, ok := node.Labels[LableNodePoolKey]; ok {
+		if nodeValue, ok := NodePoolValue(node); ok {
 			if poolValue, ok := pool.Spec.NodeSelector[LableNodePoolKey]; ok && nodeValue == poolValue {
 				return pool
 			}
@@ -110,12 +122,64 @@ func FindNodepoolByNodeObj(node *corev1.Node, pools *poolv1.NodePoolList) *poolv
 	return nil
 }
 
-func deleteNodeFromPoolnodes(del string, nodes []string) (new []string) {
-	for _, node := range nodes {
-		if del == node {
-			continue
+// NodePoolValue The nodepool value the node belongs to.
+// A node being released still belongs to its previous nodepool until it is drained.
+func NodePoolValue(node *corev1.Node) (string, bool) {
+	if from, ok := node.Annotations[AnnotationReleasingFrom]; ok {
+		return from, true
+	}
+	value, ok := node.Labels[LableNodePoolKey]
+	return value, ok
+}
+
+// FindNodepoolBySelectorValue Find the nodepool selecting the nodepool label value
+func FindNodepoolBySelectorValue(value string, pools *poolv1.NodePoolList) *poolv1.NodePool {
+	for i := 0; i < len(pools.Items); i++ {
+		if PoolSelectorValue(&pools.Items[i]) == value {
+			return &pools.Items[i]
+		}
+	}
+	return nil
+}
+
+// GetNamespacePool Get the nodepool which pods of the namespace are pinned to,
+// the default nodepool of the namespace or of the nearest ancestor it inherits from
+func GetNamespacePool(ctx context.Context, c client.Reader, namespace string) (*poolv1.NodePool, error) {
+	owner, pool, err := resolveNamespacePool(ctx, c, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		return nil, errors.NewNotFound(poolv1.GroupVersion.WithResource("nodepools").GroupResource(), owner+"/"+DefaultNodePoolName)
+	}
+	return pool, nil
+}
+
+// PoolSelectorValue The nodepool label value selected by the pool
+func PoolSelectorValue(pool *poolv1.NodePool) string {
+	return pool.Spec.NodeSelector[LableNodePoolKey]
+}
+
+// GetNodePool Get the nodepool referenced by ref, the name defaults to the default nodepool
+func GetNodePool(ctx context.Context, c client.Reader, ref poolv1.NodePoolReference) (*poolv1.NodePool, error) {
+	name := ref.Name
+	if name == "" {
+		name = DefaultNodePoolName
+	}
+	pool := &poolv1.NodePool{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: name}, pool)
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// NodeInPool Whether the node is listed in pool.status.nodes
+func NodeInPool(node string, pool *poolv1.NodePool) bool {
+	for _, n := range pool.Status.Nodes {
+		if n == node {
+			return true
 		}
-		new = append(new, node)
 	}
-	return new
+	return false
 }
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/types"
+	poolv1 "nodepool/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// nodeMembershipChanged drops node updates which can not change any nodepool, like heartbeats.
+// Allocatable is the only status field the nodepools summarize.
+var nodeMembershipChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, ok := e.ObjectOld.(*corev1.Node)
+		if !ok {
+			return false
+		}
+		newNode, ok := e.ObjectNew.(*corev1.Node)
+		if !ok {
+			return false
+		}
+		return !equality.Semantic.DeepEqual(oldNode.Labels, newNode.Labels) ||
+			!equality.Semantic.DeepEqual(oldNode.Annotations, newNode.Annotations) ||
+			!equality.Semantic.DeepEqual(oldNode.Spec, newNode.Spec) ||
+			!equality.Semantic.DeepEqual(oldNode.Status.Allocatable, newNode.Status.Allocatable)
+	},
+}
+
+// NodeToPools Map a node to the nodepools it belongs to and the nodepools listing it as a member
+func NodeToPools(c client.Reader) func(obj client.Object) []reconcile.Request {
+	return func(obj client.Object) []reconcile.Request {
+		node, ok := obj.(*corev1.Node)
+		if !ok {
+			return nil
+		}
+		pools, err := NodeCandidatePools(context.Background(), c, node)
+		if err != nil {
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(pools.Items))
+		for i := range pools.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: pools.Items[i].Namespace, Name: pools.Items[i].Name},
+			})
+		}
+		return requests
+	}
+}
+
+// NodeCandidatePools Nodepools selecting the node's label or releasing-from annotation, plus those listing it as a member
+func NodeCandidatePools(ctx context.Context, c client.Reader, node *corev1.Node) (*poolv1.NodePoolList, error) {
+	values := make([]string, 0, 2)
+	if value, ok := node.Labels[LableNodePoolKey]; ok && value != "" {
+		values = append(values, value)
+	}
+	if from, ok := node.Annotations[AnnotationReleasingFrom]; ok && from != "" {
+		values = append(values, from)
+	}
+
+	result := &poolv1.NodePoolList{}
+	seen := make(map[types.UID]bool)
+	add := func(opts ...client.ListOption) error {
+		pools := poolv1.NodePoolList{}
+		if err := c.List(ctx, &pools, opts...); err != nil {
+			return err
+		}
+		for i := range pools.Items {
+			if !seen[pools.Items[i].UID] {
+				seen[pools.Items[i].UID] = true
+				result.Items = append(result.Items, pools.Items[i])
+			}
+		}
+		return nil
+	}
+
+	for _, value := range values {
+		if err := add(client.MatchingFields{PoolSelectorField: value}); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(client.MatchingFields{PoolNodesField: node.Name}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -18,18 +18,24 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	"go.uber.org/zap/zapcore"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -57,8 +63,27 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var exceptionNs string
+	var assignmentKeyFile string
 
 	flag.StringVar(&exceptionNs, "exception-namespaces", "kube-system", "These namespaces do not need to create nodepool, eg:kube-system,default")
+	flag.BoolVar(&controllers.EvictDriftedPods, "evict-drifted-pods", false, "Evict pods running on nodes outside of their namespace's nodepool")
+	flag.Float64Var(&controllers.DriftEvictionQPS, "drift-eviction-qps", 0.1, "Max evictions per second issued for drifted pods")
+	flag.BoolVar(&controllers.DrainOnRelease, "drain-on-release", false, "Cordon a node leaving its nodepool and evict the pods of the previous nodepool before handing it over")
+	flag.DurationVar(&controllers.ReleaseTimeout, "release-timeout", 10*time.Minute, "Max time to wait for pods to be evicted from a released node before handing it over anyway")
+	flag.StringVar(&controllers.FreePool, "free-pool", "", "Nodepool label value given to nodes of a deleted nodepool, the label is removed when empty")
+	flag.BoolVar(&controllers.TaintReleasedNodes, "taint-released-nodes", false, "Taint nodes of a deleted nodepool with "+controllers.TaintUnassigned+":NoSchedule until they are reassigned")
+	flag.BoolVar(&controllers.ManageQuota, "manage-quota", false, "Keep a ResourceQuota and LimitRange named "+controllers.QuotaObjectName+" in each namespace pinned to a default nodepool, its allocatable split evenly between them")
+	flag.Float64Var(&controllers.QuotaReserve, "quota-reserve", 0.1, "Fraction of the nodepool's allocatable kept out of the ResourceQuota")
+	flag.StringVar(&controllers.RulesConfigMap, "rules-configmap", "", "<namespace>/<name> of a ConfigMap whose "+controllers.RulesConfigMapKey+" rules assign nodes to nodepools by hostname, instance type or labels, disabled when empty")
+	flag.BoolVar(&webhook.MutateWorkloads, "mutate-workloads", false, "Also pin the pod templates of Deployments, ReplicaSets, StatefulSets, Jobs and CronJobs to the nodepool, the requests are only sent once the config/workload-webhook component is deployed")
+	flag.StringVar(&webhook.DefaultEnforcementMode, "enforcement-mode", webhook.EnforcementEnforce, "Default handling of pods bypassing their nodepool via spec.nodeName or nodeAffinity: enforce, warn or off. Overridden per namespace by the "+webhook.EnforcementAnnotationKey+" annotation")
+	flag.StringVar(&webhook.EmptyPoolPolicy, "empty-pool-policy", webhook.EmptyPoolWarn, "Handling of pods whose nodepool is unknown or has no ready node: reject, warn or fallback to --fallback-pool")
+	flag.StringVar(&controllers.FallbackPool, "fallback-pool", "", "Nodepool label value of the shared nodepool used by the fallback empty pool policy")
+	flag.BoolVar(&webhook.AuditMode, "audit", false, "Admit all requests unchanged and report the patches and denials the webhook would have made as warnings and events. Overridden per namespace by the "+webhook.AuditAnnotationKey+" annotation")
+	flag.IntVar(&webhook.DecisionLogSize, "decision-log-size", 200, "Number of recent admission decisions served on the /decisions endpoint of the metrics listener")
+	flag.StringVar(&webhook.TLSCertFile, "webhook-cert-file", webhook.TLSCertFile, "Serving certificate of the webhook server")
+	flag.StringVar(&webhook.TLSKeyFile, "webhook-key-file", webhook.TLSKeyFile, "Private key of the webhook serving certificate")
+	flag.StringVar(&assignmentKeyFile, "assignment-key-file", "", "Secret signing the "+controllers.AnnotationAssignedBy+" records of admitted pods, defaults to --webhook-key-file. Records signed with a previous key are no longer trusted, set it to keep them across certificate rotations")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -76,6 +101,14 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if assignmentKeyFile == "" {
+		assignmentKeyFile = webhook.TLSKeyFile
+	}
+	if err := controllers.LoadAssignmentKey(assignmentKeyFile); err != nil {
+		setupLog.Error(err, "unable to load the assignment key")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -88,12 +121,38 @@ func main() {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
-	s := webhook.NewServer("", 443)
-	s.Start()
+	ctx := ctrl.SetupSignalHandler()
+	s := webhook.NewServer("", 443, mgr.GetClient(), mgr.GetEventRecorderFor("nodepool-webhook"))
+	// 缓存同步前webhook读到的是空缓存，同步后再开始服务
+	for _, obj := range []client.Object{&corev1.Pod{}, &corev1.Node{}, &corev1.Namespace{}, &nodev1.NodePool{}, &appsv1.DaemonSet{}} {
+		if _, err := mgr.GetCache().GetInformer(ctx, obj); err != nil {
+			setupLog.Error(err, fmt.Sprintf("unable to get informer for %T", obj))
+			os.Exit(1)
+		}
+	}
+	synced := make(chan struct{})
+	go func() {
+		if !mgr.GetCache().WaitForCacheSync(ctx) {
+			return
+		}
+		s.Start()
+		close(synced)
+	}()
+	if err := mgr.AddMetricsExtraHandler("/decisions", s.DecisionsHandler()); err != nil {
+		setupLog.Error(err, "unable to serve the webhook decisions")
+		os.Exit(1)
+	}
 
+	controllers.FieldIndexerRun(mgr)
 	controllers.NameSpaceControllerRun(mgr)
 	controllers.NodePoolControllerRun(mgr)
 	controllers.NodeControllerRun(mgr)
+	controllers.NodePoolMoveControllerRun(mgr)
+	controllers.DriftControllerRun(mgr)
+	controllers.DiagnosticsControllerRun(mgr)
+	if controllers.RulesConfigMap != "" {
+		controllers.RulesControllerRun(mgr)
+	}
 
 	//+kubebuilder:scaffold:builder
 
@@ -105,9 +164,20 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("webhook", func(_ *http.Request) error {
+		select {
+		case <-synced:
+			return nil
+		default:
+			return fmt.Errorf("webhook not serving until the caches are synced")
+		}
+	}); err != nil {
+		setupLog.Error(err, "unable to set up webhook ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}